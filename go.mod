@@ -4,12 +4,15 @@ go 1.16
 
 require (
 	github.com/ClickHouse/clickhouse-go/v2 v2.0.12
+	github.com/google/uuid v1.3.0
 	github.com/hpcloud/tail v1.0.0
 	github.com/json-iterator/go v1.1.11
+	github.com/klauspost/compress v1.14.2
 	github.com/segmentio/kafka-go v0.4.30
 	github.com/shopspring/decimal v1.3.1
 	github.com/stretchr/testify v1.7.0
 	github.com/zeromicro/go-queue v1.1.3
 	github.com/zeromicro/go-zero v1.3.1
 	go.opentelemetry.io/otel v1.5.0 // indirect
+	google.golang.org/protobuf v1.27.1
 )
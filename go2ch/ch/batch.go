@@ -0,0 +1,208 @@
+package ch
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go2ch/go2ch/config"
+)
+
+// reasons why a batch is flushed
+const (
+	flushReasonRows     = "rows"     // the batch reaches MaxBatchRows
+	flushReasonBytes    = "bytes"    // the converted values of batch reach MaxChunkBytes
+	flushReasonAge      = "age"      // the oldest row has waited for MaxRowAgeSecond
+	flushReasonInterval = "interval" // FlushIntervalSecond has passed since last flush, and there are MinBatchRows rows
+	flushReasonShutdown = "shutdown" // the writer is being closed
+)
+
+// batchTick is how often a batch is checked whether it is due to be flushed by time
+const batchTick = time.Second
+
+// flushBatch is the rows flushed together from the batch container
+type flushBatch struct {
+	rows   []*pendingRow
+	bytes  int
+	reason string
+}
+
+// batchPolicy tells when the rows in batch container are flushed, the limit hit first wins
+type batchPolicy struct {
+	maxRows  int           // 0 means no limit
+	minRows  int           // rows held back until there are as many, unless they are too old
+	maxBytes int           // 0 means no limit
+	maxAge   time.Duration // 0 means no limit
+	interval time.Duration
+	window   int64 // offsets of a dedup window, 0 means rows are not held back by windows, see dedupWindow
+}
+
+// newBatchPolicy creates a batch policy from c
+func newBatchPolicy(c *config.ClickHouseConf) batchPolicy {
+	policy := batchPolicy{
+		maxRows:  c.MaxBatchRows,
+		minRows:  c.MinBatchRows,
+		maxBytes: c.MaxChunkBytes,
+		maxAge:   time.Duration(c.MaxRowAgeSecond) * time.Second,
+		interval: time.Duration(c.FlushIntervalSecond) * time.Second,
+	}
+	if c.InsertDeduplicate {
+		policy.window = int64(c.DedupWindowOffsets)
+	}
+	return policy
+}
+
+// checkDedup checks the configuration of deduplication. The rows of the last dedup window of a partition
+// are only flushed by MaxRowAgeSecond once no more rows of it come, so it is required to be set
+func checkDedup(deduplicate bool, windowOffsets, maxRowAgeSecond int) error {
+	if !deduplicate {
+		return nil
+	}
+	if windowOffsets <= 0 {
+		return fmt.Errorf("checkDedup | DedupWindowOffsets must be positive with InsertDeduplicate")
+	}
+	if maxRowAgeSecond <= 0 {
+		return fmt.Errorf("checkDedup | MaxRowAgeSecond is required with InsertDeduplicate, otherwise the rows of the last dedup window of a partition may never be inserted")
+	}
+	return nil
+}
+
+// batchContainer is the task container of the periodical executor in writer, which collects rows into batches by policy.
+// It is always accessed in the lock of executor, except closing.
+type batchContainer struct {
+	policy    batchPolicy
+	execute   func(b *flushBatch)
+	rows      []*pendingRow
+	bytes     int
+	first     time.Time // when the oldest row in batch was added
+	lastFlush time.Time
+	full      string                 // the reason if the batch is full
+	last      map[partitionKey]int64 // the last dedup window of each partition, whose rows are held back
+	closing   int32                  // accessed atomically, all rows are flushed once it is set
+}
+
+// newBatchContainer creates a batch container which flushes rows to execute by policy
+func newBatchContainer(policy batchPolicy, execute func(b *flushBatch)) *batchContainer {
+	return &batchContainer{
+		policy:    policy,
+		execute:   execute,
+		lastFlush: time.Now(),
+		last:      make(map[partitionKey]int64),
+	}
+}
+
+// AddTask adds the row, and returns true if the batch is full
+func (c *batchContainer) AddTask(task interface{}) bool {
+	row := task.(*pendingRow)
+	row.added = time.Now()
+	if len(c.rows) == 0 {
+		c.first = row.added
+	}
+	c.rows = append(c.rows, row)
+	c.bytes += row.size
+	if c.policy.window > 0 {
+		key := partitionKey{topic: row.Topic, partition: row.Partition}
+		if window := dedupWindow(row.Offset, c.policy.window); window > c.last[key] {
+			c.last[key] = window
+		}
+	}
+
+	switch {
+	case c.policy.maxRows > 0 && len(c.rows) >= c.policy.maxRows:
+		c.full = flushReasonRows
+	case c.policy.maxBytes > 0 && c.bytes >= c.policy.maxBytes:
+		c.full = flushReasonBytes
+	}
+	return c.full != ""
+}
+
+// Execute executes the batch removed from container
+func (c *batchContainer) Execute(tasks interface{}) {
+	c.execute(tasks.(*flushBatch))
+}
+
+// RemoveAll removes the rows if the batch is due to be flushed, otherwise it returns nil and the rows are kept.
+// The rows in the last dedup window of their partition are kept as well, unless they are flushed by age or shutdown,
+// since more rows of the window may come, see dedupWindow.
+func (c *batchContainer) RemoveAll() interface{} {
+	if len(c.rows) == 0 {
+		return nil
+	}
+	reason := c.reason(time.Now())
+	if reason == "" {
+		return nil
+	}
+
+	rows, bytes := c.rows, c.bytes
+	var held []*pendingRow
+	if c.policy.window > 0 && reason != flushReasonAge && reason != flushReasonShutdown {
+		rows, held = c.holdLastWindows()
+		bytes = 0
+		for _, row := range rows {
+			bytes += row.size
+		}
+	}
+	c.rows = held
+	c.bytes -= bytes
+	c.full = ""
+	if len(held) > 0 {
+		c.first = held[0].added
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	c.lastFlush = time.Now()
+	return &flushBatch{rows: rows, bytes: bytes, reason: reason}
+}
+
+// holdLastWindows splits the rows into the ones to be flushed and the ones in the last dedup window of their partition
+func (c *batchContainer) holdLastWindows() ([]*pendingRow, []*pendingRow) {
+	flushed := make([]*pendingRow, 0, len(c.rows))
+	held := make([]*pendingRow, 0)
+	for _, row := range c.rows {
+		key := partitionKey{topic: row.Topic, partition: row.Partition}
+		if dedupWindow(row.Offset, c.policy.window) >= c.last[key] {
+			held = append(held, row)
+		} else {
+			flushed = append(flushed, row)
+		}
+	}
+	return flushed, held
+}
+
+// reason returns why the batch is flushed at now, or empty if it is not due to be flushed
+func (c *batchContainer) reason(now time.Time) string {
+	switch {
+	case c.full != "":
+		return c.full
+	case atomic.LoadInt32(&c.closing) == 1:
+		return flushReasonShutdown
+	case c.policy.maxAge > 0 && now.Sub(c.first) >= c.policy.maxAge:
+		return flushReasonAge
+	case now.Sub(c.lastFlush) >= c.policy.interval && len(c.rows) >= c.policy.minRows:
+		return flushReasonInterval
+	}
+	return ""
+}
+
+// flushPeriodically checks the batch every tick until the writer is closed, so that the rows held back
+// are flushed once they are due by age or interval. The executor can not be relied on for it,
+// since it stops ticking after being idle for a while, and does not tick again until the next row is added.
+func (w *Writer) flushPeriodically(tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.executor.Flush()
+		case <-w.closing.Done():
+			return
+		}
+	}
+}
+
+// close lets all the rows be flushed, no matter the policy
+func (c *batchContainer) close() {
+	atomic.StoreInt32(&c.closing, 1)
+}
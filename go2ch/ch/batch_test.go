@@ -0,0 +1,204 @@
+package ch
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/core/executors"
+
+	"go2ch/go2ch/pipeline"
+)
+
+func TestBatchContainer(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  batchPolicy
+		rows    int
+		since   time.Duration // time passed since the first row and last flush
+		closing bool
+		full    bool
+		reason  string
+	}{
+		{
+			name:   "max rows",
+			policy: batchPolicy{maxRows: 3, maxBytes: 100, interval: time.Minute},
+			rows:   3,
+			full:   true,
+			reason: flushReasonRows,
+		},
+		{
+			name:   "max bytes",
+			policy: batchPolicy{maxRows: 10, maxBytes: 8, interval: time.Minute},
+			rows:   4,
+			full:   true,
+			reason: flushReasonBytes,
+		},
+		{
+			name:   "not due",
+			policy: batchPolicy{maxRows: 10, interval: time.Minute},
+			rows:   2,
+		},
+		{
+			name:   "interval",
+			policy: batchPolicy{interval: time.Minute},
+			rows:   2,
+			since:  time.Minute,
+			reason: flushReasonInterval,
+		},
+		{
+			name:   "interval below min rows",
+			policy: batchPolicy{minRows: 5, interval: time.Minute},
+			rows:   2,
+			since:  time.Minute,
+		},
+		{
+			name:   "age below min rows",
+			policy: batchPolicy{minRows: 5, maxAge: 30 * time.Second, interval: time.Minute},
+			rows:   2,
+			since:  30 * time.Second,
+			reason: flushReasonAge,
+		},
+		{
+			name:    "shutdown below min rows",
+			policy:  batchPolicy{minRows: 5, interval: time.Minute},
+			rows:    2,
+			closing: true,
+			reason:  flushReasonShutdown,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var executed *flushBatch
+			c := newBatchContainer(test.policy, func(b *flushBatch) {
+				executed = b
+			})
+
+			var full bool
+			for i := 0; i < test.rows; i++ {
+				full = c.AddTask(&pendingRow{Row: &pipeline.Row{}, size: 3})
+			}
+			assert.Equal(t, test.full, full)
+			c.first = c.first.Add(-test.since)
+			c.lastFlush = c.lastFlush.Add(-test.since)
+			if test.closing {
+				c.close()
+			}
+
+			tasks := c.RemoveAll()
+			if test.reason == "" {
+				assert.Nil(t, tasks)
+				assert.Len(t, c.rows, test.rows)
+				return
+			}
+			c.Execute(tasks)
+			assert.Equal(t, test.reason, executed.reason)
+			assert.Len(t, executed.rows, test.rows)
+			assert.Equal(t, 3*test.rows, executed.bytes)
+			assert.Empty(t, c.rows)
+			assert.Nil(t, c.RemoveAll())
+		})
+	}
+}
+
+func TestFlushPeriodically(t *testing.T) {
+	executed := make(chan *flushBatch, 1)
+	closing, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &Writer{closing: closing, cancel: cancel}
+	w.batches = newBatchContainer(batchPolicy{minRows: 5, maxAge: 20 * time.Millisecond, interval: time.Minute}, func(b *flushBatch) {
+		executed <- b
+	})
+	// the executor never ticks by itself in the test, as if it has stopped after being idle
+	w.executor = executors.NewPeriodicalExecutor(time.Hour, w.batches)
+	go w.flushPeriodically(5 * time.Millisecond)
+
+	// the row held back by min rows is flushed once it is too old, without any more rows added
+	w.executor.Add(&pendingRow{Row: &pipeline.Row{}, size: 3})
+	select {
+	case b := <-executed:
+		assert.Equal(t, flushReasonAge, b.reason)
+		assert.Len(t, b.rows, 1)
+	case <-time.After(time.Second):
+		t.Fatal("the row is not flushed by age")
+	}
+}
+
+func TestBatchContainerDedupWindow(t *testing.T) {
+	var executed []*flushBatch
+	c := newBatchContainer(batchPolicy{maxRows: 4, interval: time.Minute, window: 10}, func(b *flushBatch) {
+		executed = append(executed, b)
+	})
+	add := func(partition int, offsets ...int64) bool {
+		var full bool
+		for _, offset := range offsets {
+			full = c.AddTask(&pendingRow{Row: &pipeline.Row{Partition: partition, Offset: offset}, size: 1})
+		}
+		return full
+	}
+	offsets := func(rows []*pendingRow) []int64 {
+		values := make([]int64, 0, len(rows))
+		for _, row := range rows {
+			values = append(values, row.Offset)
+		}
+		return values
+	}
+
+	// the rows of the last window of a partition are held back, as more rows of it may come
+	assert.True(t, add(0, 7, 8, 9, 10))
+	c.Execute(c.RemoveAll())
+	assert.Equal(t, []int64{7, 8, 9}, offsets(executed[0].rows))
+	assert.Equal(t, []int64{10}, offsets(c.rows))
+	assert.Equal(t, 1, c.bytes)
+
+	// nothing is flushed while all the rows are in the last windows
+	assert.True(t, add(1, 3, 4, 5))
+	assert.Nil(t, c.RemoveAll())
+	assert.Len(t, c.rows, 4)
+
+	// the rows are flushed by shutdown no matter the windows
+	c.close()
+	c.Execute(c.RemoveAll())
+	assert.Equal(t, []int64{10, 3, 4, 5}, offsets(executed[1].rows))
+	assert.Empty(t, c.rows)
+	assert.Equal(t, 0, c.bytes)
+}
+
+func TestBatchContainerDedupWindowFlushedByAge(t *testing.T) {
+	var acked int32
+	executed := make(chan *flushBatch, 10)
+	closing, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &Writer{closing: closing, cancel: cancel}
+	w.batches = newBatchContainer(batchPolicy{maxAge: 20 * time.Millisecond, interval: time.Millisecond, window: 1000}, func(b *flushBatch) {
+		for _, row := range b.rows {
+			row.Done()
+		}
+		executed <- b
+	})
+	w.executor = executors.NewPeriodicalExecutor(time.Hour, w.batches)
+	go w.flushPeriodically(time.Millisecond)
+
+	// the rows of a partition smaller than a window are held back by interval flushes, and flushed once they are too old
+	for i := 0; i < 10; i++ {
+		w.executor.Add(&pendingRow{Row: &pipeline.Row{Offset: int64(i), Ack: func() { atomic.AddInt32(&acked, 1) }}, size: 1})
+	}
+	select {
+	case b := <-executed:
+		assert.Equal(t, flushReasonAge, b.reason)
+		assert.Len(t, b.rows, 10)
+		assert.Equal(t, int32(10), atomic.LoadInt32(&acked))
+	case <-time.After(time.Second):
+		t.Fatal("the rows of the last window are not flushed")
+	}
+}
+
+func TestCheckDedup(t *testing.T) {
+	assert.Nil(t, checkDedup(false, 0, 0))
+	assert.Nil(t, checkDedup(true, 1000, 30))
+	assert.NotNil(t, checkDedup(true, 1000, 0))
+	assert.NotNil(t, checkDedup(true, 0, 30))
+}
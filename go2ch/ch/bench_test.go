@@ -0,0 +1,157 @@
+package ch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/zeromicro/go-zero/core/executors"
+	"github.com/zeromicro/go-zero/core/logx"
+
+	"go2ch/go2ch/decoder"
+	"go2ch/go2ch/pipeline"
+)
+
+// discardConn is a clickhouse connection with a table in memory, which throws the inserted rows away
+type discardConn struct {
+	schemaConn
+}
+
+func (c *discardConn) PrepareBatch(ctx context.Context, query string) (driver.Batch, error) {
+	return &discardBatch{}, nil
+}
+
+type discardBatch struct {
+	driver.Batch
+}
+
+func (b *discardBatch) Append(v ...interface{}) error {
+	return nil
+}
+
+func (b *discardBatch) Send() error {
+	return nil
+}
+
+// newBenchWriter creates a writer which flushes every 1000 rows into a discardConn
+func newBenchWriter(b *testing.B) *Writer {
+	logx.Disable()
+	conn := &discardConn{schemaConn{columns: []*rowDesc{
+		{Name: "id", Type: "UInt64"},
+		{Name: "level", Type: "LowCardinality(String)"},
+		{Name: "message", Type: "String"},
+		{Name: "score", Type: "Float64"},
+		{Name: "code", Type: "Nullable(Int32)"},
+		{Name: "tags", Type: "Array(String)"},
+		{Name: "labels", Type: "Map(String, String)"},
+		{Name: "user", Type: "String", DefaultExpression: "'anonymous'", DefaultType: "DEFAULT"},
+	}}}
+	w := &Writer{
+		ctx:        context.Background(),
+		name:       "bench",
+		conn:       conn,
+		shards:     []*shard{{conn: conn}},
+		tableName:  "t",
+		deadLetter: &memDeadLetter{},
+		flusher:    newFlusher(4),
+	}
+	if _, err := w.refreshSchema(); err != nil {
+		b.Fatal(err)
+	}
+	w.batches = newBatchContainer(batchPolicy{maxRows: 1000, interval: time.Second}, w.execute)
+	w.executor = executors.NewPeriodicalExecutor(batchTick, w.batches)
+	return w
+}
+
+// benchMessages are the values of kafka messages in the benchmarks
+func benchMessages() [][]byte {
+	msgs := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		msgs = append(msgs, []byte(fmt.Sprintf(`{"id":%d,"level":"info","message":"user %d signed in from the mobile app",`+
+			`"score":%d.5,"code":null,"tags":["a","b","c"],"labels":{"app":"go2ch","env":"prod"},"extra":"left out"}`, i, i, i)))
+	}
+	return msgs
+}
+
+// BenchmarkWritePath decodes messages as the handler does, and writes the rows to a writer until they are inserted
+func BenchmarkWritePath(b *testing.B) {
+	dec, err := decoder.NewDecoder(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := newBenchWriter(b)
+	msgs := benchMessages()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ms, err := dec.Decode(msgs[i%len(msgs)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Write(&pipeline.Row{Offset: int64(i), Fields: ms[0]}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	w.executor.Flush()
+	w.flusher.wait()
+}
+
+// BenchmarkWritePathReencode is BenchmarkWritePath with the rows encoded in json by the handler
+// and decoded again by the writer, which is how rows were passed before
+func BenchmarkWritePathReencode(b *testing.B) {
+	dec, err := decoder.NewDecoder(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := newBenchWriter(b)
+	msgs := benchMessages()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ms, err := dec.Decode(msgs[i%len(msgs)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		data, err := json.Marshal(ms[0])
+		if err != nil {
+			b.Fatal(err)
+		}
+		var fields map[string]interface{}
+		if err := jsoniter.Unmarshal(data, &fields); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Write(&pipeline.Row{Offset: int64(i), Fields: fields}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	w.executor.Flush()
+	w.flusher.wait()
+}
+
+// BenchmarkConvert converts decoded rows to the values of columns
+func BenchmarkConvert(b *testing.B) {
+	w := newBenchWriter(b)
+	s := w.getSchema()
+	rows := make([]*pipeline.Row, 0)
+	for _, msg := range benchMessages() {
+		var fields map[string]interface{}
+		if err := jsoniter.Unmarshal(msg, &fields); err != nil {
+			b.Fatal(err)
+		}
+		rows = append(rows, &pipeline.Row{Fields: fields})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.convert(s, rows[i%len(rows)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
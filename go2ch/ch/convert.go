@@ -0,0 +1,953 @@
+package ch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go2ch/go2ch/util"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// coercion modes, about how values of messages are converted to the types of columns
+const (
+	CoercionStrict  = "strict"  // values must be of the json types matching columns, and fit them
+	CoercionLenient = "lenient" // numeric and boolean strings, and ISO 8601 timestamps are parsed as well
+)
+
+// ConversionError tells the value of a column in a row can not be converted to the type of column
+type ConversionError struct {
+	Column string
+	Type   string
+	Value  interface{}
+	Err    error
+}
+
+func (e *ConversionError) Error() string {
+	return fmt.Sprintf("convert column[%s] in %s: %v", e.Column, e.Type, e.Err)
+}
+
+func (e *ConversionError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	typeInt8      = reflect.TypeOf(int8(0))
+	typeInt16     = reflect.TypeOf(int16(0))
+	typeInt32     = reflect.TypeOf(int32(0))
+	typeInt64     = reflect.TypeOf(int64(0))
+	typeUInt8     = reflect.TypeOf(uint8(0))
+	typeUInt16    = reflect.TypeOf(uint16(0))
+	typeUInt32    = reflect.TypeOf(uint32(0))
+	typeUInt64    = reflect.TypeOf(uint64(0))
+	typeFloat32   = reflect.TypeOf(float32(0))
+	typeFloat64   = reflect.TypeOf(float64(0))
+	typeBigInt    = reflect.TypeOf(&big.Int{})
+	typeString    = reflect.TypeOf("")
+	typeBool      = reflect.TypeOf(true)
+	typeTime      = reflect.TypeOf(time.Time{})
+	typeDecimal   = reflect.TypeOf(decimal.Decimal{})
+	typeUUID      = reflect.TypeOf(uuid.UUID{})
+	typeIP        = reflect.TypeOf(net.IP{})
+	typeInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+	typeTuple     = reflect.TypeOf([]interface{}{})
+	typeStrings   = reflect.TypeOf([]string{})
+	typeStringMap = reflect.TypeOf(map[string]string{})
+)
+
+// bigIntBits are the sizes of the big integer types
+var bigIntBits = map[string]int{
+	"Int128":  128,
+	"Int256":  256,
+	"UInt128": 128,
+	"UInt256": 256,
+}
+
+// goType returns the go type which the clickhouse driver accepts for t
+func (t *chType) goType() (reflect.Type, error) {
+	switch t.name {
+	case "Int8":
+		return typeInt8, nil
+	case "Int16":
+		return typeInt16, nil
+	case "Int32":
+		return typeInt32, nil
+	case "Int64":
+		return typeInt64, nil
+	case "UInt8":
+		return typeUInt8, nil
+	case "UInt16":
+		return typeUInt16, nil
+	case "UInt32":
+		return typeUInt32, nil
+	case "UInt64":
+		return typeUInt64, nil
+	case "Int128", "Int256", "UInt128", "UInt256":
+		return typeBigInt, nil
+	case "Float32":
+		return typeFloat32, nil
+	case "Float64":
+		return typeFloat64, nil
+	case "String", "FixedString", "Enum8", "Enum16", "Enum":
+		return typeString, nil
+	case "Bool", "Boolean":
+		return typeBool, nil
+	case "Date", "Date32", "DateTime", "DateTime64":
+		return typeTime, nil
+	case "Decimal", "Decimal32", "Decimal64", "Decimal128", "Decimal256":
+		return typeDecimal, nil
+	case "UUID":
+		return typeUUID, nil
+	case "IPv4", "IPv6":
+		return typeIP, nil
+	case "Nothing":
+		return typeInterface, nil
+	case "Tuple":
+		return typeTuple, nil
+	case "LowCardinality", "SimpleAggregateFunction":
+		return t.elems[0].goType()
+	case "Nullable":
+		base, err := t.elems[0].goType()
+		if err != nil || base.Kind() == reflect.Ptr || base.Kind() == reflect.Interface {
+			return base, err
+		}
+		return reflect.PtrTo(base), nil
+	case "Array":
+		elem, err := t.elems[0].goType()
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
+	case "Map":
+		key, err := t.elems[0].goType()
+		if err != nil {
+			return nil, err
+		}
+		value, err := t.elems[1].goType()
+		if err != nil {
+			return nil, err
+		}
+		return reflect.MapOf(key, value), nil
+	}
+	return nil, fmt.Errorf("goType | unsupported clickhouse type [%s]", t.raw)
+}
+
+// converter converts v to the go type which the clickhouse driver accepts for a type
+type converter func(v interface{}) (interface{}, error)
+
+// strict reports whether values are converted in strict coercion
+func (w *Writer) strict() bool {
+	return w.coercion == CoercionStrict
+}
+
+// compile builds the converter of t, the parameters and nested types of t are resolved once here
+// rather than for every value converted
+func (w *Writer) compile(t *chType) (converter, error) {
+	switch t.name {
+	case "Int8", "Int16", "Int32", "Int64", "UInt8", "UInt16", "UInt32", "UInt64":
+		r, strict := intRanges[t.name], w.strict()
+		return func(v interface{}) (interface{}, error) {
+			return convertInt(t, r, strict, v)
+		}, nil
+	case "Float32", "Float64":
+		strict := w.strict()
+		return func(v interface{}) (interface{}, error) {
+			return convertFloat(t, strict, v)
+		}, nil
+	case "Int128", "Int256", "UInt128", "UInt256":
+		strict := w.strict()
+		return func(v interface{}) (interface{}, error) {
+			return convertBigInt(t, strict, v)
+		}, nil
+	case "String":
+		strict := w.strict()
+		return func(v interface{}) (interface{}, error) {
+			return convertString(strict, v)
+		}, nil
+	case "FixedString":
+		n, err := t.intParam(0, 0)
+		if err != nil {
+			return nil, err
+		}
+		strict := w.strict()
+		return func(v interface{}) (interface{}, error) {
+			return convertFixedString(n, strict, v)
+		}, nil
+	case "Enum8", "Enum16", "Enum":
+		names := make(map[string]bool, len(t.enum))
+		for _, name := range t.enum {
+			names[name] = true
+		}
+		strict := w.strict()
+		return func(v interface{}) (interface{}, error) {
+			return convertEnum(t, names, strict, v)
+		}, nil
+	case "Bool", "Boolean":
+		strict := w.strict()
+		return func(v interface{}) (interface{}, error) {
+			return convertBool(strict, v)
+		}, nil
+	case "Date", "Date32", "DateTime", "DateTime64":
+		return w.compileTime(t)
+	case "Decimal", "Decimal32", "Decimal64", "Decimal128", "Decimal256":
+		precision, scale, err := decimalParams(t)
+		if err != nil {
+			return nil, err
+		}
+		strict := w.strict()
+		return func(v interface{}) (interface{}, error) {
+			return convertDecimal(t, precision, scale, strict, v)
+		}, nil
+	case "UUID":
+		return convertUUID, nil
+	case "IPv4", "IPv6":
+		strict := w.strict()
+		return func(v interface{}) (interface{}, error) {
+			return convertIP(t, strict, v)
+		}, nil
+	case "Nothing":
+		return func(v interface{}) (interface{}, error) {
+			return nil, nil
+		}, nil
+	case "LowCardinality", "SimpleAggregateFunction":
+		return w.compile(t.elems[0])
+	case "Nullable":
+		return w.compileNullable(t)
+	case "Array":
+		return w.compileArray(t)
+	case "Map":
+		return w.compileMap(t)
+	case "Tuple":
+		return w.compileTuple(t)
+	}
+	return nil, fmt.Errorf("compile | unsupported clickhouse type [%s]", t.raw)
+}
+
+// convertBool converts a json boolean, or a number of 0 or 1 and a boolean string from text formats like csv
+// unless coercion is strict
+func convertBool(strict bool, v interface{}) (interface{}, error) {
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	if strict {
+		return nil, fmt.Errorf("convertBool | can not convert %T value [%v] to Bool in strict coercion", v, v)
+	}
+	if s, ok := v.(string); ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("convertBool | parse [%s] to bool failed: %v", s, err)
+		}
+		return b, nil
+	}
+	if f, ok := toFloat64(v); ok && (f == 0 || f == 1) {
+		return f == 1, nil
+	}
+	return nil, fmt.Errorf("convertBool | can not convert %T value [%v] to Bool", v, v)
+}
+
+// convertUUID converts a uuid string
+func convertUUID(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("convertUUID | can not convert %T value [%v] to UUID", v, v)
+	}
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("convertUUID | parse [%s] to UUID failed: %v", s, err)
+	}
+	return id, nil
+}
+
+// compileNullable compiles the converter of Nullable, which converts v to a pointer of the nested type, nil stays nil
+func (w *Writer) compileNullable(t *chType) (converter, error) {
+	typ, err := t.goType()
+	if err != nil {
+		return nil, err
+	}
+	convert, err := w.compile(t.elems[0])
+	if err != nil {
+		return nil, err
+	}
+	null := reflect.Zero(typ).Interface()
+	return func(v interface{}) (interface{}, error) {
+		if v == nil {
+			return null, nil
+		}
+		value, err := convert(v)
+		if err != nil {
+			return nil, err
+		}
+		rv := reflect.ValueOf(value)
+		if rv.Type() == typ {
+			// the nested type is a pointer already, like big integers
+			return value, nil
+		}
+		ptr := reflect.New(rv.Type())
+		ptr.Elem().Set(rv)
+		return ptr.Interface(), nil
+	}, nil
+}
+
+// compileArray compiles the converter of Array, which converts a json array to a slice of the element type
+func (w *Writer) compileArray(t *chType) (converter, error) {
+	typ, err := t.goType()
+	if err != nil {
+		return nil, err
+	}
+	convert, err := w.compile(t.elems[0])
+	if err != nil {
+		return nil, err
+	}
+	return func(v interface{}) (interface{}, error) {
+		if v == nil {
+			return reflect.MakeSlice(typ, 0, 0).Interface(), nil
+		}
+		vs, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("convertArray | can not convert %T value [%v] to %s", v, v, t.raw)
+		}
+		if typ == typeStrings {
+			// arrays of strings are the most common, they are built without reflection
+			strs := make([]string, 0, len(vs))
+			for _, item := range vs {
+				value, err := convert(item)
+				if err != nil {
+					return nil, err
+				}
+				strs = append(strs, value.(string))
+			}
+			return strs, nil
+		}
+		slice := reflect.MakeSlice(typ, len(vs), len(vs))
+		for i, item := range vs {
+			value, err := convert(item)
+			if err != nil {
+				return nil, err
+			}
+			slice.Index(i).Set(reflectValue(value, typ.Elem()))
+		}
+		return slice.Interface(), nil
+	}, nil
+}
+
+// compileMap compiles the converter of Map, which converts a json object to a map of the key and value types
+func (w *Writer) compileMap(t *chType) (converter, error) {
+	typ, err := t.goType()
+	if err != nil {
+		return nil, err
+	}
+	convertKey, err := w.compile(t.elems[0])
+	if err != nil {
+		return nil, err
+	}
+	convertValue, err := w.compile(t.elems[1])
+	if err != nil {
+		return nil, err
+	}
+	// keys of String are taken as they are, while FixedString keys are padded
+	plainKeys := baseType(t.elems[0]).name == "String"
+	return func(v interface{}) (interface{}, error) {
+		if v == nil {
+			return reflect.MakeMap(typ).Interface(), nil
+		}
+		vs, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("convertMap | can not convert %T value [%v] to %s", v, v, t.raw)
+		}
+		if typ == typeStringMap && plainKeys {
+			// maps of strings are the most common, like the fallback column, they are built without reflection
+			strs := make(map[string]string, len(vs))
+			for k, item := range vs {
+				value, err := convertValue(item)
+				if err != nil {
+					return nil, err
+				}
+				strs[k] = value.(string)
+			}
+			return strs, nil
+		}
+		result := reflect.MakeMapWithSize(typ, len(vs))
+		for k, item := range vs {
+			// keys of json object are always strings, numeric keys are parsed before converting
+			var key interface{} = k
+			if typ.Key() != typeString {
+				if f, err := strconv.ParseFloat(k, 64); err == nil {
+					key = f
+				}
+			}
+			kv, err := convertKey(key)
+			if err != nil {
+				return nil, err
+			}
+			vv, err := convertValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result.SetMapIndex(reflectValue(kv, typ.Key()), reflectValue(vv, typ.Elem()))
+		}
+		return result.Interface(), nil
+	}, nil
+}
+
+// compileTuple compiles the converter of Tuple, which converts a json array by position,
+// or a json object by element names of a named Tuple
+func (w *Writer) compileTuple(t *chType) (converter, error) {
+	converts := make([]converter, 0, len(t.elems))
+	for _, elem := range t.elems {
+		convert, err := w.compile(elem)
+		if err != nil {
+			return nil, err
+		}
+		converts = append(converts, convert)
+	}
+	return func(v interface{}) (interface{}, error) {
+		var vs []interface{}
+		switch value := v.(type) {
+		case []interface{}:
+			vs = value
+		case map[string]interface{}:
+			vs = make([]interface{}, len(t.elems))
+			for i, field := range t.fields {
+				if field == "" {
+					return nil, fmt.Errorf("convertTuple | can not convert json object to unnamed %s", t.raw)
+				}
+				vs[i] = value[field]
+			}
+		default:
+			return nil, fmt.Errorf("convertTuple | can not convert %T value [%v] to %s", v, v, t.raw)
+		}
+		if len(vs) != len(converts) {
+			return nil, fmt.Errorf("convertTuple | %s requires %d elements, but got %d", t.raw, len(converts), len(vs))
+		}
+		tuple := make([]interface{}, 0, len(vs))
+		for i, item := range vs {
+			value, err := converts[i](item)
+			if err != nil {
+				return nil, err
+			}
+			tuple = append(tuple, value)
+		}
+		return tuple, nil
+	}, nil
+}
+
+// isoTimeLayouts are the layouts of ISO 8601 timestamps parsed in lenient coercion,
+// the ones without zone are in the timezone of column
+var isoTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// compileTime compiles the converter of date and time types.
+// Integers are unix timestamps in seconds, or in ticks of the precision of DateTime64 like clickhouse takes them,
+// and numbers with fraction are in seconds. In lenient coercion, ISO 8601 timestamps and numeric strings are parsed as well,
+// in strict coercion strings should be parsed by time_format filter.
+func (w *Writer) compileTime(t *chType) (converter, error) {
+	loc, err := timeLocation(t)
+	if err != nil {
+		return nil, fmt.Errorf("compileTime | %v", err)
+	}
+	unit := time.Second
+	if t.name == "DateTime64" {
+		precision, err := t.intParam(0, 3)
+		if err != nil {
+			return nil, err
+		}
+		if precision < 0 || precision > 9 {
+			return nil, fmt.Errorf("compileTime | precision of %s must be in [0, 9]", t.raw)
+		}
+		unit = time.Duration(math.Pow10(9 - precision))
+	}
+	strict := w.strict()
+
+	return func(v interface{}) (interface{}, error) {
+		if s, ok := v.(string); ok {
+			if strict {
+				return nil, fmt.Errorf("convertTime | can not convert string [%s] to %s in strict coercion, parse it by time_format filter", s, t.raw)
+			}
+			for _, layout := range isoTimeLayouts {
+				if tm, err := time.ParseInLocation(layout, s, loc); err == nil {
+					return tm, nil
+				}
+			}
+			n, err := parseNumber(s)
+			if err != nil {
+				return nil, fmt.Errorf("convertTime | parse [%s] to %s failed, it is neither an ISO 8601 timestamp nor a number", s, t.raw)
+			}
+			v = n
+		}
+		if tm, ok := v.(time.Time); ok {
+			return tm, nil
+		}
+		if i, ok := toInt64(v); ok {
+			perSecond := int64(time.Second / unit)
+			return time.Unix(i/perSecond, i%perSecond*int64(unit)), nil
+		}
+		if f, ok := toFloat64(v); ok {
+			sec, frac := math.Modf(f)
+			return time.Unix(int64(sec), int64(frac*1e9)), nil
+		}
+		return nil, fmt.Errorf("convertTime | can not convert %T value [%v] to %s", v, v, t.raw)
+	}, nil
+}
+
+// timeLocation returns the timezone of date and time type t, which is UTC if t has none
+func timeLocation(t *chType) (*time.Location, error) {
+	var tz string
+	switch t.name {
+	case "DateTime":
+		tz = t.param(0, "")
+	case "DateTime64":
+		tz = t.param(1, "")
+	}
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := util.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("load timezone[%s] of %s failed: %v", tz, t.raw, err)
+	}
+	return loc, nil
+}
+
+// intRange is the range of an integer type, new makes the go value of type from an integer in range
+type intRange struct {
+	min int64
+	max uint64
+	new func(i int64) interface{}
+}
+
+// intRanges are the ranges of integer types
+var intRanges = map[string]intRange{
+	"Int8":   {math.MinInt8, math.MaxInt8, func(i int64) interface{} { return int8(i) }},
+	"Int16":  {math.MinInt16, math.MaxInt16, func(i int64) interface{} { return int16(i) }},
+	"Int32":  {math.MinInt32, math.MaxInt32, func(i int64) interface{} { return int32(i) }},
+	"Int64":  {math.MinInt64, math.MaxInt64, func(i int64) interface{} { return i }},
+	"UInt8":  {0, math.MaxUint8, func(i int64) interface{} { return uint8(i) }},
+	"UInt16": {0, math.MaxUint16, func(i int64) interface{} { return uint16(i) }},
+	"UInt32": {0, math.MaxUint32, func(i int64) interface{} { return uint32(i) }},
+	"UInt64": {0, math.MaxUint64, func(i int64) interface{} { return uint64(i) }},
+}
+
+// convertNumber checks v is a json number for the numeric type t,
+// a numeric string from text formats like csv is parsed unless coercion is strict
+func convertNumber(t *chType, strict bool, v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		if strict {
+			return nil, fmt.Errorf("convertNumber | can not convert string [%s] to %s in strict coercion", s, t.raw)
+		}
+		n, err := parseNumber(s)
+		if err != nil {
+			return nil, fmt.Errorf("convertNumber | parse [%s] to %s failed: %v", s, t.raw, err)
+		}
+		return n, nil
+	}
+	if _, ok := toFloat64(v); !ok {
+		return nil, fmt.Errorf("convertNumber | can not convert %T value [%v] to %s", v, v, t.raw)
+	}
+	return v, nil
+}
+
+// convertInt converts v to the integer type t in range r,
+// a value with fraction or out of range is rejected rather than truncated or wrapped
+func convertInt(t *chType, r intRange, strict bool, v interface{}) (interface{}, error) {
+	n, err := convertNumber(t, strict, v)
+	if err != nil {
+		return nil, err
+	}
+	// integers are taken as they are, not through float64, to keep the precision of large values
+	if u, ok := toUint64(n); ok && u > math.MaxInt64 {
+		if u > r.max {
+			return nil, fmt.Errorf("convertInt | value [%v] overflows %s", v, t.raw)
+		}
+		return u, nil
+	}
+	i, ok := toInt64(n)
+	if !ok {
+		f, _ := toFloat64(n)
+		if f != math.Trunc(f) {
+			return nil, fmt.Errorf("convertInt | value [%v] of %s has a fraction", v, t.raw)
+		}
+		if f >= 0 && f < math.MaxUint64 && r.max == math.MaxUint64 {
+			return uint64(f), nil
+		}
+		return nil, fmt.Errorf("convertInt | value [%v] overflows %s", v, t.raw)
+	}
+	if i < r.min || (i > 0 && uint64(i) > r.max) {
+		return nil, fmt.Errorf("convertInt | value [%v] overflows %s", v, t.raw)
+	}
+	return r.new(i), nil
+}
+
+// convertFloat converts v to the float type t, a value out of the range of Float32 is rejected rather than becoming infinity
+func convertFloat(t *chType, strict bool, v interface{}) (interface{}, error) {
+	n, err := convertNumber(t, strict, v)
+	if err != nil {
+		return nil, err
+	}
+	f, _ := toFloat64(n)
+	if t.name == "Float64" {
+		return f, nil
+	}
+	if !math.IsInf(f, 0) && math.Abs(f) > math.MaxFloat32 {
+		return nil, fmt.Errorf("convertFloat | value [%v] overflows %s", v, t.raw)
+	}
+	return float32(f), nil
+}
+
+// parseNumber parses s to int64, or uint64 if it is too large, or float64 if it is not an integer
+func parseNumber(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return u, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// convertBigInt converts a json number to *big.Int, or a numeric string unless coercion is strict
+func convertBigInt(t *chType, strict bool, v interface{}) (interface{}, error) {
+	n := new(big.Int)
+	switch value := v.(type) {
+	case string:
+		if strict {
+			return nil, fmt.Errorf("convertBigInt | can not convert string [%s] to %s in strict coercion", value, t.raw)
+		}
+		if _, ok := n.SetString(value, 10); !ok {
+			return nil, fmt.Errorf("convertBigInt | can not convert [%s] to %s", value, t.raw)
+		}
+	default:
+		if u, ok := toUint64(v); ok {
+			n.SetUint64(u)
+		} else if i, ok := toInt64(v); ok {
+			n.SetInt64(i)
+		} else if f, ok := toFloat64(v); ok && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			big.NewFloat(f).Int(n)
+		} else {
+			return nil, fmt.Errorf("convertBigInt | can not convert %T value [%v] to %s", v, v, t.raw)
+		}
+	}
+
+	// the driver panics on values which can not be held in the size of type
+	bits := bigIntBits[t.name]
+	if strings.HasPrefix(t.name, "U") {
+		if n.Sign() < 0 || n.BitLen() > bits {
+			return nil, fmt.Errorf("convertBigInt | value [%s] overflows %s", n, t.raw)
+		}
+	} else if (n.Sign() >= 0 && n.BitLen() > bits-1) || (n.Sign() < 0 && new(big.Int).Not(n).BitLen() > bits-1) {
+		return nil, fmt.Errorf("convertBigInt | value [%s] overflows %s", n, t.raw)
+	}
+	return n, nil
+}
+
+// convertString converts v to string, times are formatted in RFC 3339 and the other values are encoded in json
+// unless coercion is strict
+func convertString(strict bool, v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case string:
+		// v is returned as it is, so that the string is not boxed again
+		return v, nil
+	case nil:
+		return "", nil
+	case time.Time:
+		// times parsed by time_format filter are kept in RFC 3339 with the zone, rather than quoted in json
+		return value.Format(time.RFC3339Nano), nil
+	}
+	if strict {
+		return nil, fmt.Errorf("convertString | can not convert %T value [%v] to String in strict coercion", v, v)
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("convertString | marshal [%v] to json failed: %v", v, err)
+	}
+	return string(bs), nil
+}
+
+// convertFixedString converts v to string of exactly n bytes, shorter is padded with zero bytes,
+// and longer is truncated unless coercion is strict
+func convertFixedString(n int, strict bool, v interface{}) (interface{}, error) {
+	value, err := convertString(strict, v)
+	if err != nil {
+		return nil, err
+	}
+	s := value.(string)
+	if len(s) > n && strict {
+		return nil, fmt.Errorf("convertFixedString | [%s] is longer than FixedString(%d) in strict coercion", s, n)
+	}
+	if len(s) >= n {
+		return s[:n], nil
+	}
+	return s + strings.Repeat("\x00", n-len(s)), nil
+}
+
+// convertEnum converts a name or a value of enum to the name, names are the names of enum.
+// Values in numeric strings are parsed as well unless coercion is strict.
+func convertEnum(t *chType, names map[string]bool, strict bool, v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		if names[s] {
+			return s, nil
+		}
+		if strict {
+			return nil, fmt.Errorf("convertEnum | [%s] is not a name of %s in strict coercion", s, t.raw)
+		}
+		if n, err := parseNumber(s); err == nil {
+			v = n
+		}
+	}
+	if i, ok := toInt64(v); ok {
+		if name, ok := t.enum[i]; ok {
+			return name, nil
+		}
+	}
+	return nil, fmt.Errorf("convertEnum | value [%v] is not in %s", v, t.raw)
+}
+
+// decimalParams returns the precision and scale of a decimal type
+func decimalParams(t *chType) (int, int, error) {
+	precision, ok := decimalPrecisions[t.name]
+	scaleIndex := 0
+	if !ok {
+		var err error
+		if precision, err = t.intParam(0, 10); err != nil {
+			return 0, 0, err
+		}
+		scaleIndex = 1
+	}
+	scale, err := t.intParam(scaleIndex, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if precision < 1 || precision > 76 || scale < 0 || scale > precision {
+		return 0, 0, fmt.Errorf("decimalParams | precision and scale of %s are out of range", t.raw)
+	}
+	return precision, scale, nil
+}
+
+// decimalPrecisions are the precisions of decimal types whose only parameter is the scale
+var decimalPrecisions = map[string]int{
+	"Decimal32":  9,
+	"Decimal64":  18,
+	"Decimal128": 38,
+	"Decimal256": 76,
+}
+
+// convertDecimal converts a json number to decimal, or a numeric string unless coercion is strict.
+// Values with more integer digits than precision - scale, or more fractional digits than scale, are rejected
+// rather than being wrapped or truncated.
+func convertDecimal(t *chType, precision, scale int, strict bool, v interface{}) (interface{}, error) {
+	var d decimal.Decimal
+	switch value := v.(type) {
+	case string:
+		if strict {
+			return nil, fmt.Errorf("convertDecimal | can not convert string [%s] to %s in strict coercion", value, t.raw)
+		}
+		var err error
+		if d, err = decimal.NewFromString(value); err != nil {
+			return nil, fmt.Errorf("convertDecimal | parse [%s] to decimal failed: %v", value, err)
+		}
+	case decimal.Decimal:
+		d = value
+	default:
+		if i, ok := toInt64(v); ok {
+			d = decimal.NewFromInt(i)
+		} else if f, ok := toFloat64(v); ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			d = decimal.NewFromFloat(f)
+		} else {
+			return nil, fmt.Errorf("convertDecimal | can not convert %T value [%v] to %s", v, v, t.raw)
+		}
+	}
+
+	if !d.Equal(d.Truncate(int32(scale))) {
+		return nil, fmt.Errorf("convertDecimal | value [%s] has more fractional digits than the scale of %s", d, t.raw)
+	}
+	if d.Abs().Cmp(decimal.New(1, int32(precision-scale))) >= 0 {
+		return nil, fmt.Errorf("convertDecimal | value [%s] overflows %s", d, t.raw)
+	}
+	return d, nil
+}
+
+// convertIP converts an ip string, or a number for IPv4 which may be in a numeric string unless coercion is strict, to net.IP
+func convertIP(t *chType, strict bool, v interface{}) (interface{}, error) {
+	var ip net.IP
+	if s, ok := v.(string); ok {
+		if ip = net.ParseIP(s); ip == nil && !strict && t.name == "IPv4" {
+			if n, err := parseNumber(s); err == nil {
+				v = n
+			}
+		}
+	}
+	if i, ok := toInt64(v); ok && ip == nil && t.name == "IPv4" && i >= 0 && i <= math.MaxUint32 {
+		ip = net.IPv4(byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("convertIP | can not convert %T value [%v] to %s", v, v, t.raw)
+	}
+	if t.name == "IPv4" {
+		if ip = ip.To4(); ip == nil {
+			return nil, fmt.Errorf("convertIP | [%v] is not an IPv4 address", v)
+		}
+		return ip, nil
+	}
+	return ip.To16(), nil
+}
+
+// toFloat64 converts a number to float64
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// toInt64 converts an integer, or a float without fraction, to int64
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint, uint64:
+		if u, _ := toUint64(n); u <= math.MaxInt64 {
+			return int64(u), true
+		}
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), true
+		}
+	case float32:
+		if f := float64(n); f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return int64(f), true
+		}
+	}
+	return 0, false
+}
+
+// toUint64 converts an unsigned integer of uint or uint64 to uint64
+func toUint64(v interface{}) (uint64, bool) {
+	switch n := v.(type) {
+	case uint:
+		return uint64(n), true
+	case uint64:
+		return n, true
+	}
+	return 0, false
+}
+
+// reflectValue returns the reflect value of v in typ, nil becomes the zero value of typ
+func reflectValue(v interface{}, typ reflect.Type) reflect.Value {
+	if v == nil {
+		return reflect.Zero(typ)
+	}
+	return reflect.ValueOf(v)
+}
+
+// valuesSize returns the bytes of converted values, see valueSize
+func valuesSize(values []interface{}) int {
+	var size int
+	for _, v := range values {
+		size += valueSize(v)
+	}
+	return size
+}
+
+// valueSize returns about the bytes of a converted value in the native format of clickhouse,
+// so that batches are sized by what is sent rather than by the message
+func valueSize(v interface{}) int {
+	switch value := v.(type) {
+	case nil:
+		return 1
+	case serverDefault:
+		return 0
+	case string:
+		return len(value) + 1
+	case []byte:
+		return len(value) + 1
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, uint, int64, uint64, float64, time.Time:
+		return 8
+	case decimal.Decimal, uuid.UUID:
+		return 16
+	case *big.Int:
+		return 32
+	case net.IP:
+		return len(value)
+	case []interface{}:
+		return valuesSize(value)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return 1
+		}
+		return 1 + valueSize(rv.Elem().Interface())
+	case reflect.Slice:
+		size := 8
+		for i := 0; i < rv.Len(); i++ {
+			size += valueSize(rv.Index(i).Interface())
+		}
+		return size
+	case reflect.Map:
+		size := 8
+		iter := rv.MapRange()
+		for iter.Next() {
+			size += valueSize(iter.Key().Interface()) + valueSize(iter.Value().Interface())
+		}
+		return size
+	}
+	return 8
+}
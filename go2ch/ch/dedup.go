@@ -0,0 +1,81 @@
+package ch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// partitionKey identifies a kafka partition
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+// groupByPartition splits rows into batches by kafka partition, rows in each batch are in offset order.
+// If window is not 0, the batches are cut at every window offsets as well, see dedupWindow.
+func groupByPartition(rows []*pendingRow, window int64) [][]*pendingRow {
+	groups := make(map[partitionKey][]*pendingRow)
+	keys := make([]partitionKey, 0)
+	for _, row := range rows {
+		key := partitionKey{topic: row.Topic, partition: row.Partition}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], row)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].topic != keys[j].topic {
+			return keys[i].topic < keys[j].topic
+		}
+		return keys[i].partition < keys[j].partition
+	})
+
+	batches := make([][]*pendingRow, 0, len(keys))
+	for _, key := range keys {
+		batch := groups[key]
+		sort.SliceStable(batch, func(i, j int) bool {
+			return batch[i].Offset < batch[j].Offset
+		})
+		start := 0
+		for i := 1; i < len(batch); i++ {
+			if dedupWindow(batch[i].Offset, window) != dedupWindow(batch[start].Offset, window) {
+				batches = append(batches, batch[start:i:i])
+				start = i
+			}
+		}
+		batches = append(batches, batch[start:])
+	}
+	return batches
+}
+
+// dedupWindow returns which window of offsets the offset is in. A partition is inserted in a batch per window,
+// and the rows of the last window are held back until it is over, see batchContainer.RemoveAll,
+// so that the rows consumed again after a failure are inserted in the same batches with the same tokens.
+func dedupWindow(offset, window int64) int64 {
+	if window <= 0 {
+		return 0
+	}
+	return offset / window
+}
+
+// dedupToken derives the insert deduplication token of a batch from the offset range of its rows.
+// The rows must be in the same partition and in offset order, see groupByPartition.
+func dedupToken(rows []*pendingRow) string {
+	if len(rows) == 0 {
+		return ""
+	}
+	first, last := rows[0], rows[len(rows)-1]
+	return fmt.Sprintf("%s-%d-%d-%d-%d", first.Topic, first.Partition, first.Offset, last.Offset, len(rows))
+}
+
+// withDedupToken attaches the insert deduplication token of rows to ctx,
+// so that clickhouse deduplicates a replayed batch in replicated tables
+func withDedupToken(ctx context.Context, rows []*pendingRow) context.Context {
+	return withSettings(ctx, clickhouse.Settings{
+		"insert_deduplication_token": dedupToken(rows),
+	})
+}
@@ -0,0 +1,324 @@
+package ch
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// default kinds of clickhouse columns, see system.columns
+const (
+	defaultTypeDefault      = "DEFAULT"
+	defaultTypeMaterialized = "MATERIALIZED"
+	defaultTypeAlias        = "ALIAS"
+	defaultTypeEphemeral    = "EPHEMERAL"
+)
+
+// timeLiteralLayouts are the layouts of date and time literals in default expressions
+var timeLiteralLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// defaultFuncs are the functions in default expressions which are evaluated for each row,
+// because their values change from row to row
+var defaultFuncs = map[string]func() interface{}{
+	"now": func() interface{} {
+		return time.Now()
+	},
+	"now64": func() interface{} {
+		return time.Now()
+	},
+	"today": func() interface{} {
+		return time.Now()
+	},
+	"yesterday": func() interface{} {
+		return time.Now().AddDate(0, 0, -1)
+	},
+	"generateUUIDv4": func() interface{} {
+		return uuid.New()
+	},
+}
+
+// serverDefault is the value of a column missing in a message, whose default expression can not be evaluated here.
+// The column is left out of the insert of the row, so that clickhouse evaluates the expression, see groupByDefaults
+type serverDefault struct{}
+
+// insertable reports whether the column can be given in INSERT, see insertableDefault
+func (d *rowDesc) insertable() bool {
+	return insertableDefault(d.DefaultType)
+}
+
+// insertableDefault reports whether a column of defaultType can be given in INSERT,
+// MATERIALIZED and ALIAS columns are always computed by clickhouse
+func insertableDefault(defaultType string) bool {
+	return defaultType != defaultTypeMaterialized && defaultType != defaultTypeAlias
+}
+
+// columnDefault returns the function giving the value of column d when it is missing in a message.
+// It is the literal of the DEFAULT expression, or one of defaultFuncs like now(), otherwise serverDefault for the other expressions,
+// and NULL for Nullable columns and the zero value of type for the columns without a default expression.
+func (w *Writer) columnDefault(d *rowDesc) (func() interface{}, error) {
+	expr := strings.TrimSpace(d.DefaultExpression)
+	if expr != "" && (d.DefaultType == defaultTypeDefault || d.DefaultType == defaultTypeEphemeral) {
+		if f, ok := defaultFuncs[funcName(expr)]; ok {
+			return f, nil
+		}
+		if literal, ok := parseLiteral(expr); ok {
+			literal = timeLiteral(d.chType, literal)
+			convert, err := w.compile(d.chType)
+			if err == nil {
+				_, err = convert(literal)
+			}
+			if err == nil {
+				return func() interface{} {
+					// converted for each row, so that rows do not share the same slices or maps
+					value, _ := convert(literal)
+					return value
+				}, nil
+			}
+		}
+		logx.Infof("columnDefault | default expression [%s] of column[%s] is evaluated by clickhouse, the column is left out of the inserts of rows missing it", expr, d.Name)
+		return func() interface{} {
+			return serverDefault{}
+		}, nil
+	}
+
+	if _, err := zeroValue(d.chType); err != nil {
+		return nil, fmt.Errorf("columnDefault | column[%s]: %v", d.Name, err)
+	}
+	return func() interface{} {
+		value, _ := zeroValue(d.chType)
+		return value
+	}, nil
+}
+
+// defaultsKey tells which values are serverDefault, so that the columns left out of the insert of a row are known
+func defaultsKey(values []interface{}) string {
+	var key strings.Builder
+	for i, v := range values {
+		if _, ok := v.(serverDefault); ok {
+			key.WriteString(strconv.Itoa(i))
+			key.WriteByte(',')
+		}
+	}
+	return key.String()
+}
+
+// groupByDefaults splits rows into groups by the columns evaluated by clickhouse, see serverDefault,
+// since the rows of a batch are inserted with the same columns. Rows keep their order in each group.
+func groupByDefaults(rows []*pendingRow) [][]*pendingRow {
+	groups := make(map[string][]*pendingRow)
+	keys := make([]string, 0, 1)
+	for _, row := range rows {
+		key := defaultsKey(row.values)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], row)
+	}
+	if len(keys) == 1 {
+		return [][]*pendingRow{rows}
+	}
+
+	batches := make([][]*pendingRow, 0, len(keys))
+	for _, key := range keys {
+		batches = append(batches, groups[key])
+	}
+	return batches
+}
+
+// insertColumns returns the indexes of the columns of s which values are inserted with, and the insert query of them.
+// The columns evaluated by clickhouse, see serverDefault, are left out.
+func (s *schema) insertColumns(values []interface{}) ([]int, []*rowDesc, string) {
+	indexes := make([]int, 0, len(s.columns))
+	columns := make([]*rowDesc, 0, len(s.columns))
+	for i, column := range s.columns {
+		if _, ok := values[i].(serverDefault); !ok {
+			indexes = append(indexes, i)
+			columns = append(columns, column)
+		}
+	}
+	if len(columns) == len(s.columns) {
+		return indexes, s.columns, s.insertQuery
+	}
+	return indexes, columns, buildInsertQuery(s.table, columns)
+}
+
+// zeroValue returns the value which clickhouse uses for t when there is not a default expression
+func zeroValue(t *chType) (interface{}, error) {
+	switch t.name {
+	case "LowCardinality", "SimpleAggregateFunction":
+		return zeroValue(t.elems[0])
+	case "Array":
+		typ, err := t.goType()
+		if err != nil {
+			return nil, err
+		}
+		return reflect.MakeSlice(typ, 0, 0).Interface(), nil
+	case "Map":
+		typ, err := t.goType()
+		if err != nil {
+			return nil, err
+		}
+		return reflect.MakeMap(typ).Interface(), nil
+	case "Tuple":
+		tuple := make([]interface{}, 0, len(t.elems))
+		for _, elem := range t.elems {
+			value, err := zeroValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			tuple = append(tuple, value)
+		}
+		return tuple, nil
+	case "Int128", "Int256", "UInt128", "UInt256":
+		return reflect.New(typeBigInt.Elem()).Interface(), nil
+	case "FixedString":
+		n, err := t.intParam(0, 0)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Repeat("\x00", n), nil
+	case "Enum8", "Enum16", "Enum":
+		// the default of enum is the item with the minimum value
+		var name string
+		var min int64
+		first := true
+		for value, item := range t.enum {
+			if first || value < min {
+				name, min, first = item, value, false
+			}
+		}
+		return name, nil
+	case "Date", "Date32", "DateTime", "DateTime64":
+		return time.Unix(0, 0).UTC(), nil
+	case "IPv4":
+		return net.IPv4zero.To4(), nil
+	case "IPv6":
+		return net.IPv6zero, nil
+	}
+
+	// Nullable is a nil pointer, and the others are the zero values of their go types
+	typ, err := t.goType()
+	if err != nil {
+		return nil, err
+	}
+	return reflect.Zero(typ).Interface(), nil
+}
+
+// funcName returns the name of the function called in expr, or empty if expr is not a function call
+func funcName(expr string) string {
+	open := strings.IndexByte(expr, '(')
+	if open <= 0 || !strings.HasSuffix(expr, ")") {
+		return ""
+	}
+	return strings.TrimSpace(expr[:open])
+}
+
+// parseLiteral parses a literal of clickhouse sql, like NULL, 1, -0.5, 'a', [1, 2] and CAST('a', 'String')
+func parseLiteral(expr string) (interface{}, bool) {
+	expr = strings.TrimSpace(expr)
+	switch {
+	case expr == "":
+		return nil, false
+	case strings.EqualFold(expr, "NULL"):
+		return nil, true
+	case strings.EqualFold(expr, "true"):
+		return true, true
+	case strings.EqualFold(expr, "false"):
+		return false, true
+	case expr[0] == '\'':
+		if len(expr) < 2 || expr[len(expr)-1] != '\'' {
+			return nil, false
+		}
+		return unquote(expr), true
+	case expr[0] == '[':
+		if expr[len(expr)-1] != ']' {
+			return nil, false
+		}
+		items, err := splitArgs(expr[1 : len(expr)-1])
+		if err != nil {
+			return nil, false
+		}
+		values := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			value, ok := parseLiteral(item)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, value)
+		}
+		return values, true
+	case funcName(expr) == "CAST":
+		args, err := splitArgs(expr[strings.IndexByte(expr, '(')+1 : len(expr)-1])
+		if err != nil || len(args) == 0 {
+			return nil, false
+		}
+		return parseLiteral(args[0])
+	}
+
+	if i, err := strconv.ParseInt(expr, 10, 64); err == nil {
+		return i, true
+	}
+	if u, err := strconv.ParseUint(expr, 10, 64); err == nil {
+		return u, true
+	}
+	if isInteger(expr) {
+		// too large for 64 bits, kept in string for big integer types
+		return expr, true
+	}
+	if f, err := strconv.ParseFloat(expr, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+// isInteger reports whether expr is an integer literal
+func isInteger(expr string) bool {
+	digits := strings.TrimPrefix(expr, "-")
+	if digits == "" {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// timeLiteral parses the string literal of date and time types to time.Time,
+// in the timezone of the type if there is, otherwise in UTC
+func timeLiteral(t *chType, literal interface{}) interface{} {
+	s, ok := literal.(string)
+	if !ok {
+		return literal
+	}
+	for t.name == "Nullable" || t.name == "LowCardinality" {
+		t = t.elems[0]
+	}
+
+	switch t.name {
+	case "Date", "Date32", "DateTime", "DateTime64":
+	default:
+		return literal
+	}
+	loc, err := timeLocation(t)
+	if err != nil {
+		loc = time.UTC
+	}
+	for _, layout := range timeLiteralLayouts {
+		if v, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return v
+		}
+	}
+	return literal
+}
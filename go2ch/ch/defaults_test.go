@@ -0,0 +1,185 @@
+package ch
+
+import (
+	"context"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go2ch/go2ch/pipeline"
+)
+
+func TestGetDataStructDefaults(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name   string
+		column rowDesc
+		data   map[string]interface{}
+		expect interface{}
+	}{
+		{
+			name:   "present",
+			column: rowDesc{Name: "c", Type: "String", DefaultType: "DEFAULT", DefaultExpression: "'x'"},
+			data:   map[string]interface{}{"c": "a"},
+			expect: "a",
+		},
+		{
+			name:   "string literal",
+			column: rowDesc{Name: "c", Type: "String", DefaultType: "DEFAULT", DefaultExpression: "'it\\'s'"},
+			expect: "it's",
+		},
+		{
+			name:   "null for column not nullable",
+			column: rowDesc{Name: "c", Type: "Int32", DefaultType: "DEFAULT", DefaultExpression: "-7"},
+			data:   map[string]interface{}{"c": nil},
+			expect: int32(-7),
+		},
+		{
+			name:   "array literal",
+			column: rowDesc{Name: "c", Type: "Array(UInt8)", DefaultType: "DEFAULT", DefaultExpression: "[1, 2]"},
+			expect: []uint8{1, 2},
+		},
+		{
+			name:   "cast literal",
+			column: rowDesc{Name: "c", Type: "LowCardinality(String)", DefaultType: "DEFAULT", DefaultExpression: "CAST('a', 'LowCardinality(String)')"},
+			expect: "a",
+		},
+		{
+			name:   "datetime literal",
+			column: rowDesc{Name: "c", Type: "DateTime('Asia/Shanghai')", DefaultType: "DEFAULT", DefaultExpression: "'2022-01-02 03:04:05'"},
+			expect: time.Date(2022, 1, 2, 3, 4, 5, 0, time.FixedZone("CST", 8*3600)),
+		},
+		{
+			name:   "big integer literal",
+			column: rowDesc{Name: "c", Type: "UInt128", DefaultType: "DEFAULT", DefaultExpression: "18446744073709551616"},
+			expect: new(big.Int).Lsh(big.NewInt(1), 64),
+		},
+		{
+			name:   "nullable",
+			column: rowDesc{Name: "c", Type: "Nullable(String)"},
+			expect: (*string)(nil),
+		},
+		{
+			name:   "nullable keeps null",
+			column: rowDesc{Name: "c", Type: "Nullable(String)", DefaultType: "DEFAULT", DefaultExpression: "'x'"},
+			data:   map[string]interface{}{"c": nil},
+			expect: (*string)(nil),
+		},
+		{
+			name:   "nullable with default",
+			column: rowDesc{Name: "c", Type: "Nullable(String)", DefaultType: "DEFAULT", DefaultExpression: "'x'"},
+			expect: str("x"),
+		},
+		{
+			name:   "expression evaluated by clickhouse",
+			column: rowDesc{Name: "c", Type: "Date", DefaultType: "DEFAULT", DefaultExpression: "toDate(ts)"},
+			expect: serverDefault{},
+		},
+		{
+			name:   "zero string",
+			column: rowDesc{Name: "c", Type: "FixedString(2)"},
+			expect: "\x00\x00",
+		},
+		{
+			name:   "zero enum",
+			column: rowDesc{Name: "c", Type: "Enum8('b' = 2, 'a' = -1)"},
+			expect: "a",
+		},
+		{
+			name:   "zero map",
+			column: rowDesc{Name: "c", Type: "Map(String, UInt64)"},
+			expect: map[string]uint64{},
+		},
+		{
+			name:   "zero tuple",
+			column: rowDesc{Name: "c", Type: "Tuple(String, Nullable(Int8), IPv4)"},
+			expect: []interface{}{"", (*int8)(nil), net.IPv4zero.To4()},
+		},
+		{
+			name:   "zero time",
+			column: rowDesc{Name: "c", Type: "DateTime64(3)"},
+			expect: time.Unix(0, 0).UTC(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &Writer{}
+			column := test.column
+			assert.Nil(t, w.describe(&column))
+			data := test.data
+			if data == nil {
+				data = map[string]interface{}{}
+			}
+			stru, err := w.getDataStruct(newSchema("t", []*rowDesc{&column}), data)
+			assert.Nil(t, err)
+			assert.Len(t, stru, 1)
+			if expect, ok := test.expect.(time.Time); ok {
+				assert.True(t, expect.Equal(stru[0].(time.Time)), "expect %v, but got %v", expect, stru[0])
+				return
+			}
+			assert.Equal(t, test.expect, stru[0])
+		})
+	}
+}
+
+func TestDefaultFuncs(t *testing.T) {
+	w := &Writer{}
+	column := &rowDesc{Name: "c", Type: "DateTime", DefaultType: "DEFAULT", DefaultExpression: "now()"}
+	column.chType, _ = parseType(column.Type)
+	f, err := w.columnDefault(column)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), f().(time.Time), time.Minute)
+}
+
+func TestBuildInsertQuery(t *testing.T) {
+	columns := []*rowDesc{{Name: "id"}, {Name: "a`b"}}
+	assert.Equal(t, "INSERT INTO t (`id`, `a\\`b`)", buildInsertQuery("t", columns))
+
+	var insertable []string
+	for _, column := range []*rowDesc{
+		{Name: "a"},
+		{Name: "b", DefaultType: "DEFAULT"},
+		{Name: "c", DefaultType: "MATERIALIZED"},
+		{Name: "d", DefaultType: "ALIAS"},
+		{Name: "e", DefaultType: "EPHEMERAL"},
+	} {
+		if column.insertable() {
+			insertable = append(insertable, column.Name)
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "e"}, insertable)
+}
+
+func TestInsertServerDefaults(t *testing.T) {
+	w := &Writer{ctx: context.Background(), deadLetter: &memDeadLetter{}}
+	descs := []*rowDesc{
+		{Name: "id", Type: "String"},
+		{Name: "d", Type: "Date", DefaultType: "DEFAULT", DefaultExpression: "toDate(ts)"},
+	}
+	for _, desc := range descs {
+		assert.Nil(t, w.describe(desc))
+	}
+	s := newSchema("t", descs)
+
+	var rows []*pendingRow
+	for _, m := range []map[string]interface{}{{"id": "a", "d": "2022-01-02"}, {"id": "b"}, {"id": "c"}} {
+		values, err := w.getDataStruct(s, m)
+		assert.Nil(t, err)
+		rows = append(rows, &pendingRow{Row: &pipeline.Row{Fields: m}, values: values})
+	}
+
+	// the rows missing the column are inserted without it, so that clickhouse evaluates its default
+	groups := groupByDefaults(rows)
+	assert.Len(t, groups, 2)
+	conn := &fakeConn{}
+	for _, group := range groups {
+		w.insert(s, &shard{conn: conn}, group)
+	}
+	assert.Equal(t, []string{"INSERT INTO t (`id`, `d`)", "INSERT INTO t (`id`)"}, conn.queries)
+	assert.Equal(t, [][]interface{}{{"a", time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)}, {"b"}, {"c"}}, conn.sent)
+}
@@ -0,0 +1,103 @@
+package ch
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go2ch/go2ch/metrics"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/threading"
+)
+
+// flushChunk is a flushed chunk whose batches are being inserted, it is logged once all of them are done
+type flushChunk struct {
+	start    time.Time
+	rows     int    // rows in the chunk, including the rejected ones
+	bytes    int    // bytes of rows in the chunk
+	reason   string // why the chunk is flushed
+	accepted int64  // accessed atomically
+	pending  int32  // batches not inserted yet, accessed atomically
+}
+
+// flusher runs the batches of flushed chunks concurrently, in at most cap(slots) batches at a time.
+// The batches of a kafka partition are inserted one after another in the order they are dispatched.
+type flusher struct {
+	slots    chan struct{}
+	inflight sync.WaitGroup
+	lock     sync.Mutex
+	last     map[partitionKey]chan struct{} // closed once the last dispatched batch of partition is done
+}
+
+// newFlusher creates a flusher which inserts n batches at most at a time
+func newFlusher(n int) *flusher {
+	if n < 1 {
+		n = 1
+	}
+	return &flusher{
+		slots: make(chan struct{}, n),
+		last:  make(map[partitionKey]chan struct{}),
+	}
+}
+
+// wait waits until all the dispatched batches are done
+func (f *flusher) wait() {
+	f.inflight.Wait()
+}
+
+// dispatch inserts the batch of a kafka partition in a free slot of flusher.
+// It blocks while all the slots are busy, which holds up the chunk executor and in turn Write,
+// so that consuming slows down to the pace of clickhouse.
+func (w *Writer) dispatch(s *schema, batch []*pendingRow, chunk *flushChunk) {
+	f := w.flusher
+	f.slots <- struct{}{}
+
+	key := partitionKey{topic: batch[0].Topic, partition: batch[0].Partition}
+	done := make(chan struct{})
+	f.lock.Lock()
+	prev := f.last[key]
+	f.last[key] = done
+	f.lock.Unlock()
+
+	f.inflight.Add(1)
+	threading.GoSafe(func() {
+		var accepted int
+		defer func() {
+			close(done)
+			<-f.slots
+			w.finishBatch(chunk, accepted)
+			f.inflight.Done()
+		}()
+
+		// the previous batch of partition holds a slot as well, so waiting for it never blocks forever
+		if prev != nil {
+			<-prev
+		}
+		accepted = w.insertShards(s, batch)
+	})
+}
+
+// finishBatch records a batch of chunk is done with accepted rows, and logs the chunk if it is the last batch
+func (w *Writer) finishBatch(chunk *flushChunk, accepted int) {
+	atomic.AddInt64(&chunk.accepted, int64(accepted))
+	if atomic.AddInt32(&chunk.pending, -1) > 0 {
+		return
+	}
+	w.finishChunk(chunk)
+}
+
+// finishChunk records all the rows of chunk are inserted or rejected
+func (w *Writer) finishChunk(chunk *flushChunk) {
+	accepted := int(atomic.LoadInt64(&chunk.accepted))
+	rejected := chunk.rows - accepted
+	atomic.AddInt64(&w.state.pendingBytes, -int64(chunk.bytes))
+
+	duration := time.Since(chunk.start)
+	metrics.RowsInserted.Add(float64(accepted), w.name, w.insertTable())
+	metrics.BatchRows.Observe(int64(chunk.rows), w.name)
+	metrics.BatchDuration.Observe(duration.Milliseconds(), w.name)
+
+	logx.Statf("execute | flush %d rows (%d bytes) by %s to clickhouse table[%s] in %v, accepted=%d, rejected=%d",
+		chunk.rows, chunk.bytes, chunk.reason, w.insertTable(), duration, accepted, rejected)
+}
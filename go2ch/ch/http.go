@@ -0,0 +1,635 @@
+package ch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/klauspost/compress/zstd"
+
+	"go2ch/go2ch/config"
+)
+
+// protocols to talk to clickhouse
+const (
+	ProtocolNative = "native"
+	ProtocolHTTP   = "http"
+)
+
+// formats of the data sent over HTTP
+const (
+	FormatRowBinary   = "RowBinary"
+	FormatJSONEachRow = "JSONEachRow"
+)
+
+// compressions of the data sent over HTTP
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	errNotSupportedOverHTTP = errors.New("not supported over http")
+	exceptionCodeRegex      = regexp.MustCompile(`Code: (\d+)`)
+	insertQueryRegex        = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\s+(\S+)\s*(?:\((.*)\))?\s*$`)
+)
+
+// settingsKey is the key of query settings in context, which are sent as the parameters of HTTP requests
+type settingsKey struct{}
+
+// withSettings attaches query settings to ctx for both native and HTTP connections
+func withSettings(ctx context.Context, settings clickhouse.Settings) context.Context {
+	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+	return context.WithValue(ctx, settingsKey{}, settings)
+}
+
+// columnsKey is the key of the columns which a batch inserts in context
+type columnsKey struct{}
+
+// withColumns attaches the columns which a batch inserts to ctx, so that HTTP connections take their types
+// from the schema of writer rather than describing the table for every batch
+func withColumns(ctx context.Context, columns []*rowDesc) context.Context {
+	return context.WithValue(ctx, columnsKey{}, columns)
+}
+
+// httpConn talks to clickhouse through the HTTP interface, it implements driver.Conn,
+// so that batching, retries and column handling of the writer are the same as the native protocol.
+// Requests are sent to the nodes in turn.
+type httpConn struct {
+	urls        []string
+	next        uint32 // accessed atomically
+	database    string
+	username    string
+	password    string
+	format      string
+	compression string
+	client      *http.Client
+}
+
+// openHTTP opens a connection to the HTTP interface of clickhouse nodes in addrs,
+// an addr without scheme is taken as http://addr
+func openHTTP(c *config.ClickHouseConf, addrs []string) (driver.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("openHTTP | no address of clickhouse")
+	}
+	urls := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		urls = append(urls, strings.TrimRight(addr, "/"))
+	}
+	return &httpConn{
+		urls:        urls,
+		database:    c.Database,
+		username:    c.Username,
+		password:    c.Password,
+		format:      c.HTTPFormat,
+		compression: c.HTTPCompression,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: c.MaxIdleConns,
+				MaxConnsPerHost:     c.MaxOpenConns,
+				IdleConnTimeout:     time.Duration(c.ConnMaxLiftTimeMinute) * time.Minute,
+			},
+		},
+	}, nil
+}
+
+func (c *httpConn) Contributors() []string {
+	return nil
+}
+
+func (c *httpConn) ServerVersion() (*driver.ServerVersion, error) {
+	return nil, errNotSupportedOverHTTP
+}
+
+func (c *httpConn) Select(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return errNotSupportedOverHTTP
+}
+
+// Query queries in JSONCompact format, args are bound to the ? in query
+func (c *httpConn) Query(ctx context.Context, query string, args ...interface{}) (driver.Rows, error) {
+	query, err := bind(query, args)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.do(ctx, query+" FORMAT JSONCompact", nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Meta []struct {
+			Name string `json:"name"`
+		} `json:"meta"`
+		Data [][]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("query | unmarshal result failed: %v", err)
+	}
+	rows := &httpRows{data: result.Data, index: -1}
+	for _, m := range result.Meta {
+		rows.columns = append(rows.columns, m.Name)
+	}
+	return rows, nil
+}
+
+func (c *httpConn) QueryRow(ctx context.Context, query string, args ...interface{}) driver.Row {
+	rows, err := c.Query(ctx, query, args...)
+	if err != nil {
+		return &httpRow{err: err}
+	}
+	if !rows.Next() {
+		return &httpRow{err: errors.New("queryRow | no rows in result")}
+	}
+	return &httpRow{rows: rows}
+}
+
+// PrepareBatch takes the types of columns to insert from the columns in ctx, see withColumns,
+// otherwise it describes the table in query, like the native protocol which receives them from server before sending data
+func (c *httpConn) PrepareBatch(ctx context.Context, query string) (driver.Batch, error) {
+	match := insertQueryRegex.FindStringSubmatch(query)
+	if match == nil {
+		return nil, fmt.Errorf("prepareBatch | [%s] is not an insert query", query)
+	}
+	if columns, ok := ctx.Value(columnsKey{}).([]*rowDesc); ok {
+		batch := &httpBatch{ctx: ctx, conn: c, query: query}
+		for _, column := range columns {
+			batch.names = append(batch.names, column.Name)
+			batch.types = append(batch.types, column.chType)
+		}
+		return batch, nil
+	}
+	rows, err := c.Query(ctx, "DESCRIBE TABLE "+match[1])
+	if err != nil {
+		return nil, fmt.Errorf("prepareBatch | describe table [%s] failed: %w", match[1], err)
+	}
+	types := make(map[string]*chType)
+	var names []string
+	for rows.Next() {
+		var name, typ, defaultType string
+		if err := rows.Scan(&name, &typ, &defaultType); err != nil {
+			return nil, fmt.Errorf("prepareBatch | scan columns of [%s] failed: %v", match[1], err)
+		}
+		t, err := parseType(typ)
+		if err != nil {
+			return nil, fmt.Errorf("prepareBatch | %v", err)
+		}
+		types[name] = t
+		if insertableDefault(defaultType) {
+			names = append(names, name)
+		}
+	}
+
+	if strings.TrimSpace(match[2]) != "" {
+		args, err := splitArgs(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("prepareBatch | parse columns of [%s] failed: %v", query, err)
+		}
+		names = make([]string, 0, len(args))
+		for _, arg := range args {
+			names = append(names, strings.Trim(arg, "`\""))
+		}
+	}
+
+	batch := &httpBatch{ctx: ctx, conn: c, query: query, names: names}
+	for _, name := range names {
+		t, ok := types[name]
+		if !ok {
+			return nil, &clickhouse.Exception{Code: 16, Name: "DB::Exception", Message: fmt.Sprintf("No such column %s in table %s", name, match[1])}
+		}
+		batch.types = append(batch.types, t)
+	}
+	return batch, nil
+}
+
+// Exec executes query, args are bound to the ? in query
+func (c *httpConn) Exec(ctx context.Context, query string, args ...interface{}) error {
+	query, err := bind(query, args)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, query, nil, false)
+	return err
+}
+
+func (c *httpConn) AsyncInsert(ctx context.Context, query string, wait bool) error {
+	return c.Exec(withSettings(ctx, clickhouse.Settings{
+		"async_insert":          1,
+		"wait_for_async_insert": map[bool]int{false: 0, true: 1}[wait],
+	}), query)
+}
+
+func (c *httpConn) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url()+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ping | clickhouse responds %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *httpConn) Stats() driver.Stats {
+	return driver.Stats{}
+}
+
+func (c *httpConn) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// url returns the url of the next node
+func (c *httpConn) url() string {
+	i := atomic.AddUint32(&c.next, 1)
+	return c.urls[int(i)%len(c.urls)]
+}
+
+// do posts query with data, data is compressed if compress is set, it returns the response body
+func (c *httpConn) do(ctx context.Context, query string, data []byte, compress bool) ([]byte, error) {
+	params := url.Values{}
+	params.Set("database", c.database)
+	if settings, ok := ctx.Value(settingsKey{}).(clickhouse.Settings); ok {
+		for k, v := range settings {
+			params.Set(k, fmt.Sprint(v))
+		}
+	}
+
+	// the query is in the body unless there is data
+	body := []byte(query)
+	if data != nil {
+		params.Set("query", query)
+		body = data
+	}
+	var encoding string
+	if compress && c.compression != "" && c.compression != CompressionNone {
+		var err error
+		if body, err = compressData(c.compression, body); err != nil {
+			return nil, err
+		}
+		encoding = c.compression
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url()+"/?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("do | create request failed: %v", err)
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if c.username != "" {
+		req.Header.Set("X-ClickHouse-User", c.username)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do | request clickhouse failed: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("do | read response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpError(resp, respBody)
+	}
+	return respBody, nil
+}
+
+// httpError converts the error response of clickhouse to *clickhouse.Exception like the native protocol,
+// so that the errors of data are told from the errors of network
+func httpError(resp *http.Response, body []byte) error {
+	message := strings.TrimSpace(string(body))
+	code := resp.Header.Get("X-ClickHouse-Exception-Code")
+	if code == "" {
+		if match := exceptionCodeRegex.FindStringSubmatch(message); match != nil {
+			code = match[1]
+		}
+	}
+	if n, err := strconv.Atoi(code); err == nil {
+		return &clickhouse.Exception{Code: int32(n), Name: "DB::Exception", Message: message}
+	}
+	return fmt.Errorf("httpError | clickhouse responds %s: %s", resp.Status, message)
+}
+
+// compressData compresses data by gzip or zstd
+func compressData(compression string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("compressData | create zstd writer failed: %v", err)
+		}
+		w = zw
+	default:
+		return nil, fmt.Errorf("compressData | unsupported compression [%s]", compression)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("compressData | compress data failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("compressData | compress data failed: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// bind replaces the ? which are not quoted in query with the literals of args
+func bind(query string, args []interface{}) (string, error) {
+	if len(args) == 0 {
+		return query, nil
+	}
+	var b strings.Builder
+	var quote byte
+	n := 0
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && i+1 < len(query) {
+				b.WriteByte(ch)
+				i++
+				ch = query[i]
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '`' || ch == '"':
+			quote = ch
+		case ch == '?':
+			if n >= len(args) {
+				return "", fmt.Errorf("bind | too few arguments for query [%s]", query)
+			}
+			b.WriteString(literal(args[n]))
+			n++
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	if n != len(args) {
+		return "", fmt.Errorf("bind | %d arguments for %d placeholders in query [%s]", len(args), n, query)
+	}
+	return b.String(), nil
+}
+
+// literal formats v as a literal in sql
+func literal(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return quoteString(value)
+	case time.Time:
+		return quoteString(value.UTC().Format("2006-01-02 15:04:05"))
+	case bool:
+		if value {
+			return "1"
+		}
+		return "0"
+	}
+	return quoteString(fmt.Sprint(v))
+}
+
+// quoteString quotes s in single quotes
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// httpBatch encodes rows in the format of conn as they are appended, and sends them in one request.
+// Values appended by columns are encoded in rows once every column is appended.
+type httpBatch struct {
+	ctx     context.Context
+	conn    *httpConn
+	query   string
+	names   []string
+	types   []*chType
+	columns []reflect.Value // slices appended by columns
+	data    []byte
+	rows    int
+}
+
+func (b *httpBatch) Abort() error {
+	b.data, b.rows, b.columns = nil, 0, nil
+	return nil
+}
+
+func (b *httpBatch) Append(v ...interface{}) error {
+	if len(v) != len(b.types) {
+		return fmt.Errorf("append | %d values for %d columns", len(v), len(b.types))
+	}
+
+	data := b.data
+	var err error
+	if b.conn.format == FormatJSONEachRow {
+		row := make(map[string]interface{}, len(v))
+		for i, value := range v {
+			if row[b.names[i]], err = jsonValue(b.types[i], value); err != nil {
+				return fmt.Errorf("append | column [%s]: %v", b.names[i], err)
+			}
+		}
+		bs, err := json.Marshal(row)
+		if err != nil {
+			return fmt.Errorf("append | marshal row failed: %v", err)
+		}
+		data = append(append(data, bs...), '\n')
+	} else {
+		for i, value := range v {
+			if data, err = appendRowBinary(data, b.types[i], value); err != nil {
+				return fmt.Errorf("append | column [%s]: %v", b.names[i], err)
+			}
+		}
+	}
+	// a row which fails to be encoded is left out entirely
+	b.data = data
+	b.rows++
+	return nil
+}
+
+func (b *httpBatch) AppendStruct(v interface{}) error {
+	return errNotSupportedOverHTTP
+}
+
+func (b *httpBatch) Column(i int) driver.BatchColumn {
+	return &httpBatchColumn{batch: b, index: i}
+}
+
+// appendColumn appends the values of the ith column in slice v, and encodes the rows once every column is appended
+func (b *httpBatch) appendColumn(i int, v interface{}) error {
+	if i < 0 || i >= len(b.types) {
+		return fmt.Errorf("appendColumn | invalid column index %d", i)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return fmt.Errorf("appendColumn | column [%s] requires a slice, but got %T", b.names[i], v)
+	}
+	if b.columns == nil {
+		b.columns = make([]reflect.Value, len(b.types))
+	}
+	if b.columns[i].IsValid() {
+		return fmt.Errorf("appendColumn | column [%s] is appended already", b.names[i])
+	}
+	b.columns[i] = rv
+	for _, column := range b.columns {
+		if !column.IsValid() {
+			return nil
+		}
+	}
+
+	columns := b.columns
+	b.columns = nil
+	n := columns[0].Len()
+	for j, column := range columns {
+		if column.Len() != n {
+			return fmt.Errorf("appendColumn | column [%s] has %d values, but column [%s] has %d", b.names[j], column.Len(), b.names[0], n)
+		}
+	}
+	values := make([]interface{}, len(columns))
+	for row := 0; row < n; row++ {
+		for j, column := range columns {
+			values[j] = column.Index(row).Interface()
+		}
+		if err := b.Append(values...); err != nil {
+			return fmt.Errorf("appendColumn | row %d: %v", row, err)
+		}
+	}
+	return nil
+}
+
+// Send sends the rows in one request, nothing is sent if there are no rows
+func (b *httpBatch) Send() error {
+	if b.rows == 0 {
+		return nil
+	}
+	format := b.conn.format
+	if format == "" {
+		format = FormatRowBinary
+	}
+	_, err := b.conn.do(b.ctx, b.query+" FORMAT "+format, b.data, true)
+	if err != nil {
+		return err
+	}
+	b.data, b.rows = nil, 0
+	return nil
+}
+
+// httpBatchColumn appends the values of a column to batch
+type httpBatchColumn struct {
+	batch *httpBatch
+	index int
+}
+
+func (c *httpBatchColumn) Append(v interface{}) error {
+	return c.batch.appendColumn(c.index, v)
+}
+
+// httpRows is the result of query in JSONCompact format
+type httpRows struct {
+	columns []string
+	data    [][]json.RawMessage
+	index   int
+}
+
+func (r *httpRows) Next() bool {
+	r.index++
+	return r.index < len(r.data)
+}
+
+// Scan scans the values of current row into dest, strings are scanned in the same way as the other types
+// except that they can take any value
+func (r *httpRows) Scan(dest ...interface{}) error {
+	if r.index < 0 || r.index >= len(r.data) {
+		return errors.New("scan | no current row")
+	}
+	row := r.data[r.index]
+	if len(dest) > len(row) {
+		return fmt.Errorf("scan | %d destinations for %d columns", len(dest), len(row))
+	}
+	for i, d := range dest {
+		raw := row[i]
+		if s, ok := d.(*string); ok && (len(raw) == 0 || raw[0] != '"') {
+			*s = string(raw)
+			continue
+		}
+		err := json.Unmarshal(raw, d)
+		// 64 bit integers are quoted in json
+		if err != nil && len(raw) > 1 && raw[0] == '"' {
+			err = json.Unmarshal(raw[1:len(raw)-1], d)
+		}
+		if err != nil {
+			return fmt.Errorf("scan | scan column [%s] failed: %v", r.columns[i], err)
+		}
+	}
+	return nil
+}
+
+func (r *httpRows) ScanStruct(dest interface{}) error {
+	return errNotSupportedOverHTTP
+}
+
+func (r *httpRows) ColumnTypes() []driver.ColumnType {
+	return nil
+}
+
+func (r *httpRows) Totals(dest ...interface{}) error {
+	return errNotSupportedOverHTTP
+}
+
+func (r *httpRows) Columns() []string {
+	return r.columns
+}
+
+func (r *httpRows) Close() error {
+	return nil
+}
+
+func (r *httpRows) Err() error {
+	return nil
+}
+
+// httpRow is the first row of the result of query
+type httpRow struct {
+	rows driver.Rows
+	err  error
+}
+
+func (r *httpRow) Err() error {
+	return r.err
+}
+
+func (r *httpRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.rows.Scan(dest...)
+}
+
+func (r *httpRow) ScanStruct(dest interface{}) error {
+	return errNotSupportedOverHTTP
+}
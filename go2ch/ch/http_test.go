@@ -0,0 +1,255 @@
+package ch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+
+	"go2ch/go2ch/config"
+)
+
+// httpServer is a fake clickhouse HTTP interface
+type httpServer struct {
+	lock     sync.Mutex
+	queries  []string
+	inserted []byte
+	settings map[string]string
+}
+
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ping" {
+		_, _ = w.Write([]byte("Ok.\n"))
+		return
+	}
+
+	var body []byte
+	switch r.Header.Get("Content-Encoding") {
+	case "gzip":
+		zr, _ := gzip.NewReader(r.Body)
+		body, _ = ioutil.ReadAll(zr)
+	case "zstd":
+		zr, _ := zstd.NewReader(r.Body)
+		body, _ = ioutil.ReadAll(zr)
+	default:
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+	query := r.URL.Query().Get("query")
+	if query == "" {
+		query = string(body)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queries = append(s.queries, query)
+	s.settings = map[string]string{"database": r.URL.Query().Get("database"), "token": r.URL.Query().Get("insert_deduplication_token")}
+
+	switch {
+	case strings.HasPrefix(query, "DESCRIBE TABLE t "):
+		_, _ = w.Write([]byte(`{"meta": [{"name": "name"}, {"name": "type"}, {"name": "default_type"}], "data": [
+			["id", "UInt64", ""], ["name", "String", ""], ["tags", "Array(String)", ""], ["upper", "String", "MATERIALIZED"]]}`))
+	case strings.HasPrefix(query, "DESCRIBE TABLE e "):
+		_, _ = w.Write([]byte(`{"meta": [{"name": "name"}, {"name": "type"}, {"name": "default_type"}], "data": [
+			["id", "UInt64", ""], ["raw", "String", "EPHEMERAL"], ["upper", "String", "MATERIALIZED"], ["alias", "String", "ALIAS"]]}`))
+	case strings.HasPrefix(query, "SELECT name, position"):
+		_, _ = w.Write([]byte(`{"meta": [{"name": "name"}, {"name": "position"}], "data": [["id", "1"], ["name", "2"]]}`))
+	case strings.HasPrefix(query, "INSERT INTO t "):
+		if strings.Contains(string(body), "bad") {
+			w.Header().Set("X-ClickHouse-Exception-Code", "27")
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("Code: 27. DB::Exception: Cannot parse input"))
+			return
+		}
+		s.inserted = body
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Code: 60. DB::Exception: Table default.x doesn't exist. (UNKNOWN_TABLE)"))
+	}
+}
+
+func TestHTTPConn(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		compression string
+		expect      string
+	}{
+		{
+			name:        "json each row in gzip",
+			format:      FormatJSONEachRow,
+			compression: CompressionGzip,
+			expect:      "{\"id\":1,\"name\":\"a\",\"tags\":[\"x\"]}\n{\"id\":2,\"name\":\"b\",\"tags\":[]}\n",
+		},
+		{
+			name:        "row binary in zstd",
+			format:      FormatRowBinary,
+			compression: CompressionZstd,
+			expect:      "\x01\x00\x00\x00\x00\x00\x00\x00\x01a\x01\x01x" + "\x02\x00\x00\x00\x00\x00\x00\x00\x01b\x00",
+		},
+		{
+			name:        "row binary without compression",
+			format:      FormatRowBinary,
+			compression: CompressionNone,
+			expect:      "\x01\x00\x00\x00\x00\x00\x00\x00\x01a\x01\x01x" + "\x02\x00\x00\x00\x00\x00\x00\x00\x01b\x00",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &httpServer{}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+
+			conn, err := openHTTP(&config.ClickHouseConf{Database: "db", HTTPFormat: test.format, HTTPCompression: test.compression}, []string{strings.TrimPrefix(ts.URL, "http://")})
+			assert.Nil(t, err)
+			assert.Nil(t, conn.Ping(context.Background()))
+
+			ctx := withDedupToken(context.Background(), newPendingRows("a"))
+			batch, err := conn.PrepareBatch(ctx, "INSERT INTO t (`id`, `name`, `tags`)")
+			assert.Nil(t, err)
+			assert.Nil(t, batch.Append(uint64(1), "a", []string{"x"}))
+			assert.NotNil(t, batch.Append(uint64(1), "a"))
+			assert.Nil(t, batch.Append(uint64(2), "b", []string{}))
+			assert.Nil(t, batch.Send())
+
+			assert.Equal(t, test.expect, string(server.inserted))
+			assert.Equal(t, "INSERT INTO t (`id`, `name`, `tags`) FORMAT "+test.format, server.queries[len(server.queries)-1])
+			assert.Equal(t, map[string]string{"database": "db", "token": "-0-0-0-1"}, server.settings)
+
+			// values appended by columns are encoded in the same rows
+			server.inserted = nil
+			batch, err = conn.PrepareBatch(ctx, "INSERT INTO t (`id`, `name`, `tags`)")
+			assert.Nil(t, err)
+			assert.Nil(t, batch.Column(0).Append([]uint64{1, 2}))
+			assert.Nil(t, batch.Column(1).Append([]string{"a", "b"}))
+			assert.NotNil(t, batch.Column(1).Append([]string{"c"}))
+			assert.Nil(t, batch.Column(2).Append([][]string{{"x"}, {}}))
+			assert.Nil(t, batch.Send())
+			assert.Equal(t, test.expect, string(server.inserted))
+
+			// the columns of table are inserted if they are not listed, except the materialized ones
+			batch, err = conn.PrepareBatch(context.Background(), "INSERT INTO t")
+			assert.Nil(t, err)
+			assert.Nil(t, batch.Append(uint64(1), "a", []string{"x"}))
+		})
+	}
+}
+
+func TestHTTPConnWithColumns(t *testing.T) {
+	server := &httpServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	conn, err := openHTTP(&config.ClickHouseConf{HTTPFormat: FormatJSONEachRow}, []string{ts.URL})
+	assert.Nil(t, err)
+
+	var columns []*rowDesc
+	for _, typ := range [][2]string{{"id", "UInt64"}, {"name", "String"}} {
+		chType, err := parseType(typ[1])
+		assert.Nil(t, err)
+		columns = append(columns, &rowDesc{Name: typ[0], Type: typ[1], chType: chType})
+	}
+
+	// the table is not described when the columns are given by the schema of writer
+	batch, err := conn.PrepareBatch(withColumns(context.Background(), columns), "INSERT INTO t (`id`, `name`)")
+	assert.Nil(t, err)
+	assert.Nil(t, batch.Append(uint64(1), "a"))
+	assert.Nil(t, batch.Send())
+	assert.Equal(t, []string{"INSERT INTO t (`id`, `name`) FORMAT JSONEachRow"}, server.queries)
+	assert.Equal(t, "{\"id\":1,\"name\":\"a\"}\n", string(server.inserted))
+}
+
+func TestHTTPPrepareBatchInsertable(t *testing.T) {
+	ts := httptest.NewServer(&httpServer{})
+	defer ts.Close()
+	conn, err := openHTTP(&config.ClickHouseConf{HTTPFormat: FormatJSONEachRow}, []string{ts.URL})
+	assert.Nil(t, err)
+
+	// the columns inserted without a list are the ones of the schema of writer, EPHEMERAL ones included
+	batch, err := conn.PrepareBatch(context.Background(), "INSERT INTO e")
+	assert.Nil(t, err)
+	s := newSchema("e", []*rowDesc{
+		{Name: "id", Type: "UInt64"},
+		{Name: "raw", Type: "String", DefaultType: defaultTypeEphemeral},
+		{Name: "upper", Type: "String", DefaultType: defaultTypeMaterialized},
+		{Name: "alias", Type: "String", DefaultType: defaultTypeAlias},
+	})
+	var names []string
+	for _, column := range s.columns {
+		names = append(names, column.Name)
+	}
+	assert.Equal(t, names, batch.(*httpBatch).names)
+}
+
+func TestHTTPConnErrors(t *testing.T) {
+	ts := httptest.NewServer(&httpServer{})
+	defer ts.Close()
+	conn, err := openHTTP(&config.ClickHouseConf{HTTPFormat: FormatJSONEachRow}, []string{ts.URL})
+	assert.Nil(t, err)
+
+	// the column is not in table
+	_, err = conn.PrepareBatch(context.Background(), "INSERT INTO t (`id`, `other`)")
+	assert.True(t, isSchemaMismatch(err))
+
+	// clickhouse refuses data
+	batch, err := conn.PrepareBatch(context.Background(), "INSERT INTO t (`name`)")
+	assert.Nil(t, err)
+	assert.Nil(t, batch.Append("bad"))
+	err = batch.Send()
+	assert.True(t, isDataError(err))
+	assert.Equal(t, int32(27), err.(*clickhouse.Exception).Code)
+
+	// the code is parsed from message if it is not in header
+	err = conn.Exec(context.Background(), "DROP TABLE x")
+	assert.Equal(t, int32(60), err.(*clickhouse.Exception).Code)
+
+	// clickhouse can not be reached
+	unreachable, err := openHTTP(&config.ClickHouseConf{}, []string{"127.0.0.1:1"})
+	assert.Nil(t, err)
+	err = unreachable.Exec(context.Background(), "SELECT 1")
+	assert.NotNil(t, err)
+	assert.False(t, isDataError(err))
+}
+
+func TestHTTPQuery(t *testing.T) {
+	server := &httpServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	conn, err := openHTTP(&config.ClickHouseConf{}, []string{ts.URL})
+	assert.Nil(t, err)
+
+	rows, err := conn.Query(context.Background(), "SELECT name, position FROM system.columns WHERE database = ? AND table = ? AND name != '?'", "db", "it's")
+	assert.Nil(t, err)
+	assert.Equal(t, "SELECT name, position FROM system.columns WHERE database = 'db' AND table = 'it\\'s' AND name != '?' FORMAT JSONCompact", server.queries[0])
+
+	var names []string
+	var positions []int64
+	for rows.Next() {
+		var name string
+		var position int64
+		assert.Nil(t, rows.Scan(&name, &position))
+		names = append(names, name)
+		positions = append(positions, position)
+	}
+	assert.Equal(t, []string{"id", "name"}, names)
+	assert.Equal(t, []int64{1, 2}, positions)
+
+	_, err = conn.Query(context.Background(), "SELECT ?", "a", "b")
+	assert.NotNil(t, err)
+}
+
+func TestBind(t *testing.T) {
+	query, err := bind("SELECT ?, ?, ?, `?`", []interface{}{nil, true, time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)})
+	assert.Nil(t, err)
+	assert.Equal(t, "SELECT NULL, 1, '2022-04-01 00:00:00', `?`", query)
+	assert.True(t, bytes.Contains([]byte(literal(`a\b`)), []byte(`a\\b`)))
+}
@@ -0,0 +1,44 @@
+package ch
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// backoff computes the waiting time before retrying
+type backoff struct {
+	maxRetries  int // 0 means retrying forever
+	interval    time.Duration
+	maxInterval time.Duration
+}
+
+// exhausted reports whether it should give up after attempt times of retrying
+func (b backoff) exhausted(attempt int) bool {
+	return b.maxRetries > 0 && attempt >= b.maxRetries
+}
+
+// duration returns the waiting time before the next retry, it grows exponentially with attempt,
+// and the jitter spreads the retries of writers which fail at the same time
+func (b backoff) duration(attempt int) time.Duration {
+	d := b.interval
+	for i := 0; i < attempt && d < b.maxInterval; i++ {
+		d *= 2
+	}
+	if d > b.maxInterval {
+		d = b.maxInterval
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isDataError reports whether err is returned by clickhouse server because of the data sent,
+// rather than clickhouse can not be reached, so that retrying the same data makes no sense
+func isDataError(err error) bool {
+	var exception *clickhouse.Exception
+	return errors.As(err, &exception)
+}
@@ -0,0 +1,357 @@
+package ch
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// intSizes are the sizes in bytes of the integer types in RowBinary
+var intSizes = map[string]int{
+	"Int8":   1,
+	"Int16":  2,
+	"Int32":  4,
+	"Int64":  8,
+	"UInt8":  1,
+	"UInt16": 2,
+	"UInt32": 4,
+	"UInt64": 8,
+	"Enum8":  1,
+	"Enum16": 2,
+}
+
+// appendRowBinary appends v of type t to buf in RowBinary format, v is converted by the converter of t, see compile
+func appendRowBinary(buf []byte, t *chType, v interface{}) ([]byte, error) {
+	switch t.name {
+	case "LowCardinality", "SimpleAggregateFunction":
+		return appendRowBinary(buf, t.elems[0], v)
+	case "Nullable":
+		v = deref(v)
+		if v == nil {
+			return append(buf, 1), nil
+		}
+		return appendRowBinary(append(buf, 0), t.elems[0], v)
+	}
+
+	v = deref(v)
+	switch value := v.(type) {
+	case string:
+		return appendRowBinaryString(buf, t, value)
+	case []byte:
+		// Array(UInt8) is also []byte
+		if t.name != "Array" {
+			return appendRowBinaryString(buf, t, string(value))
+		}
+	case bool:
+		if value {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case time.Time:
+		return appendRowBinaryTime(buf, t, value)
+	case decimal.Decimal:
+		return appendRowBinaryDecimal(buf, t, value)
+	case *big.Int:
+		return appendBigInt(buf, value, bigIntBits[t.name]/8), nil
+	case uuid.UUID:
+		// two little endian UInt64 of the halves
+		for i := 7; i >= 0; i-- {
+			buf = append(buf, value[i])
+		}
+		for i := 15; i >= 8; i-- {
+			buf = append(buf, value[i])
+		}
+		return buf, nil
+	case net.IP:
+		if t.name == "IPv4" {
+			ip := value.To4()
+			if ip == nil {
+				return nil, fmt.Errorf("appendRowBinary | [%v] is not an IPv4 address", value)
+			}
+			return append(buf, ip[3], ip[2], ip[1], ip[0]), nil
+		}
+		return append(buf, value.To16()...), nil
+	case []interface{}:
+		if t.name != "Tuple" || len(value) != len(t.elems) {
+			return nil, fmt.Errorf("appendRowBinary | can not append %T value to %s", v, t.raw)
+		}
+		var err error
+		for i, item := range value {
+			if buf, err = appendRowBinary(buf, t.elems[i], item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch {
+	case !rv.IsValid():
+		return nil, fmt.Errorf("appendRowBinary | can not append NULL to %s", t.raw)
+	case rv.Kind() == reflect.Slice && t.name == "Array":
+		buf = appendUvarint(buf, uint64(rv.Len()))
+		var err error
+		for i := 0; i < rv.Len(); i++ {
+			if buf, err = appendRowBinary(buf, t.elems[0], rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case rv.Kind() == reflect.Map && t.name == "Map":
+		buf = appendUvarint(buf, uint64(rv.Len()))
+		var err error
+		iter := rv.MapRange()
+		for iter.Next() {
+			if buf, err = appendRowBinary(buf, t.elems[0], iter.Key().Interface()); err != nil {
+				return nil, err
+			}
+			if buf, err = appendRowBinary(buf, t.elems[1], iter.Value().Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64:
+		if t.name == "Float32" {
+			return appendUint32(buf, math.Float32bits(float32(rv.Float()))), nil
+		}
+		return appendUint64(buf, math.Float64bits(rv.Float())), nil
+	}
+
+	size, ok := intSizes[t.name]
+	if !ok {
+		return nil, fmt.Errorf("appendRowBinary | can not append %T value to %s", v, t.raw)
+	}
+	var n uint64
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = uint64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = rv.Uint()
+	default:
+		return nil, fmt.Errorf("appendRowBinary | can not append %T value to %s", v, t.raw)
+	}
+	for i := 0; i < size; i++ {
+		buf = append(buf, byte(n>>(8*i)))
+	}
+	return buf, nil
+}
+
+// appendRowBinaryString appends a string, a FixedString, or the value of an enum name
+func appendRowBinaryString(buf []byte, t *chType, s string) ([]byte, error) {
+	switch t.name {
+	case "FixedString":
+		n, err := t.intParam(0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(s) >= n {
+			return append(buf, s[:n]...), nil
+		}
+		return append(append(buf, s...), make([]byte, n-len(s))...), nil
+	case "Enum8", "Enum16", "Enum":
+		for value, name := range t.enum {
+			if name == s {
+				size := intSizes[t.name]
+				if size == 0 {
+					size = 2
+				}
+				for i := 0; i < size; i++ {
+					buf = append(buf, byte(uint64(value)>>(8*i)))
+				}
+				return buf, nil
+			}
+		}
+		return nil, fmt.Errorf("appendRowBinary | [%s] is not in %s", s, t.raw)
+	case "String":
+		buf = appendUvarint(buf, uint64(len(s)))
+		return append(buf, s...), nil
+	}
+	return nil, fmt.Errorf("appendRowBinary | can not append string value to %s", t.raw)
+}
+
+// appendRowBinaryTime appends days of Date and Date32, seconds of DateTime, or ticks of DateTime64
+func appendRowBinaryTime(buf []byte, t *chType, v time.Time) ([]byte, error) {
+	switch t.name {
+	case "Date", "Date32":
+		days := time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400
+		if t.name == "Date" {
+			return appendUint16(buf, uint16(days)), nil
+		}
+		return appendUint32(buf, uint32(int32(days))), nil
+	case "DateTime":
+		return appendUint32(buf, uint32(v.Unix())), nil
+	case "DateTime64":
+		precision, err := t.intParam(0, 3)
+		if err != nil {
+			return nil, err
+		}
+		ticks := v.UnixNano() / int64(math.Pow10(9-precision))
+		return appendUint64(buf, uint64(ticks)), nil
+	}
+	return nil, fmt.Errorf("appendRowBinary | can not append time value to %s", t.raw)
+}
+
+// appendRowBinaryDecimal appends the unscaled value of a decimal in the size by its precision
+func appendRowBinaryDecimal(buf []byte, t *chType, v decimal.Decimal) ([]byte, error) {
+	precision, scale, err := decimalParams(t)
+	if err != nil {
+		return nil, err
+	}
+	unscaled := v.Shift(int32(scale)).BigInt()
+	switch {
+	case precision <= 9:
+		return appendBigInt(buf, unscaled, 4), nil
+	case precision <= 18:
+		return appendBigInt(buf, unscaled, 8), nil
+	case precision <= 38:
+		return appendBigInt(buf, unscaled, 16), nil
+	default:
+		return appendBigInt(buf, unscaled, 32), nil
+	}
+}
+
+// appendBigInt appends n in two's complement little endian of size bytes, n is not changed
+func appendBigInt(buf []byte, n *big.Int, size int) []byte {
+	v := new(big.Int).Set(n)
+	if v.Sign() < 0 {
+		v.Add(v, new(big.Int).Lsh(big.NewInt(1), uint(size*8)))
+	}
+	be := v.Bytes()
+	for i := 0; i < size; i++ {
+		if i < len(be) {
+			buf = append(buf, be[len(be)-1-i])
+		} else {
+			buf = append(buf, 0)
+		}
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], n)]...)
+}
+
+func appendUint16(buf []byte, n uint16) []byte {
+	return append(buf, byte(n), byte(n>>8))
+}
+
+func appendUint32(buf []byte, n uint32) []byte {
+	return append(buf, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+}
+
+func appendUint64(buf []byte, n uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(n)), uint32(n>>32))
+}
+
+// jsonValue converts v of type t to the value encoded in JSONEachRow format, v is converted by the converter of t.
+// Times are unix timestamps except dates, and decimals and big integers are numbers in full precision.
+func jsonValue(t *chType, v interface{}) (interface{}, error) {
+	v = deref(v)
+	switch value := v.(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		switch baseType(t).name {
+		case "Date", "Date32":
+			return value.Format("2006-01-02"), nil
+		case "DateTime64":
+			return json.Number(decimal.New(value.UnixNano(), -9).String()), nil
+		}
+		return value.Unix(), nil
+	case decimal.Decimal:
+		return json.Number(value.String()), nil
+	case *big.Int:
+		return json.Number(value.String()), nil
+	case uuid.UUID:
+		return value.String(), nil
+	case net.IP:
+		return value.String(), nil
+	case []byte:
+		if baseType(t).name != "Array" {
+			return string(value), nil
+		}
+	case []interface{}:
+		bt := baseType(t)
+		if bt.name != "Tuple" || len(value) != len(bt.elems) {
+			return nil, fmt.Errorf("jsonValue | can not convert %T value to %s", v, t.raw)
+		}
+		values := make([]interface{}, 0, len(value))
+		for i, item := range value {
+			item, err := jsonValue(bt.elems[i], item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, item)
+		}
+		return values, nil
+	}
+
+	bt := baseType(t)
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Kind() == reflect.Slice && bt.name == "Array":
+		values := make([]interface{}, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			item, err := jsonValue(bt.elems[0], rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, item)
+		}
+		return values, nil
+	case rv.Kind() == reflect.Map && bt.name == "Map":
+		values := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, err := jsonValue(bt.elems[0], iter.Key().Interface())
+			if err != nil {
+				return nil, err
+			}
+			item, err := jsonValue(bt.elems[1], iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			values[fmt.Sprint(key)] = item
+		}
+		return values, nil
+	}
+	return v, nil
+}
+
+// baseType returns the type wrapped in Nullable, LowCardinality and SimpleAggregateFunction
+func baseType(t *chType) *chType {
+	for t.name == "Nullable" || t.name == "LowCardinality" || t.name == "SimpleAggregateFunction" {
+		t = t.elems[0]
+	}
+	return t
+}
+
+// deref returns the value which v points to, or nil if v is a nil pointer, big integers are kept as pointers
+func deref(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	if n, ok := v.(*big.Int); ok {
+		if n == nil {
+			return nil
+		}
+		return n
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr {
+		return v
+	}
+	if rv.IsNil() {
+		return nil
+	}
+	return rv.Elem().Interface()
+}
@@ -0,0 +1,91 @@
+package ch
+
+import (
+	"encoding/json"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendRowBinary(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		typ    string
+		input  interface{}
+		expect []byte
+		err    bool
+	}{
+		{typ: "Int16", input: int16(-2), expect: []byte{0xfe, 0xff}},
+		{typ: "UInt32", input: uint32(1), expect: []byte{1, 0, 0, 0}},
+		{typ: "Float32", input: float32(1), expect: []byte{0, 0, 0x80, 0x3f}},
+		{typ: "Bool", input: true, expect: []byte{1}},
+		{typ: "String", input: "ab", expect: []byte{2, 'a', 'b'}},
+		{typ: "FixedString(3)", input: "ab", expect: []byte{'a', 'b', 0}},
+		{typ: "Enum8('a' = 1, 'b' = -1)", input: "b", expect: []byte{0xff}},
+		{typ: "Enum8('a' = 1)", input: "c", err: true},
+		{typ: "Nullable(String)", input: str("a"), expect: []byte{0, 1, 'a'}},
+		{typ: "Nullable(String)", input: (*string)(nil), expect: []byte{1}},
+		{typ: "LowCardinality(Nullable(String))", input: nil, expect: []byte{1}},
+		{typ: "Date", input: time.Date(1970, 1, 3, 23, 0, 0, 0, time.FixedZone("", 3600)), expect: []byte{2, 0}},
+		{typ: "DateTime", input: time.Unix(256, 0), expect: []byte{0, 1, 0, 0}},
+		{typ: "DateTime64(3)", input: time.Unix(1, 5e6), expect: []byte{0xed, 0x03, 0, 0, 0, 0, 0, 0}},
+		{typ: "Decimal(9, 2)", input: decimal.RequireFromString("-0.01"), expect: []byte{0xff, 0xff, 0xff, 0xff}},
+		{typ: "Decimal64(1)", input: decimal.RequireFromString("1.5"), expect: []byte{15, 0, 0, 0, 0, 0, 0, 0}},
+		{typ: "Int128", input: big.NewInt(-1), expect: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{typ: "UUID", input: uuid.MustParse("00010203-0405-0607-0809-0a0b0c0d0e0f"), expect: []byte{7, 6, 5, 4, 3, 2, 1, 0, 15, 14, 13, 12, 11, 10, 9, 8}},
+		{typ: "IPv4", input: net.ParseIP("1.2.3.4").To4(), expect: []byte{4, 3, 2, 1}},
+		{typ: "Array(UInt8)", input: []uint8{1, 2}, expect: []byte{2, 1, 2}},
+		{typ: "Map(String, UInt8)", input: map[string]uint8{"a": 1}, expect: []byte{1, 1, 'a', 1}},
+		{typ: "Tuple(String, UInt8)", input: []interface{}{"a", uint8(1)}, expect: []byte{1, 'a', 1}},
+		{typ: "UInt8", input: "a", err: true},
+		{typ: "String", input: nil, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.typ, func(t *testing.T) {
+			typ, err := parseType(test.typ)
+			assert.Nil(t, err)
+			buf, err := appendRowBinary(nil, typ, test.input)
+			if test.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, buf)
+		})
+	}
+}
+
+func TestJSONValue(t *testing.T) {
+	tests := []struct {
+		typ    string
+		input  interface{}
+		expect string
+	}{
+		{typ: "Date", input: time.Date(2022, 4, 1, 23, 0, 0, 0, time.UTC), expect: `"2022-04-01"`},
+		{typ: "DateTime", input: time.Unix(10, 0), expect: `10`},
+		{typ: "Nullable(DateTime64(3))", input: func() *time.Time { v := time.Unix(10, 5e6); return &v }(), expect: `10.005`},
+		{typ: "Decimal(38, 10)", input: decimal.RequireFromString("12345678901234567890.5"), expect: `12345678901234567890.5`},
+		{typ: "UInt256", input: new(big.Int).Lsh(big.NewInt(1), 100), expect: `1267650600228229401496703205376`},
+		{typ: "IPv6", input: net.ParseIP("::1"), expect: `"::1"`},
+		{typ: "Map(UInt8, Array(DateTime))", input: map[uint8][]time.Time{1: {time.Unix(1, 0)}}, expect: `{"1":[1]}`},
+		{typ: "Tuple(a String, b Nullable(UInt8))", input: []interface{}{"x", (*uint8)(nil)}, expect: `["x",null]`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.typ, func(t *testing.T) {
+			typ, err := parseType(test.typ)
+			assert.Nil(t, err)
+			v, err := jsonValue(typ, test.input)
+			assert.Nil(t, err)
+			bs, err := json.Marshal(v)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, string(bs))
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package ch
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go2ch/go2ch/dlq"
+	"go2ch/go2ch/pipeline"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// policies of schema evolution, about the keys of messages which are not columns of table
+const (
+	SchemaEvolutionIgnore = "ignore" // the keys are left out
+	SchemaEvolutionAdd    = "add"    // the keys are added to table as new columns
+	SchemaEvolutionMap    = "map"    // the keys are put into the Map(String, String) fallback column
+)
+
+// schema is the columns of table, it is replaced as a whole when the table is altered,
+// so that the rows of a batch are always converted and inserted with the same columns
+type schema struct {
+	table       string
+	columns     []*rowDesc          // the columns which can be inserted, in the order of table
+	names       map[string]struct{} // names of all columns, including MATERIALIZED and ALIAS ones
+	insertQuery string
+	skipped     sync.Map // keys failing to be added as columns, they are not tried again until the table changes
+}
+
+// schemaMismatchCodes are the codes of clickhouse exceptions telling the columns of table are not the ones inserted with
+var schemaMismatchCodes = map[int32]bool{
+	8:  true, // THERE_IS_NO_COLUMN
+	10: true, // NOT_FOUND_COLUMN_IN_BLOCK
+	16: true, // NO_SUCH_COLUMN_IN_TABLE
+	47: true, // UNKNOWN_IDENTIFIER
+}
+
+// newSchema creates a schema of table from the descriptions of all its columns
+func newSchema(table string, descs []*rowDesc) *schema {
+	s := &schema{
+		table:   table,
+		columns: make([]*rowDesc, 0, len(descs)),
+		names:   make(map[string]struct{}, len(descs)),
+	}
+	for _, desc := range descs {
+		s.names[desc.Name] = struct{}{}
+		if desc.insertable() {
+			s.columns = append(s.columns, desc)
+		}
+	}
+	s.insertQuery = buildInsertQuery(table, s.columns)
+	return s
+}
+
+// has reports whether there is a column named name
+func (s *schema) has(name string) bool {
+	_, ok := s.names[name]
+	return ok
+}
+
+// column returns the insertable column named name
+func (s *schema) column(name string) *rowDesc {
+	for _, column := range s.columns {
+		if column.Name == name {
+			return column
+		}
+	}
+	return nil
+}
+
+// equal reports whether s and o have the same columns
+func (s *schema) equal(o *schema) bool {
+	if len(s.names) != len(o.names) || len(s.columns) != len(o.columns) {
+		return false
+	}
+	for i, column := range s.columns {
+		other := o.columns[i]
+		if column.Name != other.Name || column.Type != other.Type ||
+			column.DefaultType != other.DefaultType || column.DefaultExpression != other.DefaultExpression {
+			return false
+		}
+	}
+	for name := range s.names {
+		if !o.has(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// getSchema returns the current schema of table
+func (w *Writer) getSchema() *schema {
+	return w.schema.Load().(*schema)
+}
+
+// refreshSchema reads the columns of table and replaces the current schema.
+// The current schema is kept if the columns are not changed, along with the keys skipped by addColumns.
+func (w *Writer) refreshSchema() (*schema, error) {
+	descs, err := w.getColumns()
+	if err != nil {
+		return nil, fmt.Errorf("refreshSchema | get table columns failed: %v", err)
+	}
+	s := newSchema(w.insertTable(), descs)
+	if old, ok := w.schema.Load().(*schema); ok && s.equal(old) {
+		return old, nil
+	}
+	w.schema.Store(s)
+	return s, nil
+}
+
+// refreshPeriodically refreshes the schema every interval until the writer is closed.
+// The rows being inserted keep the schema they are converted with, and the new one takes effect from the next chunk.
+func (w *Writer) refreshPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			old := w.getSchema()
+			s, err := w.refreshSchema()
+			if err != nil {
+				logx.Errorf("refreshPeriodically | %v", err)
+				continue
+			}
+			if !s.equal(old) {
+				logx.Infof("refreshPeriodically | columns of table[%s] changed: %s", w.tableName, s.insertQuery)
+			}
+		case <-w.closing.Done():
+			return
+		}
+	}
+}
+
+// isSchemaMismatch reports whether err tells the columns of table are not the ones inserted with
+func isSchemaMismatch(err error) bool {
+	var exception *clickhouse.Exception
+	return errors.As(err, &exception) && schemaMismatchCodes[exception.Code]
+}
+
+// reconvert converts the rows which are not converted with the columns of s again, the rows which can not be converted are rejected
+func (w *Writer) reconvert(s *schema, rows []*pendingRow) []*pendingRow {
+	converted := make([]*pendingRow, 0, len(rows))
+	for _, row := range rows {
+		if row.schema != s {
+			p, err := w.convert(s, row.Row)
+			if err != nil {
+				w.reject([]*pipeline.Row{row.Row}, dlq.StageConvert, fmt.Errorf("reconvert | %v", err))
+				continue
+			}
+			row.schema, row.values = s, p.values
+		}
+		converted = append(converted, row)
+	}
+	return converted
+}
+
+// checkFallbackColumn checks the fallback column of schema evolution is a Map with String keys
+func (w *Writer) checkFallbackColumn() error {
+	if w.schemaEvolution != SchemaEvolutionMap {
+		return nil
+	}
+	column := w.getSchema().column(w.fallbackColumn)
+	if column == nil {
+		return fmt.Errorf("checkFallbackColumn | fallback column[%s] is not in table[%s]", w.fallbackColumn, w.tableName)
+	}
+	if column.chType.name != "Map" {
+		return fmt.Errorf("checkFallbackColumn | fallback column[%s] must be Map(String, String), but got %s", w.fallbackColumn, column.Type)
+	}
+	if typ, err := column.chType.elems[0].goType(); err != nil || typ != typeString {
+		return fmt.Errorf("checkFallbackColumn | fallback column[%s] must be Map(String, String), but got %s", w.fallbackColumn, column.Type)
+	}
+	return nil
+}
+
+// unknownKey reports whether key of a message is not a column of s
+func unknownKey(s *schema, key string) bool {
+	return !s.has(key)
+}
+
+// addColumns adds the unknown keys of messages to table as new columns, and returns the schema with them.
+// The keys which can not be added are left out, and they are skipped with s from now on.
+func (w *Writer) addColumns(s *schema, ms []map[string]interface{}) *schema {
+	types := make(map[string]string)
+	for _, m := range ms {
+		for key, v := range m {
+			if _, ok := types[key]; ok || !unknownKey(s, key) {
+				continue
+			}
+			if _, ok := s.skipped.Load(key); ok {
+				continue
+			}
+			if typ, ok := inferType(v); ok {
+				types[key] = typ
+			}
+		}
+	}
+	if len(types) == 0 {
+		return s
+	}
+
+	// columns are added in name order, so that they are in the same order wherever they are added
+	keys := make([]string, 0, len(types))
+	for key := range types {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tables := []string{w.tableName}
+	if strings.TrimSpace(w.distributedTableName) != "" {
+		tables = append(tables, w.distributedTableName)
+	}
+	var added int
+	for _, key := range keys {
+		if err := w.addColumn(tables, key, types[key]); err != nil {
+			logx.Errorf("addColumns | %v, the key is left out", err)
+			s.skipped.Store(key, struct{}{})
+			continue
+		}
+		added++
+	}
+	if added == 0 {
+		return s
+	}
+
+	refreshed, err := w.refreshSchema()
+	if err != nil {
+		logx.Errorf("addColumns | %v", err)
+		return s
+	}
+	return refreshed
+}
+
+// addColumn adds the column named key in typ to tables
+func (w *Writer) addColumn(tables []string, key, typ string) error {
+	for _, conn := range w.alterConns() {
+		for _, table := range tables {
+			err := conn.Exec(w.ctx, buildAddColumnQuery(table, w.cluster, key, typ))
+			if err != nil {
+				return fmt.Errorf("addColumn | add column[%s %s] to table[%s] failed: %v", key, typ, table, err)
+			}
+			logx.Infof("addColumn | add column[%s %s] to table[%s]", key, typ, table)
+		}
+	}
+	return nil
+}
+
+// alterConns returns the connections which tables are altered on. Every node is altered from one of them ON CLUSTER,
+// otherwise the table of each shard is altered on its own, so that rows routed to any shard find the columns
+func (w *Writer) alterConns() []driver.Conn {
+	if w.cluster != "" || len(w.shards) == 0 {
+		return []driver.Conn{w.conn}
+	}
+	conns := make([]driver.Conn, 0, len(w.shards))
+	for _, sh := range w.shards {
+		conns = append(conns, sh.conn)
+	}
+	return conns
+}
+
+// buildAddColumnQuery builds the ALTER statement adding a column, ON CLUSTER cluster if it is not empty
+func buildAddColumnQuery(table, cluster, name, typ string) string {
+	var onCluster string
+	if cluster != "" {
+		onCluster = " ON CLUSTER " + cluster
+	}
+	return fmt.Sprintf("ALTER TABLE %s%s ADD COLUMN IF NOT EXISTS %s %s", table, onCluster, quoteName(name), typ)
+}
+
+// inferType infers the clickhouse type of a json value, it is false for null which tells nothing.
+// Integral numbers are Int64, or UInt64 above it, so that ids keep their precision, the other numbers are Float64,
+// and objects are kept in String as json.
+func inferType(v interface{}) (string, bool) {
+	switch value := v.(type) {
+	case bool:
+		return "Bool", true
+	case string, map[string]interface{}:
+		return "String", true
+	case time.Time:
+		return "DateTime64(9)", true
+	case []interface{}:
+		for _, item := range value {
+			if typ, ok := inferType(item); ok {
+				return "Array(" + typ + ")", true
+			}
+		}
+		return "Array(String)", true
+	}
+	if _, ok := toInt64(v); ok {
+		return "Int64", true
+	}
+	if _, ok := toUint64(v); ok {
+		return "UInt64", true
+	}
+	if _, ok := toFloat64(v); ok {
+		return "Float64", true
+	}
+	return "", false
+}
+
+// fallbackValue encodes v in the string kept in the fallback column, which takes the values of any json types,
+// even in strict coercion where the String column takes strings only
+func fallbackValue(v interface{}) interface{} {
+	if s, err := convertString(false, v); err == nil {
+		return s
+	}
+	return v
+}
+
+// withFallback puts the unknown keys of m into the fallback column, along with the value of the column in m
+func (w *Writer) withFallback(s *schema, m map[string]interface{}) map[string]interface{} {
+	var extra map[string]interface{}
+	for key, v := range m {
+		if !unknownKey(s, key) {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]interface{})
+			if origin, ok := m[w.fallbackColumn].(map[string]interface{}); ok {
+				for k, v := range origin {
+					extra[k] = fallbackValue(v)
+				}
+			}
+		}
+		extra[key] = fallbackValue(v)
+	}
+	if extra == nil {
+		return m
+	}
+
+	merged := make(map[string]interface{}, len(m))
+	for key, v := range m {
+		merged[key] = v
+	}
+	merged[w.fallbackColumn] = extra
+	return merged
+}
@@ -0,0 +1,237 @@
+package ch
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+
+	"go2ch/go2ch/pipeline"
+)
+
+// schemaConn is a clickhouse connection with a table in memory, which can be described and altered
+type schemaConn struct {
+	fakeConn
+	columns []*rowDesc
+	execs   []string
+	fail    bool
+	failed  int // queries failed because of fail
+}
+
+func (c *schemaConn) Exec(ctx context.Context, query string, args ...interface{}) error {
+	if c.fail {
+		c.failed++
+		return errors.New("not allowed")
+	}
+	c.execs = append(c.execs, query)
+	const add = "ADD COLUMN IF NOT EXISTS "
+	if i := strings.Index(query, add); i >= 0 && strings.HasPrefix(query, "ALTER TABLE t ") {
+		def := query[i+len(add):]
+		end := strings.LastIndexByte(def, '`')
+		c.columns = append(c.columns, &rowDesc{Name: def[1:end], Type: def[end+2:]})
+	}
+	return nil
+}
+
+// PrepareBatch fails if the batch is not inserted with the current columns
+func (c *schemaConn) PrepareBatch(ctx context.Context, query string) (driver.Batch, error) {
+	if query != newSchema("t", c.columns).insertQuery {
+		return nil, &clickhouse.Exception{Code: 16, Name: "DB::Exception", Message: "no such column in table"}
+	}
+	return c.fakeConn.PrepareBatch(ctx, query)
+}
+
+func (c *schemaConn) Query(ctx context.Context, query string, args ...interface{}) (driver.Rows, error) {
+	return &descRows{columns: c.columns, index: -1}, nil
+}
+
+// descRows are the rows of system.columns
+type descRows struct {
+	driver.Rows
+	columns []*rowDesc
+	index   int
+}
+
+func (r *descRows) Next() bool {
+	r.index++
+	return r.index < len(r.columns)
+}
+
+func (r *descRows) Scan(dest ...interface{}) error {
+	column := r.columns[r.index]
+	values := []string{column.Name, column.Type, column.DefaultType, column.DefaultExpression, "", ""}
+	for i, d := range dest {
+		*d.(*string) = values[i]
+	}
+	return nil
+}
+
+func TestInferType(t *testing.T) {
+	tests := []struct {
+		input  interface{}
+		expect string
+	}{
+		{input: "a", expect: "String"},
+		{input: float64(1), expect: "Int64"},
+		{input: 1.5, expect: "Float64"},
+		{input: int64(1 << 62), expect: "Int64"},
+		{input: uint64(1 << 63), expect: "UInt64"},
+		{input: true, expect: "Bool"},
+		{input: map[string]interface{}{"a": "b"}, expect: "String"},
+		{input: []interface{}{nil, float64(1)}, expect: "Array(Int64)"},
+		{input: []interface{}{nil, 1.5}, expect: "Array(Float64)"},
+		{input: []interface{}{[]interface{}{"a"}}, expect: "Array(Array(String))"},
+		{input: []interface{}{}, expect: "Array(String)"},
+		{input: nil, expect: ""},
+	}
+
+	for _, test := range tests {
+		actual, ok := inferType(test.input)
+		assert.Equal(t, test.expect, actual)
+		assert.Equal(t, test.expect != "", ok)
+	}
+}
+
+func TestAddColumns(t *testing.T) {
+	conn := &schemaConn{columns: []*rowDesc{{Name: "id", Type: "UInt32"}, {Name: "m", Type: "String", DefaultType: "MATERIALIZED"}}}
+	w := &Writer{
+		ctx:                  context.Background(),
+		conn:                 conn,
+		tableName:            "t",
+		distributedTableName: "t_all",
+		cluster:              "c",
+	}
+	s, err := w.refreshSchema()
+	assert.Nil(t, err)
+
+	ms := []map[string]interface{}{
+		{"id": float64(1), "m": "x", "b": "x", "n": nil},
+		{"id": float64(2), "a": []interface{}{float64(1)}, "n": nil},
+	}
+	s = w.addColumns(s, ms)
+	assert.Equal(t, []string{
+		"ALTER TABLE t ON CLUSTER c ADD COLUMN IF NOT EXISTS `a` Array(Int64)",
+		"ALTER TABLE t_all ON CLUSTER c ADD COLUMN IF NOT EXISTS `a` Array(Int64)",
+		"ALTER TABLE t ON CLUSTER c ADD COLUMN IF NOT EXISTS `b` String",
+		"ALTER TABLE t_all ON CLUSTER c ADD COLUMN IF NOT EXISTS `b` String",
+	}, conn.execs)
+	assert.Equal(t, s, w.getSchema())
+	assert.Equal(t, "INSERT INTO t (`id`, `a`, `b`)", s.insertQuery)
+
+	stru, err := w.getDataStruct(s, ms[1])
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{uint32(2), []int64{1}, ""}, stru)
+
+	// nothing is added for the known keys
+	conn.execs = nil
+	assert.Equal(t, s, w.addColumns(s, ms))
+	assert.Empty(t, conn.execs)
+
+	// the keys are left out if the table can not be altered, and they are not tried again with the same schema
+	conn.fail = true
+	assert.Equal(t, s, w.addColumns(s, []map[string]interface{}{{"c": "x"}}))
+	assert.Equal(t, s, w.addColumns(s, []map[string]interface{}{{"c": "x"}}))
+	assert.Equal(t, 1, conn.failed)
+
+	// the schema is kept if the table is not changed, so are the skipped keys
+	conn.fail = false
+	refreshed, err := w.refreshSchema()
+	assert.Nil(t, err)
+	assert.True(t, refreshed == s)
+	assert.Equal(t, s, w.addColumns(s, []map[string]interface{}{{"c": "x"}}))
+	assert.Empty(t, conn.execs)
+}
+
+func TestAddColumnsOnShards(t *testing.T) {
+	conn := &schemaConn{columns: []*rowDesc{{Name: "id", Type: "UInt32"}}}
+	shards := []*schemaConn{{}, {}}
+	w := &Writer{
+		ctx:       context.Background(),
+		conn:      conn,
+		tableName: "t",
+		shards:    []*shard{{addr: "a", conn: shards[0]}, {addr: "b", conn: shards[1]}},
+	}
+	s, err := w.refreshSchema()
+	assert.Nil(t, err)
+
+	// without cluster, the table of every shard is altered
+	w.addColumns(s, []map[string]interface{}{{"id": float64(1), "b": "x"}})
+	for _, sh := range shards {
+		assert.Equal(t, []string{"ALTER TABLE t ADD COLUMN IF NOT EXISTS `b` String"}, sh.execs)
+	}
+	assert.Empty(t, conn.execs)
+}
+
+func TestWithFallback(t *testing.T) {
+	conn := &schemaConn{columns: []*rowDesc{{Name: "id", Type: "UInt32"}, {Name: "extra", Type: "Map(String, String)"}}}
+	w := &Writer{
+		ctx:             context.Background(),
+		conn:            conn,
+		tableName:       "t",
+		schemaEvolution: SchemaEvolutionMap,
+		fallbackColumn:  "extra",
+		coercion:        CoercionStrict,
+	}
+	s, err := w.refreshSchema()
+	assert.Nil(t, err)
+	assert.Nil(t, w.checkFallbackColumn())
+
+	// the values in any json types are encoded in the fallback column, even in strict coercion
+	stru, err := w.getDataStruct(s, map[string]interface{}{
+		"id":    float64(1),
+		"extra": map[string]interface{}{"a": "x"},
+		"b":     float64(2),
+		"c":     map[string]interface{}{"d": true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{uint32(1), map[string]string{"a": "x", "b": "2", "c": `{"d":true}`}}, stru)
+
+	w.fallbackColumn = "id"
+	assert.NotNil(t, w.checkFallbackColumn())
+	w.fallbackColumn = "missing"
+	assert.NotNil(t, w.checkFallbackColumn())
+}
+
+func TestInsertSchemaMismatch(t *testing.T) {
+	conn := &schemaConn{columns: []*rowDesc{{Name: "id", Type: "UInt32"}, {Name: "a", Type: "String"}}}
+	deadLetter := &memDeadLetter{}
+	w := &Writer{ctx: context.Background(), conn: conn, tableName: "t", deadLetter: deadLetter}
+	s, err := w.refreshSchema()
+	assert.Nil(t, err)
+
+	rows := make([]*pendingRow, 0)
+	for _, m := range []map[string]interface{}{{"id": float64(1), "a": "x", "b": "y"}, {"id": float64(2), "b": "z"}} {
+		row, err := w.convert(s, &pipeline.Row{Fields: m})
+		assert.Nil(t, err)
+		rows = append(rows, row)
+	}
+
+	// the table is altered after the rows are converted
+	conn.columns = []*rowDesc{{Name: "id", Type: "UInt32"}, {Name: "b", Type: "String"}}
+	assert.Equal(t, 2, w.insert(s, &shard{conn: conn}, rows))
+	assert.Equal(t, [][]interface{}{{uint32(1), "y"}, {uint32(2), "z"}}, conn.sent)
+	assert.Empty(t, deadLetter.records)
+	assert.True(t, w.getSchema().has("b"))
+}
+
+func TestRefreshPeriodicallyStopsOnClose(t *testing.T) {
+	closing, cancel := context.WithCancel(context.Background())
+	w := &Writer{ctx: context.Background(), closing: closing, cancel: cancel, conn: &schemaConn{}, tableName: "t"}
+
+	done := make(chan struct{})
+	go func() {
+		w.refreshPeriodically(time.Millisecond)
+		close(done)
+	}()
+	w.cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refreshPeriodically is still running after the writer is closed")
+	}
+}
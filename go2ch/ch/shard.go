@@ -0,0 +1,121 @@
+package ch
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/zeromicro/go-zero/core/hash"
+	"github.com/zeromicro/go-zero/core/threading"
+)
+
+// routing modes, about where rows are inserted
+const (
+	RoutingLocal       = "local"       // into TableName on any node of Addrs
+	RoutingDistributed = "distributed" // into DistributedTableName, which routes rows to shards by its sharding key
+	RoutingShard       = "shard"       // into TableName on the shard chosen by hashing ShardingKey, each of Addrs is a shard
+)
+
+// shardingHashes are the hash functions to choose shards by sharding key
+var shardingHashes = map[string]func(data []byte) uint64{
+	"murmur3": hash.Hash,
+	"fnv": func(data []byte) uint64 {
+		h := fnv.New64a()
+		h.Write(data)
+		return h.Sum64()
+	},
+	"crc32": func(data []byte) uint64 {
+		return uint64(crc32.ChecksumIEEE(data))
+	},
+}
+
+// shard is where a batch of rows is inserted
+type shard struct {
+	addr string // empty if rows are not routed to shards by go2ch
+	conn driver.Conn
+}
+
+// String returns the address of shard
+func (s *shard) String() string {
+	if s.addr == "" {
+		return "any"
+	}
+	return s.addr
+}
+
+// shardOf returns the index of shard which the row m is inserted into
+func (w *Writer) shardOf(m map[string]interface{}) int {
+	if len(w.shards) <= 1 {
+		return 0
+	}
+	return int(w.shardingHash(shardingKey(m[w.shardingKey])) % uint64(len(w.shards)))
+}
+
+// shardingKey returns the bytes of sharding key value v to be hashed
+func shardingKey(v interface{}) []byte {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []byte(value)
+	case bool:
+		return []byte(strconv.FormatBool(value))
+	}
+	if f, ok := toFloat64(v); ok {
+		return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	bs, _ := json.Marshal(v)
+	return bs
+}
+
+// insertShards inserts rows into their shards, a batch for each shard.
+// The shards are inserted concurrently, so that a shard which can not be reached does not hold up the others.
+func (w *Writer) insertShards(s *schema, rows []*pendingRow) int {
+	if len(w.shards) == 1 {
+		return w.insert(s, w.shards[0], rows)
+	}
+
+	batches := make([][]*pendingRow, len(w.shards))
+	for _, row := range rows {
+		batches[row.shard] = append(batches[row.shard], row)
+	}
+
+	var accepted int64
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		sh, batch := w.shards[i], batch
+		wg.Add(1)
+		threading.GoSafe(func() {
+			defer wg.Done()
+			atomic.AddInt64(&accepted, int64(w.insert(s, sh, batch)))
+		})
+	}
+	wg.Wait()
+	return int(accepted)
+}
+
+// checkRouting checks the configuration of routing mode
+func checkRouting(routing, distributedTable, shardingKey, shardingHash string) error {
+	switch routing {
+	case RoutingDistributed:
+		if distributedTable == "" {
+			return fmt.Errorf("checkRouting | DistributedTableName is required in %s routing", routing)
+		}
+	case RoutingShard:
+		if shardingKey == "" {
+			return fmt.Errorf("checkRouting | ShardingKey is required in %s routing", routing)
+		}
+		if _, ok := shardingHashes[shardingHash]; !ok {
+			return fmt.Errorf("checkRouting | unknown sharding hash [%s]", shardingHash)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package ch
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go2ch/go2ch/dlq"
+)
+
+func TestShardOf(t *testing.T) {
+	w := &Writer{shards: make([]*shard, 3), shardingKey: "k", shardingHash: shardingHashes["murmur3"]}
+
+	counts := make([]int, 3)
+	for i := 0; i < 300; i++ {
+		m := map[string]interface{}{"k": fmt.Sprintf("key-%d", i)}
+		index := w.shardOf(m)
+		// the same key is always in the same shard
+		assert.Equal(t, index, w.shardOf(map[string]interface{}{"k": fmt.Sprintf("key-%d", i), "other": i}))
+		counts[index]++
+	}
+	for _, count := range counts {
+		assert.True(t, count > 50, "rows are not spread over shards: %v", counts)
+	}
+
+	// numbers are hashed in the same way whatever type they are decoded in
+	assert.Equal(t, w.shardOf(map[string]interface{}{"k": float64(42)}), w.shardOf(map[string]interface{}{"k": 42}))
+	// there is only one shard if rows are not routed by go2ch
+	assert.Equal(t, 0, (&Writer{shards: make([]*shard, 1)}).shardOf(map[string]interface{}{"k": "a"}))
+}
+
+func TestInsertShards(t *testing.T) {
+	conns := []*fakeConn{{}, {unreachable: 100}, {}}
+	deadLetter := &memDeadLetter{}
+	w := &Writer{
+		ctx:        context.Background(),
+		closing:    context.Background(),
+		deadLetter: deadLetter,
+		backoff:    backoff{maxRetries: 1, interval: time.Millisecond, maxInterval: time.Millisecond},
+	}
+	for i, conn := range conns {
+		w.shards = append(w.shards, &shard{addr: fmt.Sprintf("shard-%d", i), conn: conn})
+	}
+
+	rows := newPendingRows("a", "b", "c", "d", "e")
+	for i, row := range rows {
+		row.shard = i % len(conns)
+	}
+
+	// the rows of the unreachable shard are rejected without affecting the other shards
+	assert.Equal(t, 3, w.insertShards(newTestSchema(t, "v", "String"), rows))
+	assert.Equal(t, [][]interface{}{{"a"}, {"d"}}, conns[0].sent)
+	assert.Empty(t, conns[1].sent)
+	assert.Equal(t, [][]interface{}{{"c"}}, conns[2].sent)
+	assert.Len(t, deadLetter.records, 2)
+	for _, record := range deadLetter.records {
+		assert.Equal(t, dlq.StagePrepare, record.Stage)
+	}
+}
+
+func TestCheckRouting(t *testing.T) {
+	assert.Nil(t, checkRouting(RoutingLocal, "", "", ""))
+	assert.Nil(t, checkRouting(RoutingDistributed, "t_all", "", ""))
+	assert.NotNil(t, checkRouting(RoutingDistributed, "", "", ""))
+	assert.Nil(t, checkRouting(RoutingShard, "", "id", "fnv"))
+	assert.NotNil(t, checkRouting(RoutingShard, "", "", "fnv"))
+	assert.NotNil(t, checkRouting(RoutingShard, "", "id", "md5"))
+}
@@ -0,0 +1,79 @@
+package ch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status is the state of a writer shown on status page
+type Status struct {
+	Table         string     `json:"table"`
+	PendingBytes  int64      `json:"pending_bytes"`             // bytes of converted rows waiting in the batch
+	LastFlushTime *time.Time `json:"last_flush_time,omitempty"` // when rows were inserted into clickhouse last time
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// writerState keeps what happened to a writer
+type writerState struct {
+	pendingBytes  int64 // accessed atomically
+	lock          sync.Mutex
+	lastFlushTime time.Time
+	lastError     error
+	lastErrorTime time.Time
+}
+
+// flushed records rows are inserted
+func (s *writerState) flushed() {
+	s.lock.Lock()
+	s.lastFlushTime = time.Now()
+	s.lock.Unlock()
+}
+
+// failed records err happened
+func (s *writerState) failed(err error) {
+	s.lock.Lock()
+	s.lastError = err
+	s.lastErrorTime = time.Now()
+	s.lock.Unlock()
+}
+
+// Status returns the state of writer
+func (w *Writer) Status() Status {
+	status := Status{
+		Table:        w.insertTable(),
+		PendingBytes: atomic.LoadInt64(&w.state.pendingBytes),
+	}
+
+	w.state.lock.Lock()
+	defer w.state.lock.Unlock()
+	if !w.state.lastFlushTime.IsZero() {
+		t := w.state.lastFlushTime
+		status.LastFlushTime = &t
+	}
+	if w.state.lastError != nil {
+		t := w.state.lastErrorTime
+		status.LastError = w.state.lastError.Error()
+		status.LastErrorTime = &t
+	}
+	return status
+}
+
+// Ping checks every connection of writer can reach clickhouse
+func (w *Writer) Ping(ctx context.Context) error {
+	if err := w.conn.Ping(ctx); err != nil {
+		return fmt.Errorf("ping | ping clickhouse failed: %v", err)
+	}
+	for _, sh := range w.shards {
+		if sh.conn == w.conn {
+			continue
+		}
+		if err := sh.conn.Ping(ctx); err != nil {
+			return fmt.Errorf("ping | ping clickhouse shard[%s] failed: %v", sh, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package ch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// chType is a parsed clickhouse column type, nested types like Array(Nullable(LowCardinality(String)))
+// are parsed recursively into elems.
+type chType struct {
+	raw    string           // the type as it is in DESC TABLE
+	name   string           // name without parameters, e.g. Array, Decimal, DateTime64
+	params []string         // literal parameters, e.g. precision and scale of Decimal, length of FixedString, timezone
+	elems  []*chType        // nested types of Nullable, LowCardinality, Array, Map, Tuple and SimpleAggregateFunction
+	fields []string         // element names of a named Tuple
+	enum   map[int64]string // values to names of Enum8 and Enum16
+}
+
+// parseType parses a clickhouse column type
+func parseType(s string) (*chType, error) {
+	s = strings.TrimSpace(s)
+	open := strings.IndexByte(s, '(')
+	if open < 0 {
+		if !isIdentifier(s) {
+			return nil, fmt.Errorf("parseType | invalid type [%s]", s)
+		}
+		return &chType{raw: s, name: s}, nil
+	}
+	if !strings.HasSuffix(s, ")") {
+		return nil, fmt.Errorf("parseType | unbalanced parentheses in type [%s]", s)
+	}
+
+	t := &chType{raw: s, name: strings.TrimSpace(s[:open])}
+	if !isIdentifier(t.name) {
+		return nil, fmt.Errorf("parseType | invalid type [%s]", s)
+	}
+	args, err := splitArgs(s[open+1 : len(s)-1])
+	if err != nil {
+		return nil, fmt.Errorf("parseType | parse type [%s] failed: %v", s, err)
+	}
+
+	switch t.name {
+	case "Nullable", "LowCardinality", "Array":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("parseType | %s requires 1 nested type, but got [%s]", t.name, s)
+		}
+		err = t.parseElems(args)
+	case "Map":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("parseType | Map requires key and value types, but got [%s]", s)
+		}
+		err = t.parseElems(args)
+	case "Tuple", "Nested":
+		for _, arg := range args {
+			name, typ := splitTupleElement(arg)
+			elem, e := parseType(typ)
+			if e != nil {
+				return nil, e
+			}
+			t.elems = append(t.elems, elem)
+			t.fields = append(t.fields, name)
+		}
+	case "SimpleAggregateFunction":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("parseType | SimpleAggregateFunction requires function and type, but got [%s]", s)
+		}
+		t.params = args[:1]
+		err = t.parseElems(args[1:])
+	case "Enum8", "Enum16", "Enum":
+		t.params = args
+		t.enum, err = parseEnum(args)
+	default:
+		t.params = args
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseElems parses args as nested types
+func (t *chType) parseElems(args []string) error {
+	for _, arg := range args {
+		elem, err := parseType(arg)
+		if err != nil {
+			return err
+		}
+		t.elems = append(t.elems, elem)
+	}
+	return nil
+}
+
+// String returns the type as it is in DESC TABLE
+func (t *chType) String() string {
+	return t.raw
+}
+
+// nullable reports whether t can be NULL
+func (t *chType) nullable() bool {
+	if t.name == "LowCardinality" {
+		return t.elems[0].nullable()
+	}
+	return t.name == "Nullable"
+}
+
+// param returns the ith literal parameter without quotes, or def if there is not
+func (t *chType) param(i int, def string) string {
+	if i >= len(t.params) {
+		return def
+	}
+	return unquote(t.params[i])
+}
+
+// intParam returns the ith literal parameter as an integer, or def if there is not
+func (t *chType) intParam(i int, def int) (int, error) {
+	if i >= len(t.params) {
+		return def, nil
+	}
+	n, err := strconv.Atoi(t.params[i])
+	if err != nil {
+		return 0, fmt.Errorf("intParam | parameter %d of type [%s] is not an integer", i, t.raw)
+	}
+	return n, nil
+}
+
+// splitArgs splits the arguments of a type by the commas which are not nested in parentheses or quotes
+func splitArgs(s string) ([]string, error) {
+	args := make([]string, 0)
+	var depth, start int
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '`' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("splitArgs | unbalanced parentheses")
+			}
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if depth != 0 || quote != 0 {
+		return nil, fmt.Errorf("splitArgs | unbalanced parentheses or quotes")
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" || len(args) > 0 {
+		args = append(args, last)
+	}
+	return args, nil
+}
+
+// splitTupleElement splits an element of Tuple into name and type, name is empty if the element is not named
+func splitTupleElement(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "`") {
+		if end := strings.IndexByte(s[1:], '`'); end >= 0 {
+			return s[1 : end+1], strings.TrimSpace(s[end+2:])
+		}
+	}
+	space := strings.IndexAny(s, " \t")
+	if space < 0 || strings.ContainsAny(s[:space], "('") {
+		return "", s
+	}
+	return s[:space], strings.TrimSpace(s[space+1:])
+}
+
+// parseEnum parses the items of enum like 'a' = 1, 'b' = 2
+func parseEnum(args []string) (map[int64]string, error) {
+	enum := make(map[int64]string, len(args))
+	for _, arg := range args {
+		eq := strings.LastIndexByte(arg, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("parseEnum | invalid enum item [%s]", arg)
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(arg[eq+1:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parseEnum | invalid enum value [%s]", arg)
+		}
+		enum[value] = unquote(strings.TrimSpace(arg[:eq]))
+	}
+	return enum, nil
+}
+
+// unquote removes the single quotes around s and unescapes it
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '\'' || s[len(s)-1] != '\'' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if !strings.ContainsRune(s, '\\') {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// isIdentifier reports whether s is a valid name of type
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,303 @@
+package ch
+
+import (
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// convertValue converts v to the go type of t, with the converter compiled for each call
+func (w *Writer) convertValue(t *chType, v interface{}) (interface{}, error) {
+	convert, err := w.compile(t)
+	if err != nil {
+		return nil, err
+	}
+	return convert(v)
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect string // the parsed type in a compact form, see describe
+		err    bool
+	}{
+		{
+			name:   "primitive",
+			input:  "UInt32",
+			expect: "UInt32",
+		},
+		{
+			name:   "nested wrappers",
+			input:  "Array(Nullable(LowCardinality(String)))",
+			expect: "Array<Nullable<LowCardinality<String>>>",
+		},
+		{
+			name:   "decimal",
+			input:  "Decimal(18, 4)",
+			expect: "Decimal[18,4]",
+		},
+		{
+			name:   "datetime64 with timezone",
+			input:  "DateTime64(3, 'Asia/Shanghai')",
+			expect: "DateTime64[3,Asia/Shanghai]",
+		},
+		{
+			name:   "map",
+			input:  "Map(String, Array(UInt8))",
+			expect: "Map<String,Array<UInt8>>",
+		},
+		{
+			name:   "named tuple",
+			input:  "Tuple(a String, `b c` Nullable(Int64), Decimal(9, 2))",
+			expect: "Tuple<a:String,b c:Nullable<Int64>,Decimal[9,2]>",
+		},
+		{
+			name:   "enum with commas and parentheses in names",
+			input:  "Enum8('a, (b)' = 1, 'c\\'d' = -2)",
+			expect: "Enum8[a, (b)=1,c'd=-2]",
+		},
+		{
+			name:   "simple aggregate function",
+			input:  "SimpleAggregateFunction(sum, UInt64)",
+			expect: "SimpleAggregateFunction[sum]<UInt64>",
+		},
+		{
+			name:  "unbalanced",
+			input: "Array(String",
+			err:   true,
+		},
+		{
+			name:  "missing nested type",
+			input: "Nullable()",
+			err:   true,
+		},
+		{
+			name:  "map without value type",
+			input: "Map(String)",
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := parseType(test.input)
+			if test.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, describe(actual))
+		})
+	}
+}
+
+// describe prints t in a compact form which shows how it is parsed
+func describe(t *chType) string {
+	s := t.name
+	if len(t.params) > 0 && t.enum == nil {
+		s += "["
+		for i := range t.params {
+			if i > 0 {
+				s += ","
+			}
+			s += t.param(i, "")
+		}
+		s += "]"
+	}
+	if t.enum != nil {
+		s += "["
+		for i, param := range t.params {
+			if i > 0 {
+				s += ","
+			}
+			items, _ := parseEnum([]string{param})
+			for value, name := range items {
+				s += name + "=" + big.NewInt(value).String()
+			}
+		}
+		s += "]"
+	}
+	if len(t.elems) > 0 {
+		s += "<"
+		for i, elem := range t.elems {
+			if i > 0 {
+				s += ","
+			}
+			if t.fields != nil && t.fields[i] != "" {
+				s += t.fields[i] + ":"
+			}
+			s += describe(elem)
+		}
+		s += ">"
+	}
+	return s
+}
+
+func TestConvertValue(t *testing.T) {
+	str := func(s string) *string { return &s }
+	i64 := func(i int64) *int64 { return &i }
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name   string
+		typ    string
+		strict bool
+		input  interface{}
+		expect interface{}
+		err    bool
+	}{
+		{name: "int", typ: "Int32", input: float64(-12), expect: int32(-12)},
+		{name: "int overflow", typ: "UInt8", input: float64(300), err: true},
+		{name: "negative uint", typ: "UInt32", input: float64(-1), err: true},
+		{name: "int with fraction", typ: "Int64", input: 3.7, err: true},
+		{name: "uint64 above int64", typ: "UInt64", input: uint64(1 << 63), expect: uint64(1 << 63)},
+		{name: "int64 from uint64 above int64", typ: "Int64", input: uint64(1 << 63), err: true},
+		{name: "float32 overflow", typ: "Float32", input: 1e39, err: true},
+		{name: "uint from int", typ: "UInt64", input: 7, expect: uint64(7)},
+		{name: "float", typ: "Float32", input: 1.5, expect: float32(1.5)},
+		{name: "int from string", typ: "Int8", input: "1", expect: int8(1)},
+		{name: "uint64 from string", typ: "UInt64", input: "18446744073709551615", expect: uint64(18446744073709551615)},
+		{name: "int from bad string", typ: "Int8", input: "a", err: true},
+		{name: "bool from string", typ: "Bool", input: "true", expect: true},
+		{name: "string", typ: "String", input: "a", expect: "a"},
+		{name: "string from object", typ: "String", input: map[string]interface{}{"a": float64(1)}, expect: `{"a":1}`},
+		{
+			name:   "string from time",
+			typ:    "String",
+			input:  time.Date(2022, 4, 15, 5, 20, 0, 123000000, time.FixedZone("", 8*3600)),
+			expect: "2022-04-15T05:20:00.123+08:00",
+		},
+		{name: "fixed string truncated", typ: "FixedString(2)", input: "abc", expect: "ab"},
+		{name: "fixed string padded", typ: "FixedString(3)", input: "a", expect: "a\x00\x00"},
+		{name: "bool", typ: "Bool", input: true, expect: true},
+		{name: "bool from number", typ: "Bool", input: float64(0), expect: false},
+		{name: "enum by name", typ: "Enum8('a' = 1, 'b' = 2)", input: "b", expect: "b"},
+		{name: "enum by value", typ: "Enum8('a' = 1, 'b' = 2)", input: float64(1), expect: "a"},
+		{name: "enum unknown value", typ: "Enum16('a' = 1)", input: float64(3), err: true},
+		{name: "enum unknown name", typ: "Enum8('a' = 1)", input: "b", err: true},
+		{name: "enum by value in string", typ: "Enum8('a' = 1, 'b' = 2)", input: "2", expect: "b"},
+		{name: "decimal from string", typ: "Decimal(18, 4)", input: "12.3456", expect: decimal.RequireFromString("12.3456")},
+		{name: "decimal from float", typ: "Decimal64(2)", input: 1.25, expect: decimal.NewFromFloat(1.25)},
+		{name: "decimal at max", typ: "Decimal(5, 2)", input: "-999.99", expect: decimal.RequireFromString("-999.99")},
+		{name: "decimal overflow", typ: "Decimal(5, 2)", input: float64(1000), err: true},
+		{name: "decimal32 overflow", typ: "Decimal32(4)", input: "123456.1", err: true},
+		{name: "decimal beyond scale", typ: "Decimal(9, 2)", input: 1.255, err: true},
+		{name: "decimal out of range", typ: "Decimal(77, 2)", input: float64(1), err: true},
+		{name: "int128 from string", typ: "Int128", input: "-170141183460469231731687303715884105728", expect: mustBigInt("-170141183460469231731687303715884105728")},
+		{name: "uint256 negative", typ: "UInt256", input: float64(-1), err: true},
+		{name: "int128 overflow", typ: "Int128", input: "170141183460469231731687303715884105728", err: true},
+		{name: "int128 from fraction", typ: "Int128", input: 1.5, err: true},
+		{name: "uuid", typ: "UUID", input: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", expect: uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")},
+		{name: "bad uuid", typ: "UUID", input: "x", err: true},
+		{name: "ipv4", typ: "IPv4", input: "10.0.0.1", expect: net.IPv4(10, 0, 0, 1).To4()},
+		{name: "ipv4 from number", typ: "IPv4", input: float64(167772161), expect: net.IPv4(10, 0, 0, 1).To4()},
+		{name: "ipv4 from numeric string", typ: "IPv4", input: "167772161", expect: net.IPv4(10, 0, 0, 1).To4()},
+		{name: "ipv4 from ipv6", typ: "IPv4", input: "::1", err: true},
+		{name: "ipv6", typ: "IPv6", input: "::1", expect: net.ParseIP("::1")},
+		{name: "datetime from unix timestamp", typ: "DateTime", input: float64(1600000000), expect: time.Unix(1600000000, 0)},
+		{name: "datetime from iso timestamp", typ: "DateTime64(3)", input: "2020-09-13T12:26:40.5Z", expect: time.Date(2020, 9, 13, 12, 26, 40, 5e8, time.UTC)},
+		{name: "date from iso date", typ: "Date", input: "2020-09-13", expect: time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC)},
+		{name: "datetime from bad string", typ: "DateTime", input: "13/09/2020", err: true},
+		{name: "datetime from numeric string", typ: "DateTime", input: "1600000000", expect: time.Unix(1600000000, 0)},
+		{name: "datetime64 from ticks", typ: "DateTime64(3)", input: float64(1600000000123), expect: time.Unix(1600000000, 123e6)},
+		{name: "datetime64 from seconds with fraction", typ: "DateTime64(3)", input: 1600000000.5, expect: time.Unix(1600000000, 5e8)},
+		{name: "datetime in timezone of column", typ: "DateTime('Asia/Shanghai')", input: "2020-09-13 20:26:40", expect: time.Unix(1600000000, 0).In(shanghai)},
+		{name: "strict int", typ: "Int8", strict: true, input: float64(1), expect: int8(1)},
+		{name: "strict int from string", typ: "Int8", strict: true, input: "1", err: true},
+		{name: "strict int overflow", typ: "Int8", strict: true, input: float64(128), err: true},
+		{name: "strict bool from string", typ: "Bool", strict: true, input: "true", err: true},
+		{name: "strict bool from number", typ: "Bool", strict: true, input: float64(1), err: true},
+		{name: "strict datetime from iso timestamp", typ: "DateTime", strict: true, input: "2020-09-13T12:26:40Z", err: true},
+		{name: "strict datetime from unix timestamp", typ: "DateTime", strict: true, input: float64(1600000000), expect: time.Unix(1600000000, 0)},
+		{name: "strict array from strings", typ: "Array(UInt8)", strict: true, input: []interface{}{"1"}, err: true},
+		{name: "strict int128 from string", typ: "Int128", strict: true, input: "1", err: true},
+		{name: "strict int128", typ: "Int128", strict: true, input: float64(-1), expect: big.NewInt(-1)},
+		{name: "strict decimal from string", typ: "Decimal(9, 2)", strict: true, input: "1.5", err: true},
+		{name: "strict decimal", typ: "Decimal(9, 2)", strict: true, input: 1.5, expect: decimal.NewFromFloat(1.5)},
+		{name: "strict enum by name", typ: "Enum8('a' = 1)", strict: true, input: "a", expect: "a"},
+		{name: "strict enum by value in string", typ: "Enum8('a' = 1)", strict: true, input: "1", err: true},
+		{name: "strict ipv4", typ: "IPv4", strict: true, input: "10.0.0.1", expect: net.IPv4(10, 0, 0, 1).To4()},
+		{name: "strict ipv4 from numeric string", typ: "IPv4", strict: true, input: "167772161", err: true},
+		{name: "strict string", typ: "String", strict: true, input: "a", expect: "a"},
+		{name: "strict string from number", typ: "String", strict: true, input: float64(1), err: true},
+		{name: "strict string from bool", typ: "String", strict: true, input: true, err: true},
+		{name: "strict string from object", typ: "String", strict: true, input: map[string]interface{}{"a": "b"}, err: true},
+		{name: "strict fixed string padded", typ: "FixedString(3)", strict: true, input: "a", expect: "a\x00\x00"},
+		{name: "strict fixed string too long", typ: "FixedString(2)", strict: true, input: "中", err: true},
+		{name: "strict fixed string from number", typ: "FixedString(2)", strict: true, input: float64(1), err: true},
+		{name: "nullable nil", typ: "Nullable(String)", input: nil, expect: (*string)(nil)},
+		{name: "nullable", typ: "Nullable(String)", input: "a", expect: str("a")},
+		{name: "nullable big int", typ: "Nullable(Int256)", input: float64(3), expect: big.NewInt(3)},
+		{name: "low cardinality", typ: "LowCardinality(String)", input: "a", expect: "a"},
+		{
+			name:   "array of nullable low cardinality",
+			typ:    "Array(Nullable(LowCardinality(String)))",
+			input:  []interface{}{"a", nil},
+			expect: []*string{str("a"), nil},
+		},
+		{
+			name:   "nested arrays",
+			typ:    "Array(Array(Int64))",
+			input:  []interface{}{[]interface{}{float64(1)}, []interface{}{}},
+			expect: [][]int64{{1}, {}},
+		},
+		{name: "array from string", typ: "Array(String)", input: "a", err: true},
+		{
+			name:   "map",
+			typ:    "Map(String, String)",
+			input:  map[string]interface{}{"a": "b"},
+			expect: map[string]string{"a": "b"},
+		},
+		{
+			name:   "map with numeric keys and nullable values",
+			typ:    "Map(UInt8, Nullable(Int64))",
+			input:  map[string]interface{}{"1": float64(2), "3": nil},
+			expect: map[uint8]*int64{1: i64(2), 3: nil},
+		},
+		{
+			name:   "tuple by position",
+			typ:    "Tuple(String, UInt8)",
+			input:  []interface{}{"a", float64(1)},
+			expect: []interface{}{"a", uint8(1)},
+		},
+		{
+			name:   "named tuple by object",
+			typ:    "Tuple(a String, b Nullable(UInt8))",
+			input:  map[string]interface{}{"a": "x"},
+			expect: []interface{}{"x", (*uint8)(nil)},
+		},
+		{name: "tuple size mismatch", typ: "Tuple(String, UInt8)", input: []interface{}{"a"}, err: true},
+		{name: "unsupported", typ: "AggregateFunction(uniq, String)", input: "a", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			typ, err := parseType(test.typ)
+			assert.Nil(t, err)
+
+			w := &Writer{coercion: CoercionLenient}
+			if test.strict {
+				w.coercion = CoercionStrict
+			}
+			actual, err := w.convertValue(typ, test.input)
+			if test.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, actual)
+		})
+	}
+}
+
+func mustBigInt(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 10)
+	return n
+}
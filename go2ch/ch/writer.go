@@ -2,30 +2,76 @@ package ch
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go2ch/go2ch/config"
-	"go2ch/go2ch/filter"
+	"go2ch/go2ch/dlq"
+	"go2ch/go2ch/metrics"
+	"go2ch/go2ch/pipeline"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
-	jsoniter "github.com/json-iterator/go"
 	"github.com/zeromicro/go-zero/core/executors"
 	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/threading"
 )
 
+// errWriterClosed tells the rows are not inserted because the writer is closed while retrying
+var errWriterClosed = errors.New("writer is closed")
+
 type Writer struct {
-	ctx                  context.Context
+	ctx                  context.Context    // queries to clickhouse are sent with it
+	closing              context.Context    // cancelled by Close, which stops the background work of writer
+	cancel               context.CancelFunc // cancels closing
+	name                 string             // name of cluster, which labels metrics
 	conn                 driver.Conn
-	executor             *executors.ChunkExecutor
+	shards               []*shard // where rows are inserted, there is only one unless rows are routed to shards by go2ch
+	executor             *executors.PeriodicalExecutor
+	batches              *batchContainer // collects rows into batches for executor
+	flusher              *flusher        // inserts the batches of flushed chunks concurrently
 	ddl                  string
 	distributedDDL       string
+	database             string
 	tableName            string
 	distributedTableName string
-	columns              []*rowDesc
+	schema               atomic.Value // *schema
+	schemaEvolution      string
+	fallbackColumn       string
+	coercion             string
+	cluster              string
+	deadLetter           dlq.DeadLetter
+	backoff              backoff
+	deduplicate          bool
+	routing              string
+	shardingKey          string
+	shardingHash         func(data []byte) uint64
+	state                writerState
+}
+
+// pendingRow is a row converted to the values of clickhouse columns, waiting in the batch to be sent
+type pendingRow struct {
+	*pipeline.Row
+	schema *schema // the columns which values are converted with
+	values []interface{}
+	size   int       // bytes of values, see valueSize
+	shard  int       // index of the shard which the row is inserted into
+	added  time.Time // when the row is added to the batch
+}
+
+type pendingRows []*pendingRow
+
+// origin returns the original rows
+func (rs pendingRows) origin() []*pipeline.Row {
+	rows := make([]*pipeline.Row, 0, len(rs))
+	for _, r := range rs {
+		rows = append(rows, r.Row)
+	}
+	return rows
 }
 
 type rowDesc struct {
@@ -35,49 +81,115 @@ type rowDesc struct {
 	DefaultExpression string `json:"default_expression"`
 	Comment           string `json:"comment"`
 	CodecExpression   string `json:"codec_expression"`
-	TTLExpression     string `json:"ttl_expression"`
+	chType            *chType
+	goType            reflect.Type       // the go type which values are converted to
+	convert           converter          // compiled from chType, see compile
+	defaultValue      func() interface{} // gives the value when the column is missing in a message
 }
 
-var index int64 = 0
-var total int64 = 0
-var size int64 = 0
+// NewWriter creates a new writer for clickhouse of cluster name, the rows which can not be inserted are sent to deadLetter
+func NewWriter(ctx context.Context, name string, c *config.ClickHouseConf, deadLetter dlq.DeadLetter) (*Writer, error) {
+	err := checkRouting(c.Routing, c.DistributedTableName, c.ShardingKey, c.ShardingHash)
+	if err != nil {
+		return nil, fmt.Errorf("newWriter | %v", err)
+	}
+	if err = checkDedup(c.InsertDeduplicate, c.DedupWindowOffsets, c.MaxRowAgeSecond); err != nil {
+		return nil, fmt.Errorf("newWriter | %v", err)
+	}
 
-// NewWriter creates a new writer for clickhouse
-func NewWriter(ctx context.Context, c *config.ClickHouseConf) (*Writer, error) {
-	conn, err := clickhouse.Open(&clickhouse.Options{
-		Addr: c.Addrs,
-		Auth: clickhouse.Auth{
-			Database: c.Database,
-			Username: c.Username,
-			Password: c.Password,
-		},
-		DialTimeout:     time.Duration(c.DialTimeoutSecond) * time.Second,
-		MaxOpenConns:    c.MaxOpenConns,
-		MaxIdleConns:    c.MaxIdleConns,
-		ConnMaxLifetime: time.Duration(c.ConnMaxLiftTimeMinute) * time.Minute,
-	})
+	conn, err := open(c, c.Addrs)
 	if err != nil {
 		return nil, fmt.Errorf("newWriter | create clickhouse writer failed: %v", err)
 	}
+	shards := []*shard{{conn: conn}}
+	if c.Routing == RoutingShard {
+		shards = make([]*shard, 0, len(c.Addrs))
+		for _, addr := range c.Addrs {
+			shardConn, err := open(c, []string{addr})
+			if err != nil {
+				return nil, fmt.Errorf("newWriter | create clickhouse writer of shard[%s] failed: %v", addr, err)
+			}
+			shards = append(shards, &shard{addr: addr, conn: shardConn})
+		}
+	}
 
+	closing, cancel := context.WithCancel(ctx)
 	writer := &Writer{
 		ctx:                  ctx,
+		closing:              closing,
+		cancel:               cancel,
+		name:                 name,
 		conn:                 conn,
+		shards:               shards,
 		ddl:                  c.DDL,
 		distributedDDL:       c.DistributedDDL,
+		database:             c.Database,
 		tableName:            c.TableName,
 		distributedTableName: c.DistributedTableName,
+		deadLetter:           deadLetter,
+		backoff: backoff{
+			maxRetries:  c.MaxRetries,
+			interval:    time.Duration(c.RetryIntervalMillisecond) * time.Millisecond,
+			maxInterval: time.Duration(c.MaxRetryIntervalSecond) * time.Second,
+		},
+		deduplicate:     c.InsertDeduplicate,
+		schemaEvolution: c.SchemaEvolution,
+		fallbackColumn:  c.FallbackColumn,
+		coercion:        c.Coercion,
+		cluster:         c.Cluster,
+		routing:         c.Routing,
+		shardingKey:     c.ShardingKey,
+		shardingHash:    shardingHashes[c.ShardingHash],
+		flusher:         newFlusher(c.MaxInflightBatches),
 	}
 
 	err = writer.initTable()
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("newWriter | %v", err)
 	}
 
-	writer.executor = executors.NewChunkExecutor(writer.execute, executors.WithChunkBytes(c.MaxChunkBytes), executors.WithFlushInterval(time.Duration(c.FlushIntervalSecond)*time.Second))
+	if c.ColumnRefreshIntervalSecond > 0 {
+		threading.GoSafe(func() {
+			writer.refreshPeriodically(time.Duration(c.ColumnRefreshIntervalSecond) * time.Second)
+		})
+	}
+
+	writer.batches = newBatchContainer(newBatchPolicy(c), writer.execute)
+	writer.executor = executors.NewPeriodicalExecutor(batchTick, writer.batches)
+	threading.GoSafe(func() {
+		writer.flushPeriodically(batchTick)
+	})
 	return writer, nil
 }
 
+// open opens a connection pool to the clickhouse nodes in addrs
+func open(c *config.ClickHouseConf, addrs []string) (driver.Conn, error) {
+	if c.Protocol == ProtocolHTTP {
+		return openHTTP(c, addrs)
+	}
+	return clickhouse.Open(&clickhouse.Options{
+		Addr: addrs,
+		Auth: clickhouse.Auth{
+			Database: c.Database,
+			Username: c.Username,
+			Password: c.Password,
+		},
+		DialTimeout:     time.Duration(c.DialTimeoutSecond) * time.Second,
+		MaxOpenConns:    c.MaxOpenConns,
+		MaxIdleConns:    c.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(c.ConnMaxLiftTimeMinute) * time.Minute,
+	})
+}
+
+// insertTable returns the table which rows are inserted into
+func (w *Writer) insertTable() string {
+	if w.routing == RoutingDistributed {
+		return w.distributedTableName
+	}
+	return w.tableName
+}
+
 // initTable inits clickhouse table by executing ddl
 func (w *Writer) initTable() error {
 	err := w.conn.Exec(w.ctx, w.ddl)
@@ -92,82 +204,257 @@ func (w *Writer) initTable() error {
 		}
 	}
 
-	rowDescs, err := w.getColumns()
+	_, err = w.refreshSchema()
 	if err != nil {
-		return fmt.Errorf("initTable | get table columns failed: %v", err)
+		return fmt.Errorf("initTable | %v", err)
 	}
-	w.columns = rowDescs
 
-	return nil
+	return w.checkFallbackColumn()
 }
 
-// Write writes data to chunk executor, when chunk is filled or chunk flash time is met, it would run writer.execute function
-func (w *Writer) Write(data string) error {
-	err := w.executor.Add(data, len(data))
+// Write converts row to the values of columns and adds it to the batch of executor,
+// when the batch is due to be flushed by its policy, it would run writer.execute function.
+// A row which can not be converted is rejected right away, it is handled so nil is returned.
+func (w *Writer) Write(row *pipeline.Row) error {
+	p, err := w.convert(w.getSchema(), row)
 	if err != nil {
-		return fmt.Errorf("write | write data to chunk executor failed: %v", err)
+		w.reject([]*pipeline.Row{row}, dlq.StageConvert, err)
+		return nil
 	}
+	w.executor.Add(p)
+	metrics.QueueRows.Inc(w.name)
+	atomic.AddInt64(&w.state.pendingBytes, int64(p.size))
 	return nil
 }
 
-// execute sends chunk values to clickhouse, it would be called when the chunk is full or reaches flash interval time
-func (w *Writer) execute(values []interface{}) {
+// convert converts the fields of row to the values of the columns of s
+func (w *Writer) convert(s *schema, row *pipeline.Row) (*pendingRow, error) {
+	values, err := w.getDataStruct(s, row.Fields)
+	if err != nil {
+		var conversion *ConversionError
+		if errors.As(err, &conversion) {
+			metrics.ConversionErrors.Inc(w.name, conversion.Column)
+		}
+		return nil, fmt.Errorf("convert | convert data to struct failed: %v", err)
+	}
+	return &pendingRow{Row: row, schema: s, values: values, size: valuesSize(values), shard: w.shardOf(row.Fields)}, nil
+}
 
-	index++
+// Close inserts the rows waiting in the batch, and closes the connections to clickhouse.
+// The rows failing to be inserted are not retried any more, they are left to be consumed again after restarting.
+func (w *Writer) Close() error {
+	w.batches.close()
+	w.executor.Flush()
+	w.cancel()
+	w.flusher.wait()
+	for _, sh := range w.shards {
+		if sh.conn == w.conn {
+			continue
+		}
+		if err := sh.conn.Close(); err != nil {
+			return fmt.Errorf("close | close clickhouse shard[%s] failed: %v", sh, err)
+		}
+	}
+	return w.conn.Close()
+}
 
-	start := time.Now().UnixNano()
+// execute dispatches the rows of batch to flusher, it would be called when the batch is due to be flushed.
+// It blocks while flusher is busy with as many batches as it can insert at a time.
+func (w *Writer) execute(b *flushBatch) {
+	metrics.QueueRows.Add(-float64(len(b.rows)), w.name)
+	metrics.Flushes.Inc(w.name, b.reason)
+	start := time.Now()
+
+	// the whole batch is inserted with the same columns, the rows converted with the former ones are converted again
+	s := w.getSchema()
+	if w.schemaEvolution == SchemaEvolutionAdd {
+		ms := make([]map[string]interface{}, 0, len(b.rows))
+		for _, row := range b.rows {
+			ms = append(ms, row.Fields)
+		}
+		s = w.addColumns(s, ms)
+	}
+	rows := w.reconvert(s, b.rows)
 
-	batch, err := w.conn.PrepareBatch(w.ctx, "INSERT INTO "+w.tableName)
-	if err != nil {
-		logx.Errorf("execute | prepare clickhouse insert batch sql failed: %v", err)
+	// rows of a kafka partition are inserted in batches of their own for each shard, see groupByPartition.
+	// The batches are inserted by flusher while the next chunk is being filled and converted.
+	var batches [][]*pendingRow
+	for _, batch := range groupByPartition(rows, w.batches.policy.window) {
+		batches = append(batches, groupByDefaults(batch)...)
+	}
+	chunk := &flushChunk{start: start, rows: len(b.rows), bytes: b.bytes, reason: b.reason, pending: int32(len(batches))}
+	if len(batches) == 0 {
+		w.finishChunk(chunk)
 		return
 	}
-	var length = 0
-	for _, value := range values {
-		length += len(value.(string))
+	for _, batch := range batches {
+		w.dispatch(s, batch, chunk)
+	}
+}
 
-		m := make(map[string]interface{})
-		err = jsoniter.Unmarshal([]byte(value.(string)), &m)
-		if err != nil {
-			logx.Errorf("execute | unmarshal value failed: %v", err)
-			return
+// insert inserts rows into clickhouse and returns the number of rows accepted.
+// A row failing to be appended is left out and the batch is rebuilt with the rest rows,
+// and if clickhouse refuses the batch, it is split in halves so that the good rows still land.
+// If the error tells the table has been altered, rows are converted again with the latest columns and sent once more.
+func (w *Writer) insert(s *schema, sh *shard, rows []*pendingRow) int {
+	var refreshed bool
+	for len(rows) > 0 {
+		stage, bad, err := w.sendWithRetry(s, sh, rows)
+		switch {
+		case err == nil:
+			for _, row := range rows {
+				row.Done()
+			}
+			w.state.flushed()
+			return len(rows)
+		case errors.Is(err, errWriterClosed):
+			// the rows are not acked, they would be consumed again after restarting
+			logx.Errorf("insert | %v, %d rows are left to be consumed again", err, len(rows))
+			return 0
+		case isSchemaMismatch(err) && !refreshed:
+			refreshed = true
+			latest, e := w.refreshSchema()
+			if e != nil {
+				logx.Errorf("insert | %v", e)
+				continue
+			}
+			logx.Infof("insert | columns of table[%s] are refreshed after error: %v", w.tableName, err)
+			s = latest
+			rows = w.reconvert(s, rows)
+			if groups := groupByDefaults(rows); len(groups) > 1 {
+				// the rows may leave out other columns with the latest ones
+				var accepted int
+				for _, group := range groups {
+					accepted += w.insert(s, sh, group)
+				}
+				return accepted
+			}
+		case stage == dlq.StageAppend && bad < 0:
+			// the bad row is not known, it is found by halves
+			mid := len(rows) / 2
+			return w.insert(s, sh, rows[:mid]) + w.insert(s, sh, rows[mid:])
+		case stage == dlq.StageAppend:
+			w.reject([]*pipeline.Row{rows[bad].Row}, stage, err)
+			rows = append(rows[:bad:bad], rows[bad+1:]...)
+		case stage == dlq.StageSend && isDataError(err) && len(rows) > 1:
+			mid := len(rows) / 2
+			return w.insert(s, sh, rows[:mid]) + w.insert(s, sh, rows[mid:])
+		default:
+			w.reject(pendingRows(rows).origin(), stage, err)
+			return 0
 		}
-		//fmt.Println("execute - m:", m)
-		stru, err := w.getDataStruct(m)
+	}
+	return 0
+}
+
+// sendWithRetry sends rows to clickhouse, and retries with backoff if clickhouse can not be reached.
+// It gives up retrying once the writer is closed.
+func (w *Writer) sendWithRetry(s *schema, sh *shard, rows []*pendingRow) (string, int, error) {
+	for attempt := 0; ; attempt++ {
+		stage, bad, err := w.send(s, sh, rows)
 		if err != nil {
-			logx.Errorf("execute | convert data to struct failed: %v", err)
-			return
+			metrics.InsertErrors.Inc(w.name, stage)
+			w.state.failed(err)
 		}
-		//fmt.Println("execute - stru:", stru)
-		err = batch.Append(stru...)
-		if err != nil {
-			logx.Errorf("execute | append value to clickhouse insert batch failed: %v", err)
-			return
+		if err == nil || stage == dlq.StageAppend || isDataError(err) || w.backoff.exhausted(attempt) {
+			return stage, bad, err
+		}
+
+		d := w.backoff.duration(attempt)
+		logx.Errorf("sendWithRetry | %v, retry %d rows to shard[%s] in %v", err, len(rows), sh, d)
+		select {
+		case <-time.After(d):
+		case <-w.closing.Done():
+			return stage, bad, fmt.Errorf("sendWithRetry | %w: %v", errWriterClosed, err)
 		}
 	}
+}
 
+// send sends rows to shard in one batch, with the columns of s which rows are converted with,
+// except the ones left for clickhouse to evaluate, which are the same for all rows, see groupByDefaults.
+// Values are appended column by column, each column in a slice of its go type.
+// If it fails, it returns the stage where it failed, and the index of the bad row when appending fails,
+// which is -1 if the bad row is not known.
+func (w *Writer) send(s *schema, sh *shard, rows []*pendingRow) (string, int, error) {
+	indexes, columns, query := s.insertColumns(rows[0].values)
+	ctx := withColumns(w.ctx, columns)
+	if w.deduplicate {
+		ctx = withDedupToken(ctx, rows)
+	}
+	batch, err := sh.conn.PrepareBatch(ctx, query)
+	if err != nil {
+		return dlq.StagePrepare, 0, fmt.Errorf("send | prepare clickhouse insert batch sql failed: %w", err)
+	}
+	// the batch is aborted if appending fails, so that its connection is released, it is released by sending otherwise
+	for j, i := range indexes {
+		column := s.columns[i]
+		values, bad, err := columnValues(column, i, rows)
+		if err != nil {
+			_ = batch.Abort()
+			return dlq.StageAppend, bad, fmt.Errorf("send | %v", err)
+		}
+		if err = batch.Column(j).Append(values); err != nil {
+			_ = batch.Abort()
+			bad = -1
+			if len(rows) == 1 {
+				bad = 0
+			}
+			return dlq.StageAppend, bad, fmt.Errorf("send | append column[%s] to clickhouse insert batch failed: %v", column.Name, err)
+		}
+	}
 	err = batch.Send()
 	if err != nil {
-		logx.Errorf("execute | send values to clickhouse failed: %v", err)
-		return
+		return dlq.StageSend, 0, fmt.Errorf("send | send values to clickhouse failed: %w", err)
 	}
+	return "", 0, nil
+}
 
-	end := time.Now().UnixNano()
-	use := end - start
-	total += use
-	size += int64(length)
+// columnValues returns the values of the ith column of rows, in a slice of the go type of column.
+// If a value is not in the go type, it returns the index of its row.
+func columnValues(column *rowDesc, i int, rows []*pendingRow) (interface{}, int, error) {
+	slice := reflect.MakeSlice(reflect.SliceOf(column.goType), 0, len(rows))
+	for j, row := range rows {
+		v := row.values[i]
+		rv := reflectValue(v, column.goType)
+		if !rv.Type().AssignableTo(column.goType) {
+			return nil, j, fmt.Errorf("columnValues | column[%s] in %s can not take %T value [%v]", column.Name, column.Type, v, v)
+		}
+		slice = reflect.Append(slice, rv)
+	}
+	return slice.Interface(), 0, nil
+}
 
-	fmt.Printf("execute function | finish send time: %d\n", end)
+// reject sends rows to the dead letter queue with the stage and reason why they are rejected
+func (w *Writer) reject(rows []*pipeline.Row, stage string, err error) {
+	logx.Errorf("%v", err)
+	metrics.RowsRejected.Add(float64(len(rows)), w.name, stage)
+	w.state.failed(err)
 
-	fmt.Printf("execute function | send index=%d, one data size=%dbytes, total data size=%dbytes, one use time=%dns, total use time=%dns, avg=%dns\n", index, length, size, use, total, total/index)
+	records := make([]*dlq.Record, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, row.Record(stage, err))
+	}
+	// the rows not kept by dead letter are not acked, they would be consumed again after restarting
+	if err := w.deadLetter.Put(records...); err != nil {
+		logx.Errorf("reject | put %d rows to dead letter failed: %v", len(records), err)
+		return
+	}
+	for _, row := range rows {
+		row.Done()
+	}
 }
 
 // getColumns returns the descriptions of rows in clickhouse table
 func (w *Writer) getColumns() ([]*rowDesc, error) {
 
-	rows, err := w.conn.Query(w.ctx, "DESC TABLE "+w.tableName)
+	database, table := w.database, w.tableName
+	if i := strings.IndexByte(table, '.'); i >= 0 {
+		database, table = table[:i], table[i+1:]
+	}
+	rows, err := w.conn.Query(w.ctx, "SELECT name, type, default_kind, default_expression, comment, compression_codec "+
+		"FROM system.columns WHERE database = ? AND table = ? ORDER BY position", database, table)
 	if err != nil {
-		return nil, fmt.Errorf("getColumns | query desc table failed: %v", err)
+		return nil, fmt.Errorf("getColumns | query columns of table failed: %v", err)
 	}
 
 	descs := make([]*rowDesc, 0)
@@ -179,302 +466,75 @@ func (w *Writer) getColumns() ([]*rowDesc, error) {
 			&desc.DefaultType,
 			&desc.DefaultExpression,
 			&desc.Comment,
-			&desc.CodecExpression,
-			&desc.TTLExpression)
+			&desc.CodecExpression)
 		if err != nil {
 			return nil, fmt.Errorf("getColumns | scan row to struct failed: %v", err)
 		}
+		if err = w.describe(&desc); err != nil {
+			return nil, fmt.Errorf("getColumns | %v", err)
+		}
 		descs = append(descs, &desc)
 	}
-
-	return descs, nil
-}
-
-// getDataStruct dynamically builds a struct (in []interface{} format, each interface{} means a filed in struct) according to m
-func (w *Writer) getDataStruct(m map[string]interface{}) ([]interface{}, error) {
-	stru := make([]interface{}, 0)
-	for _, column := range w.columns {
-		if v, ok := m[column.Name]; ok {
-			switch column.Type {
-			// string
-			case "String":
-				realType, _ := v.(string)
-				stru = append(stru, realType)
-			// int
-			case "Int8":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, int8(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, int8(rt))
-				}
-			case "Int16":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, int16(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, int16(rt))
-				}
-			case "Int32":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, int32(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, int32(rt))
-				}
-			case "Int64":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, int64(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, int64(rt))
-				}
-			case "UInt8":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, uint8(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, uint8(rt))
-				}
-			case "UInt16":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, uint16(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, uint16(rt))
-				}
-			case "UInt32":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, uint32(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, uint32(rt))
-				}
-			case "UInt64":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, uint64(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, uint64(rt))
-				}
-			// float
-			case "Float32":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, float32(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, float32(rt))
-				}
-			case "Float64":
-				if realType, ok := v.(int); ok {
-					stru = append(stru, float64(realType))
-				} else {
-					rt, _ := v.(float64)
-					stru = append(stru, rt)
-				}
-			default:
-				realType, _ := v.(string)
-				if strings.Contains(column.Type, "Date") {
-					// Date
-					// Datetime
-					// Datetime64
-					vt, err := w.getTimeValue(v, m)
-					if err != nil {
-						return nil, fmt.Errorf("getDateStruct | %v", err)
-					}
-					stru = append(stru, vt)
-				} else if strings.Contains(column.Type, "FixString") {
-					// FixString(N)
-					length := column.Type[len("FixString(") : len(column.Type)-1]
-					l, _ := strconv.Atoi(length)
-					realType = realType[:l]
-					stru = append(stru, realType)
-				} else if strings.Contains(column.Type, "Enum") {
-					// Enum8, Enum16
-					stru = append(stru, realType)
-				} else if strings.Contains(column.Type, "Array") {
-					// Array(T)
-					t := column.Type[len("Array(") : len(column.Type)-1]
-					vs, _ := v.([]interface{})
-					array, err := w.getArray(t, vs, m)
-					if err != nil {
-						return nil, fmt.Errorf("getDataStruct | get array failed: %v", err)
-					}
-					stru = append(stru, array)
-				}
-			}
-		}
+	if len(descs) == 0 {
+		return nil, fmt.Errorf("getColumns | table[%s.%s] has no columns", database, table)
 	}
 
-	return stru, nil
+	return descs, nil
 }
 
-// getArray builds a slice data for inserting to clickhouse
-func (w *Writer) getArray(t string, vs []interface{}, m map[string]interface{}) ([]interface{}, error) {
-
-	array := make([]interface{}, 0)
+// describe parses the type of column d, and compiles how its values are converted and what its default is,
+// so that nothing of the type is resolved again for every row
+func (w *Writer) describe(d *rowDesc) error {
 	var err error
-
-	switch t {
-	// string
-	case "String":
-		for _, v := range vs {
-			realType, _ := v.(string)
-			array = append(array, realType)
-		}
-
-	case "Int8":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, int8(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, int8(rt))
-			}
-		}
-	case "Int16":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, int16(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, int16(rt))
-			}
-		}
-	case "Int32":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, int32(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, int32(rt))
-			}
-		}
-	case "Int64":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, int64(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, int64(rt))
-			}
-		}
-	case "UInt8":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, uint8(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, uint8(rt))
-			}
-		}
-	case "UInt16":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, uint16(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, uint16(rt))
-			}
-		}
-	case "UInt32":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, uint32(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, uint32(rt))
-			}
-		}
-	case "UInt64":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, uint64(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, uint64(rt))
-			}
-		}
-	// float
-	case "Float32":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, float32(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, float32(rt))
-			}
-		}
-	case "Float64":
-		for _, v := range vs {
-			if realType, ok := v.(int); ok {
-				array = append(array, float64(realType))
-			} else {
-				rt, _ := v.(float64)
-				array = append(array, float64(rt))
-			}
-		}
-	default:
-		if strings.Contains(t, "Date") {
-			// Date
-			// Datetime
-			// Datetime64
-			for _, v := range vs {
-				// Date
-				// Datetime
-				// Datetime64
-				var vt time.Time
-				if vt, err = w.getTimeValue(v, m); err == nil {
-					array = append(array, vt)
-				} else {
-					break
-				}
-			}
-		} else if strings.Contains(t, "FixString") {
-			// FixString(N)
-			for _, v := range vs {
-				realType, _ := v.(string)
-				length := t[len("FixString(") : len(t)-1]
-				l, _ := strconv.Atoi(length)
-				realType = realType[:l]
-				array = append(array, realType)
-			}
-		} else if strings.Contains(t, "Enum") {
-			// Enum8, Enum16
-			for _, v := range vs {
-				realType, _ := v.(string)
-				array = append(array, realType)
-			}
-		} else if strings.Contains(t, "Array") {
-			// 	not support multidimensional arrays
-			err = fmt.Errorf("getArray | not support multidimensional arrays")
-		}
-
+	if d.chType, err = parseType(d.Type); err != nil {
+		return fmt.Errorf("describe | parse type of column[%s] failed: %v", d.Name, err)
+	}
+	if d.goType, err = d.chType.goType(); err != nil {
+		return fmt.Errorf("describe | column[%s]: %v", d.Name, err)
+	}
+	if d.convert, err = w.compile(d.chType); err != nil {
+		return fmt.Errorf("describe | column[%s]: %v", d.Name, err)
 	}
-	return array, err
+	if d.defaultValue, err = w.columnDefault(d); err != nil {
+		return fmt.Errorf("describe | %v", err)
+	}
+	return nil
 }
 
-// getTimeValue converts v to time.Time type
-func (w *Writer) getTimeValue(v interface{}, m map[string]interface{}) (time.Time, error) {
-	vs, ok := v.(string)
-	if !ok {
-		return time.Time{}, fmt.Errorf("getTimeValue | time data's original type must be string")
+// getDataStruct dynamically builds a struct (in []interface{} format, each interface{} means a filed in struct) according to m.
+// There is a value for every column, a missing field, or null for a column which is not Nullable, takes the default of column.
+// The keys which are not columns are put into the fallback column if schema evolution is in map policy.
+func (w *Writer) getDataStruct(s *schema, m map[string]interface{}) ([]interface{}, error) {
+	if w.schemaEvolution == SchemaEvolutionMap {
+		m = w.withFallback(s, m)
 	}
-	layout, ok1 := m[filter.Time_Format_Layout_Field]
-	local, ok2 := m[filter.Time_Format_Local_Field]
-	if !ok1 || !ok2 {
-		return time.Time{}, fmt.Errorf("getTimeValue | convert [%v] to time.Time failed, please add time_fortmat config in configuration file if you need to storage time data", v)
+	stru := make([]interface{}, 0, len(s.columns))
+	for _, column := range s.columns {
+		v, ok := m[column.Name]
+		if !ok || (v == nil && !column.chType.nullable()) {
+			stru = append(stru, column.defaultValue())
+			continue
+		}
+		value, err := column.convert(v)
+		if err != nil {
+			return nil, fmt.Errorf("getDataStruct | %w", &ConversionError{Column: column.Name, Type: column.Type, Value: v, Err: err})
+		}
+		stru = append(stru, value)
 	}
 
-	l, err := time.LoadLocation(local.(string))
-	if err != nil {
-		return time.Time{}, fmt.Errorf("getTimeValue | load location[%v] failed: %v", local, err)
-	}
+	return stru, nil
+}
 
-	t, err := time.ParseInLocation(layout.(string), vs, l)
-	if err != nil {
-		return time.Time{}, fmt.Errorf("getTimeValue | parse date [%v] to time.Time failed: %v", vs, err)
+// buildInsertQuery builds the INSERT statement with the column list, so that values are matched to columns by name
+func buildInsertQuery(table string, columns []*rowDesc) string {
+	names := make([]string, 0, len(columns))
+	for _, column := range columns {
+		names = append(names, quoteName(column.Name))
 	}
+	return fmt.Sprintf("INSERT INTO %s (%s)", table, strings.Join(names, ", "))
+}
 
-	return t, nil
+// quoteName quotes the name of column in backquotes
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
 }
@@ -0,0 +1,398 @@
+package ch
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+
+	"go2ch/go2ch/dlq"
+	"go2ch/go2ch/pipeline"
+)
+
+// fakeConn is a clickhouse connection which keeps the sent rows in memory.
+// A batch fails to append a row whose first value is "bad_append",
+// and clickhouse refuses it if it contains a row whose first value is "bad_send".
+// It can not be reached in the first unreachable times of preparing batch, and each batch takes delay to send.
+type fakeConn struct {
+	driver.Conn
+	lock        sync.Mutex
+	sent        [][]interface{}
+	batches     int
+	unreachable int
+	delay       time.Duration
+	inflight    int32
+	maxInflight int32 // the most batches sent at a time
+	open        int32 // batches prepared but neither sent nor aborted
+	queries     []string
+}
+
+func (c *fakeConn) PrepareBatch(ctx context.Context, query string) (driver.Batch, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.unreachable > 0 {
+		c.unreachable--
+		return nil, errors.New("connection refused")
+	}
+	atomic.AddInt32(&c.open, 1)
+	c.queries = append(c.queries, query)
+	return &fakeBatch{conn: c}, nil
+}
+
+type fakeBatch struct {
+	driver.Batch
+	conn *fakeConn
+	rows [][]interface{}
+}
+
+func (b *fakeBatch) Abort() error {
+	atomic.AddInt32(&b.conn.open, -1)
+	return nil
+}
+
+func (b *fakeBatch) Column(i int) driver.BatchColumn {
+	return &fakeColumn{batch: b}
+}
+
+// fakeColumn appends the values of a column to the rows of batch
+type fakeColumn struct {
+	batch *fakeBatch
+}
+
+func (c *fakeColumn) Append(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for i := 0; i < rv.Len(); i++ {
+		value := rv.Index(i).Interface()
+		if value == "bad_append" {
+			return errors.New("bad append")
+		}
+		if i == len(c.batch.rows) {
+			c.batch.rows = append(c.batch.rows, nil)
+		}
+		c.batch.rows[i] = append(c.batch.rows[i], value)
+	}
+	return nil
+}
+
+func (b *fakeBatch) Send() error {
+	atomic.AddInt32(&b.conn.open, -1)
+	n := atomic.AddInt32(&b.conn.inflight, 1)
+	defer atomic.AddInt32(&b.conn.inflight, -1)
+	for {
+		max := atomic.LoadInt32(&b.conn.maxInflight)
+		if n <= max || atomic.CompareAndSwapInt32(&b.conn.maxInflight, max, n) {
+			break
+		}
+	}
+	time.Sleep(b.conn.delay)
+
+	for _, row := range b.rows {
+		if row[0] == "bad_send" {
+			return &clickhouse.Exception{Code: 53, Name: "DB::Exception", Message: "bad send"}
+		}
+	}
+	b.conn.lock.Lock()
+	defer b.conn.lock.Unlock()
+	b.conn.sent = append(b.conn.sent, b.rows...)
+	b.conn.batches++
+	return nil
+}
+
+// memDeadLetter keeps the rejected records in memory
+type memDeadLetter struct {
+	lock    sync.Mutex
+	records []*dlq.Record
+}
+
+func (d *memDeadLetter) Put(records ...*dlq.Record) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.records = append(d.records, records...)
+	return nil
+}
+
+func (d *memDeadLetter) Close() error {
+	return nil
+}
+
+// newTestSchema creates the schema of table t with the columns of names and types in pairs
+func newTestSchema(t *testing.T, columns ...string) *schema {
+	descs := make([]*rowDesc, 0, len(columns)/2)
+	for i := 0; i < len(columns); i += 2 {
+		desc := &rowDesc{Name: columns[i], Type: columns[i+1]}
+		assert.Nil(t, (&Writer{}).describe(desc))
+		descs = append(descs, desc)
+	}
+	return newSchema("t", descs)
+}
+
+func newPendingRows(values ...string) []*pendingRow {
+	rows := make([]*pendingRow, 0, len(values))
+	for _, v := range values {
+		rows = append(rows, &pendingRow{Row: &pipeline.Row{Payload: v, Ack: func() {}}, values: []interface{}{v}})
+	}
+	return rows
+}
+
+func TestWriterInsert(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     []string
+		accepted int
+		stages   []string
+	}{
+		{
+			name:     "all good",
+			rows:     []string{"a", "b", "c"},
+			accepted: 3,
+		},
+		{
+			name:     "bad append",
+			rows:     []string{"a", "bad_append", "c", "bad_append"},
+			accepted: 2,
+			stages:   []string{dlq.StageAppend, dlq.StageAppend},
+		},
+		{
+			name:     "bad send",
+			rows:     []string{"a", "b", "c", "bad_send", "e", "f", "g"},
+			accepted: 6,
+			stages:   []string{dlq.StageSend},
+		},
+		{
+			name:     "bad append and send",
+			rows:     []string{"bad_send", "b", "bad_append", "d", "bad_send"},
+			accepted: 2,
+			stages:   []string{dlq.StageAppend, dlq.StageSend, dlq.StageSend},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &fakeConn{}
+			deadLetter := &memDeadLetter{}
+			w := &Writer{ctx: context.Background(), conn: conn, deadLetter: deadLetter}
+
+			accepted := w.insert(newTestSchema(t, "v", "String"), &shard{conn: conn}, newPendingRows(test.rows...))
+			assert.Equal(t, test.accepted, accepted)
+			assert.Len(t, conn.sent, test.accepted)
+			// every batch is released, whether it is sent or aborted
+			assert.EqualValues(t, 0, conn.open)
+
+			stages := make([]string, 0)
+			for _, record := range deadLetter.records {
+				stages = append(stages, record.Stage)
+			}
+			assert.ElementsMatch(t, test.stages, stages)
+		})
+	}
+}
+
+func TestWriterInsertRetry(t *testing.T) {
+	tests := []struct {
+		name        string
+		unreachable int
+		maxRetries  int
+		accepted    int
+		stages      []string
+	}{
+		{
+			name:        "retry until success",
+			unreachable: 5,
+			accepted:    2,
+		},
+		{
+			name:        "retry within limit",
+			unreachable: 2,
+			maxRetries:  2,
+			accepted:    2,
+		},
+		{
+			name:        "retry exhausted",
+			unreachable: 3,
+			maxRetries:  2,
+			stages:      []string{dlq.StagePrepare, dlq.StagePrepare},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &fakeConn{unreachable: test.unreachable}
+			deadLetter := &memDeadLetter{}
+			w := &Writer{
+				ctx:        context.Background(),
+				closing:    context.Background(),
+				conn:       conn,
+				deadLetter: deadLetter,
+				backoff: backoff{
+					maxRetries:  test.maxRetries,
+					interval:    time.Millisecond,
+					maxInterval: 4 * time.Millisecond,
+				},
+			}
+
+			var acked int32
+			rows := newPendingRows("a", "b")
+			for _, row := range rows {
+				row.Ack = func() { atomic.AddInt32(&acked, 1) }
+			}
+
+			accepted := w.insert(newTestSchema(t, "v", "String"), &shard{conn: conn}, rows)
+			assert.Equal(t, test.accepted, accepted)
+
+			stages := make([]string, 0)
+			for _, record := range deadLetter.records {
+				stages = append(stages, record.Stage)
+			}
+			assert.ElementsMatch(t, test.stages, stages)
+			// rows are acked whether they are inserted or kept by dead letter
+			assert.EqualValues(t, 2, acked)
+		})
+	}
+}
+
+func TestWriterInsertRetryClosed(t *testing.T) {
+	conn := &fakeConn{unreachable: 100}
+	deadLetter := &memDeadLetter{}
+	closing, cancel := context.WithCancel(context.Background())
+	w := &Writer{
+		ctx:        context.Background(),
+		closing:    closing,
+		cancel:     cancel,
+		conn:       conn,
+		deadLetter: deadLetter,
+		backoff:    backoff{interval: 10 * time.Millisecond, maxInterval: 10 * time.Millisecond},
+	}
+	time.AfterFunc(30*time.Millisecond, w.cancel)
+
+	var acked int32
+	rows := newPendingRows("a", "b")
+	for _, row := range rows {
+		row.Ack = func() { atomic.AddInt32(&acked, 1) }
+	}
+
+	// retrying forever stops once the writer is closed, and the rows are neither rejected nor acked
+	assert.Equal(t, 0, w.insert(newTestSchema(t, "v", "String"), &shard{conn: conn}, rows))
+	assert.Empty(t, deadLetter.records)
+	assert.EqualValues(t, 0, acked)
+}
+
+func TestWriterDispatch(t *testing.T) {
+	conn := &fakeConn{delay: 20 * time.Millisecond}
+	w := &Writer{
+		ctx:        context.Background(),
+		conn:       conn,
+		shards:     []*shard{{conn: conn}},
+		deadLetter: &memDeadLetter{},
+		flusher:    newFlusher(2),
+	}
+
+	// batches of partition 0 and 1 in turns, each with the offset of its row
+	s := newTestSchema(t, "offset", "Int64")
+	chunk := &flushChunk{rows: 6, pending: 6}
+	for i := 0; i < 6; i++ {
+		row := &pendingRow{Row: &pipeline.Row{Partition: i % 2, Offset: int64(i)}, values: []interface{}{int64(i)}}
+		w.dispatch(s, []*pendingRow{row}, chunk)
+	}
+	w.flusher.wait()
+
+	assert.EqualValues(t, 6, chunk.accepted)
+	assert.EqualValues(t, 0, chunk.pending)
+	assert.EqualValues(t, 2, conn.maxInflight)
+	// batches of a partition are inserted in the order they are dispatched
+	var sent []int
+	for _, row := range conn.sent {
+		sent = append(sent, int(row[0].(int64)))
+	}
+	evens, odds := make([]int, 0), make([]int, 0)
+	for _, i := range sent {
+		if i%2 == 0 {
+			evens = append(evens, i)
+		} else {
+			odds = append(odds, i)
+		}
+	}
+	assert.Equal(t, []int{0, 2, 4}, evens)
+	assert.Equal(t, []int{1, 3, 5}, odds)
+}
+
+func TestColumnValues(t *testing.T) {
+	s := newTestSchema(t, "id", "UInt32", "name", "Nullable(String)")
+	name := "a"
+	rows := []*pendingRow{
+		{values: []interface{}{uint32(1), &name}},
+		{values: []interface{}{uint32(2), (*string)(nil)}},
+		{values: []interface{}{"3", nil}},
+	}
+
+	values, _, err := columnValues(s.columns[1], 1, rows)
+	assert.Nil(t, err)
+	assert.Equal(t, []*string{&name, nil, nil}, values)
+
+	// the row whose value is not in the type of column is told
+	_, bad, err := columnValues(s.columns[0], 0, rows)
+	assert.Equal(t, 2, bad)
+	assert.EqualError(t, err, "columnValues | column[id] in UInt32 can not take string value [3]")
+}
+
+func TestGetDataStructError(t *testing.T) {
+	w := &Writer{}
+	_, err := w.getDataStruct(newTestSchema(t, "id", "UInt32", "tags", "Array(UInt8)"), map[string]interface{}{
+		"id":   float64(1),
+		"tags": []interface{}{float64(1), true},
+	})
+	assert.EqualError(t, err, "getDataStruct | convert column[tags] in Array(UInt8): convertNumber | can not convert bool value [true] to UInt8")
+
+	var conversion *ConversionError
+	assert.True(t, errors.As(err, &conversion))
+	assert.Equal(t, "tags", conversion.Column)
+}
+
+func TestBackoffDuration(t *testing.T) {
+	b := backoff{interval: 100 * time.Millisecond, maxInterval: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		d := b.duration(attempt)
+		assert.True(t, d >= max*time.Millisecond/2 && d <= max*time.Millisecond, "attempt %d: %v", attempt, d)
+	}
+}
+
+func TestGroupByPartition(t *testing.T) {
+	row := func(topic string, partition int, offset int64) *pendingRow {
+		return &pendingRow{Row: &pipeline.Row{Topic: topic, Partition: partition, Offset: offset}}
+	}
+	rows := []*pendingRow{
+		row("b", 0, 5), row("a", 1, 9), row("a", 0, 3), row("a", 1, 8), row("a", 0, 2), row("b", 0, 4),
+	}
+
+	batches := groupByPartition(rows, 0)
+	tokens := make([]string, 0, len(batches))
+	for _, batch := range batches {
+		tokens = append(tokens, dedupToken(batch))
+	}
+	assert.Equal(t, []string{"a-0-2-3-2", "a-1-8-9-2", "b-0-4-5-2"}, tokens)
+
+	// the same rows flushed in another order build the same batches
+	reversed := make([]*pendingRow, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		reversed = append(reversed, rows[i])
+	}
+	assert.Equal(t, batches, groupByPartition(reversed, 0))
+
+	// batches are cut at the boundaries of dedup windows
+	tokens = tokens[:0]
+	for _, batch := range groupByPartition(rows, 4) {
+		tokens = append(tokens, dedupToken(batch))
+	}
+	assert.Equal(t, []string{"a-0-2-3-2", "a-1-8-9-2", "b-0-4-5-2"}, tokens)
+	tokens = tokens[:0]
+	for _, batch := range groupByPartition(rows, 3) {
+		tokens = append(tokens, dedupToken(batch))
+	}
+	assert.Equal(t, []string{"a-0-2-2-1", "a-0-3-3-1", "a-1-8-8-1", "a-1-9-9-1", "b-0-4-5-2"}, tokens)
+}
@@ -5,17 +5,26 @@ import (
 
 	"github.com/zeromicro/go-queue/kq"
 	"github.com/zeromicro/go-zero/core/conf"
+	"github.com/zeromicro/go-zero/core/prometheus"
 	"github.com/zeromicro/go-zero/core/service"
 )
 
+// Condition is a condition on a field of message, or a group of conditions if one of All, Any and Not is set
 type Condition struct {
-	Key   string
-	Value string
-	Type  string `json:",optional,default=match,options=match|contains"`
-	Op    string `json:",optional,default=and,options=and|or"`
+	Key    string   `json:",optional"` // name of field, or a dotted path to a field in nested objects like user.geo.country
+	Value  string   `json:",optional"`
+	Values []string `json:",optional"` // values of in, or the lower and upper bounds of between
+	Type   string   `json:",optional,default=eq,options=eq|ne|in|match|contains|prefix|suffix|regex|exists|gt|gte|lt|lte|between"`
+	// how the condition is combined with the others in the list of a filter: the and conditions must all be true,
+	// without any of them one of the or conditions must be true. Groups are combined by All and Any instead.
+	Op  string      `json:",optional,default=and,options=and|or"`
+	All []Condition `json:",optional"`
+	Any []Condition `json:",optional"`
+	Not *Condition  `json:",optional"`
 }
 
 type ClickHouseConf struct {
+	// addresses of the native protocol, or of the HTTP interface if Protocol is http, like host:8123 or https://host:8443
 	Addrs                 []string
 	Username              string `json:",default=default"`
 	Password              string `json:",optional"`
@@ -28,18 +37,64 @@ type ClickHouseConf struct {
 	MaxIdleConns          int    `json:",optional,default=5"`
 	MaxOpenConns          int    `json:",optional,default=10"`
 	ConnMaxLiftTimeMinute int    `json:",optional,default=60"`
-	MaxChunkBytes         int    `json:",optional,default=10485760"`
-	FlushIntervalSecond   int    `json:",optional,default=5"`
+	// rows are flushed in a batch when any of the limits is hit: MaxBatchRows rows, MaxChunkBytes bytes of converted values,
+	// the oldest row waiting for MaxRowAgeSecond, or FlushIntervalSecond passing once there are MinBatchRows rows.
+	// 0 means no limit for MaxBatchRows and MaxRowAgeSecond, without MaxRowAgeSecond rows wait for MinBatchRows forever
+	MaxBatchRows        int `json:",optional,default=0"`
+	MinBatchRows        int `json:",optional,default=0"`
+	MaxChunkBytes       int `json:",optional,default=10485760"`
+	MaxRowAgeSecond     int `json:",optional,default=0"`
+	FlushIntervalSecond int `json:",optional,default=5"`
+	// batches inserted at a time, the batches of a kafka partition are still inserted in order,
+	// consuming is held up while all of them are in flight, it should not be more than MaxOpenConns
+	MaxInflightBatches int `json:",optional,default=4"`
+	// retry with exponential backoff when clickhouse can not be reached, 0 means retrying until success
+	MaxRetries               int `json:",optional,default=0"`
+	RetryIntervalMillisecond int `json:",optional,default=500"`
+	MaxRetryIntervalSecond   int `json:",optional,default=30"`
+	// attach insert_deduplication_token derived from kafka offsets to each batch, requires clickhouse 22.2+.
+	// Batches are cut at every DedupWindowOffsets offsets of a partition, and the rows of the window being consumed
+	// are held back until it is over, so that the rows consumed again after a failure are inserted with the same tokens.
+	// Rows flushed by MaxRowAgeSecond or shutdown are not held back, their windows may be inserted with other tokens.
+	// MaxRowAgeSecond is required with it, since the last window of a partition is only flushed by age once no more rows come
+	InsertDeduplicate  bool `json:",optional"`
+	DedupWindowOffsets int  `json:",optional,default=1000"`
+	// how to handle the keys of messages which are not columns of table: leave them out, add them to table as new columns,
+	// or put them into FallbackColumn in type Map(String, String)
+	SchemaEvolution string `json:",optional,default=ignore,options=ignore|add|map"`
+	FallbackColumn  string `json:",optional"`
+	// how values of messages are converted to the types of columns: strict takes only the json types matching columns,
+	// lenient parses numeric and boolean strings and ISO 8601 timestamps as well, which text formats like csv need.
+	// In both modes, values with fraction or out of the range of column are rejected rather than truncated or wrapped
+	Coercion string `json:",optional,default=lenient,options=strict|lenient"`
+	// the cluster in ON CLUSTER clause when altering table
+	Cluster string `json:",optional"`
+	// interval to read the columns of table again, so that altering table takes effect without restart, 0 means never
+	ColumnRefreshIntervalSecond int `json:",optional,default=60"`
+	// where rows are inserted: local inserts into TableName on any node of Addrs, distributed inserts into DistributedTableName,
+	// and shard inserts into TableName on the shard chosen by hashing the value of ShardingKey column, each of Addrs is a shard
+	Routing      string `json:",optional,default=local,options=local|distributed|shard"`
+	ShardingKey  string `json:",optional"`
+	ShardingHash string `json:",optional,default=murmur3,options=murmur3|fnv|crc32"`
+	// talk to clickhouse by the native TCP protocol, or by the HTTP interface which sends batches in HTTPFormat
+	Protocol        string `json:",optional,default=native,options=native|http"`
+	HTTPFormat      string `json:",optional,default=RowBinary,options=RowBinary|JSONEachRow"`
+	HTTPCompression string `json:",optional,default=gzip,options=none|gzip|zstd"`
 }
 
+// Filter is a filter of messages by Action, its fields may be dotted paths like a.b[0].c into nested objects and arrays
 type Filter struct {
-	Action     string      `json:",options=drop|remove_field|transfer|time_format"`
+	Action     string      `json:",options=drop|keep|sample|remove_field|transfer|time_format|eval|set|flatten|unflatten"`
 	Conditions []Condition `json:",optional"`
 	Fields     []string    `json:",optional"`
 	Field      string      `json:",optional"`
 	Target     string      `json:",optional"`
-	Layout     string      `json:",optional"`
+	Layout     string      `json:",optional"` // a go time layout, or one of unix, unix_ms, unix_us and unix_ns of time_format
 	Local      string      `json:",optional,default=Local"`
+	Percent    float64     `json:",optional,default=100"` // percent of messages kept by sample, hashed by Field if it is set
+	Expr       string      `json:",optional"`             // expression of eval, whose value is set to Field
+	Separator  string      `json:",optional,default=_"`   // what the keys of flatten and unflatten are joined by
+	MaxDepth   int         `json:",optional"`             // levels of objects flatten and unflatten go through, 0 means no limit
 }
 
 type KafkaConf struct {
@@ -61,23 +116,92 @@ type KafkaPusher struct {
 	Port int `json:",optional,default=10010"`
 }
 
+type DeadLetterConf struct {
+	Type    string   `json:",options=kafka|file"`
+	Brokers []string `json:",optional"`
+	Topic   string   `json:",optional"`
+	Path    string   `json:",optional"`
+}
+
 type Cluster struct {
-	Input   *Input
-	Filters []Filter `json:",optional"`
-	Output  *Output
+	Input      *Input
+	Filters    []Filter `json:",optional"`
+	Output     *Output
+	DeadLetter *DeadLetterConf `json:",optional"`
 }
 
 type Input struct {
-	Kafka *KafkaConf
+	Kafka   *KafkaConf
+	Decoder *DecoderConf `json:",optional"`
+}
+
+// DecoderConf tells how to decode kafka messages into rows
+type DecoderConf struct {
+	Format string `json:",optional,default=json,options=json|json_array|ndjson|csv|tsv|logfmt|protobuf|confluent"`
+	// names of csv and tsv fields in order, or take the first line of each message as names if Header is set
+	Columns   []string `json:",optional"`
+	Header    bool     `json:",optional"`
+	Delimiter string   `json:",optional"`
+	// descriptor set file generated by protoc --include_imports --descriptor_set_out, and full name of the message in it
+	ProtoDescriptorSet string `json:",optional"`
+	ProtoMessage       string `json:",optional"`
+	// where the schemas of avro and protobuf messages in confluent wire format are resolved
+	SchemaRegistry *SchemaRegistryConf `json:",optional"`
 }
 
+// SchemaRegistryConf is a Confluent compatible schema registry, or a directory of schema files laid out like its API
+type SchemaRegistryConf struct {
+	URL           string `json:",optional"`
+	Dir           string `json:",optional"`
+	Username      string `json:",optional"`
+	Password      string `json:",optional"`
+	TimeoutSecond int    `json:",optional,default=5"`
+	// requests are retried with exponential backoff while schema registry is unavailable, until it responds
+	RetryIntervalMillisecond int `json:",optional,default=500"`
+	MaxRetryIntervalSecond   int `json:",optional,default=30"`
+}
+
+// Output is where rows go after filters, rows fan out to every output configured
 type Output struct {
-	ClickHouse *ClickHouseConf
+	ClickHouse *ClickHouseConf   `json:",optional"`
+	File       *FileOutputConf   `json:",optional"`
+	Stdout     *StdoutOutputConf `json:",optional"`
+	Kafka      *KafkaOutputConf  `json:",optional"`
+}
+
+// FileOutputConf writes rows to a local file, which is rotated when it is larger than MaxSizeMB
+// or older than RotateIntervalMinute, 0 means never
+type FileOutputConf struct {
+	Path                 string
+	Format               string   `json:",optional,default=jsonl,options=jsonl|csv"`
+	Columns              []string `json:",optional"` // fields of rows in csv, in order
+	MaxSizeMB            int      `json:",optional,default=100"`
+	RotateIntervalMinute int      `json:",optional,default=60"`
+	MaxBackups           int      `json:",optional"` // number of rotated files to keep, 0 means all
+}
+
+// StdoutOutputConf prints rows to stdout for debugging
+type StdoutOutputConf struct {
+	WithMeta bool `json:",optional"` // print topic, partition and offset before each row
+}
+
+// KafkaOutputConf republishes rows to a kafka topic, in batches of BatchSize rows or every FlushIntervalMillisecond
+type KafkaOutputConf struct {
+	Brokers                  []string `json:",optional"` // the brokers of input if empty
+	Topic                    string
+	BatchSize                int `json:",optional,default=1000"`
+	FlushIntervalMillisecond int `json:",optional,default=100"`
+}
+
+type StatusConf struct {
+	Port int `json:",optional,default=10020"`
 }
 
 type Config struct {
 	Clusters          []*Cluster
-	GracePeriodSecond int `json:",optional,default=10"`
+	GracePeriodSecond int               `json:",optional,default=10"`
+	Prometheus        prometheus.Config `json:",optional"`
+	Status            *StatusConf       `json:",optional"`
 }
 
 // ReadConfig read config file and return a *Config
@@ -94,7 +218,7 @@ func ReadConfig(path string) (*Config, error) {
 func GetKafkaConf(c *KafkaConf) []*kq.KqConf {
 	ret := make([]*kq.KqConf, 0)
 	for _, topic := range c.Topics {
-		ret = append(ret, &kq.KqConf{
+		kc := &kq.KqConf{
 			ServiceConf: c.ServiceConf,
 			Brokers:     c.Brokers,
 			Group:       c.Group,
@@ -105,7 +229,10 @@ func GetKafkaConf(c *KafkaConf) []*kq.KqConf {
 			Processors:  c.Processors,
 			MinBytes:    c.MinBytes,
 			MaxBytes:    c.MaxBytes,
-		})
+		}
+		// the name of cluster labels the metrics of its consumers
+		kc.Name = c.Name
+		ret = append(ret, kc)
 	}
 	return ret
 }
@@ -0,0 +1,356 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/shopspring/decimal"
+)
+
+// avroType is a parsed avro schema
+type avroType struct {
+	kind     string // a primitive type, or record, enum, fixed, array, map, union
+	name     string // full name of record, enum and fixed
+	logical  string // logicalType
+	scale    int32  // scale of decimal
+	size     int    // size of fixed
+	fields   []*avroField
+	symbols  []string
+	items    *avroType // items of array, or values of map
+	branches []*avroType
+}
+
+type avroField struct {
+	name string
+	typ  *avroType
+}
+
+// avroSchemas keeps the named types, so that they can be referenced by name in later schemas
+type avroSchemas struct {
+	names map[string]*avroType
+}
+
+func newAvroSchemas() *avroSchemas {
+	return &avroSchemas{names: make(map[string]*avroType)}
+}
+
+// parse parses an avro schema in json, the named types in it are kept for the schemas parsed later
+func (s *avroSchemas) parse(schema string) (*avroType, error) {
+	var v interface{}
+	if err := jsoniter.UnmarshalFromString(schema, &v); err != nil {
+		return nil, fmt.Errorf("parse | unmarshal avro schema failed: %v", err)
+	}
+	t, err := s.parseType(v, "")
+	if err != nil {
+		return nil, fmt.Errorf("parse | parse avro schema failed: %v", err)
+	}
+	return t, nil
+}
+
+func (s *avroSchemas) parseType(v interface{}, namespace string) (*avroType, error) {
+	switch schema := v.(type) {
+	case string:
+		switch schema {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroType{kind: schema}, nil
+		}
+		if t, ok := s.names[fullName(schema, namespace)]; ok {
+			return t, nil
+		}
+		if t, ok := s.names[schema]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown type [%s]", schema)
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, branch := range schema {
+			bt, err := s.parseType(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			t.branches = append(t.branches, bt)
+		}
+		return t, nil
+	case map[string]interface{}:
+		return s.parseComplex(schema, namespace)
+	}
+	return nil, fmt.Errorf("invalid schema [%v]", v)
+}
+
+func (s *avroSchemas) parseComplex(schema map[string]interface{}, namespace string) (*avroType, error) {
+	kind, _ := schema["type"].(string)
+	logical, _ := schema["logicalType"].(string)
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := schema["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("%s without name", kind)
+		}
+		if ns, ok := schema["namespace"].(string); ok {
+			namespace = ns
+		}
+		name = fullName(name, namespace)
+		// the namespace of a full name is used by the types nested in it
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			namespace = name[:i]
+		}
+
+		t := &avroType{kind: kind, name: name, logical: logical}
+		// a record can reference itself in its fields
+		s.names[name] = t
+		switch kind {
+		case "record", "error":
+			t.kind = "record"
+			fields, _ := schema["fields"].([]interface{})
+			for _, f := range fields {
+				field, _ := f.(map[string]interface{})
+				fieldName, _ := field["name"].(string)
+				ft, err := s.parseType(field["type"], namespace)
+				if err != nil {
+					return nil, fmt.Errorf("field [%s] of record [%s]: %v", fieldName, name, err)
+				}
+				t.fields = append(t.fields, &avroField{name: fieldName, typ: ft})
+			}
+		case "enum":
+			symbols, _ := schema["symbols"].([]interface{})
+			for _, symbol := range symbols {
+				t.symbols = append(t.symbols, fmt.Sprint(symbol))
+			}
+		case "fixed":
+			size, _ := schema["size"].(float64)
+			t.size = int(size)
+			scale, _ := schema["scale"].(float64)
+			t.scale = int32(scale)
+		}
+		return t, nil
+	case "array", "map":
+		key := "items"
+		if kind == "map" {
+			key = "values"
+		}
+		items, err := s.parseType(schema[key], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroType{kind: kind, items: items}, nil
+	}
+
+	// a primitive type with attributes like logicalType
+	t, err := s.parseType(kind, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if t.name != "" || logical == "" {
+		return t, nil
+	}
+	scale, _ := schema["scale"].(float64)
+	return &avroType{kind: t.kind, logical: logical, scale: int32(scale)}, nil
+}
+
+// fullName qualifies name with namespace unless it is already qualified
+func fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+var errShortBuffer = errors.New("unexpected end of avro data")
+
+// avroReader reads values in avro binary encoding
+type avroReader struct {
+	buf []byte
+}
+
+// decodeAvro decodes data of record t into a row.
+// Timestamps become unix time in seconds and dates become unix time of the day, decimals become strings.
+func decodeAvro(t *avroType, data []byte) (map[string]interface{}, error) {
+	if t.kind != "record" {
+		return nil, fmt.Errorf("decodeAvro | schema of a row must be a record, but it is %s", t.kind)
+	}
+	r := &avroReader{buf: data}
+	v, err := r.read(t)
+	if err != nil {
+		return nil, fmt.Errorf("decodeAvro | decode record[%s] failed: %v", t.name, err)
+	}
+	if len(r.buf) > 0 {
+		return nil, fmt.Errorf("decodeAvro | %d bytes left after record[%s]", len(r.buf), t.name)
+	}
+	return v.(map[string]interface{}), nil
+}
+
+func (r *avroReader) read(t *avroType) (interface{}, error) {
+	switch t.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "int", "long":
+		n, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		return longValue(t, n), nil
+	case "float":
+		b, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		b, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes", "string":
+		n, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("negative length %d", n)
+		}
+		b, err := r.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == "string" {
+			return string(b), nil
+		}
+		return bytesValue(t, b), nil
+	case "fixed":
+		b, err := r.next(t.size)
+		if err != nil {
+			return nil, err
+		}
+		return bytesValue(t, b), nil
+	case "enum":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(t.symbols) {
+			return nil, fmt.Errorf("index %d out of symbols of enum [%s]", i, t.name)
+		}
+		return t.symbols[i], nil
+	case "union":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(t.branches) {
+			return nil, fmt.Errorf("index %d out of branches of union", i)
+		}
+		return r.read(t.branches[i])
+	case "array":
+		values := make([]interface{}, 0)
+		err := r.blocks(func() error {
+			v, err := r.read(t.items)
+			values = append(values, v)
+			return err
+		})
+		return values, err
+	case "map":
+		values := make(map[string]interface{})
+		err := r.blocks(func() error {
+			k, err := r.read(&avroType{kind: "string"})
+			if err != nil {
+				return err
+			}
+			v, err := r.read(t.items)
+			values[k.(string)] = v
+			return err
+		})
+		return values, err
+	case "record":
+		m := make(map[string]interface{}, len(t.fields))
+		for _, f := range t.fields {
+			v, err := r.read(f.typ)
+			if err != nil {
+				return nil, fmt.Errorf("field [%s]: %v", f.name, err)
+			}
+			m[f.name] = v
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown type [%s]", t.kind)
+}
+
+// blocks calls fn for each item of array or map, which are encoded in blocks
+func (r *avroReader) blocks(fn func() error) error {
+	for {
+		n, err := r.long()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		// a negative count is followed by the size of block in bytes
+		if n < 0 {
+			n = -n
+			if _, err := r.long(); err != nil {
+				return err
+			}
+		}
+		for i := int64(0); i < n; i++ {
+			if err := fn(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// long reads a zigzag encoded varint
+func (r *avroReader) long() (int64, error) {
+	n, size := binary.Varint(r.buf)
+	if size <= 0 {
+		return 0, errShortBuffer
+	}
+	r.buf = r.buf[size:]
+	return n, nil
+}
+
+func (r *avroReader) next(n int) ([]byte, error) {
+	if n > len(r.buf) {
+		return nil, errShortBuffer
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+// longValue converts n by the logical type of t
+func longValue(t *avroType, n int64) interface{} {
+	switch t.logical {
+	case "date":
+		return n * 86400
+	case "timestamp-millis", "local-timestamp-millis":
+		return float64(n) / 1e3
+	case "timestamp-micros", "local-timestamp-micros":
+		return float64(n) / 1e6
+	}
+	return n
+}
+
+// bytesValue converts b by the logical type of t, decimal is in two's complement big endian
+func bytesValue(t *avroType, b []byte) interface{} {
+	if t.logical != "decimal" {
+		return b
+	}
+	unscaled := new(big.Int).SetBytes(b)
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return decimal.NewFromBigInt(unscaled, -t.scale).String()
+}
@@ -0,0 +1,313 @@
+package decoder
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/syncx"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	// well known types which protobuf schemas import without references
+	_ "google.golang.org/protobuf/types/known/anypb"
+	_ "google.golang.org/protobuf/types/known/durationpb"
+	_ "google.golang.org/protobuf/types/known/emptypb"
+	_ "google.golang.org/protobuf/types/known/structpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+	_ "google.golang.org/protobuf/types/known/wrapperspb"
+
+	"go2ch/go2ch/config"
+)
+
+// magicByte leads the messages in Confluent wire format, followed by 4 bytes of schema id in big endian
+const magicByte = 0
+
+// failedSchemaTTL is how long the error of a schema failing to be resolved is cached, so that the messages of it
+// are rejected without requesting registry every time
+const failedSchemaTTL = time.Minute
+
+// codec decodes the payload after schema id into a row
+type codec func(payload []byte) (map[string]interface{}, error)
+
+// confluentDecoder decodes Avro or Protobuf messages in Confluent wire format,
+// the schemas are resolved from registry by the ids in messages and cached since they never change
+type confluentDecoder struct {
+	registry Registry
+	lock     sync.RWMutex
+	codecs   map[int]codec
+	failures map[int]failedSchema
+	// registry is requested once for concurrent messages of a new schema
+	flight syncx.SingleFlight
+	// the waiting time before requesting unavailable registry again, doubled each time up to maxRetryInterval
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+	closing          chan struct{} // closed by Close, which stops retrying
+	closeOnce        sync.Once
+}
+
+// failedSchema is the error of a schema failing to be resolved, which is cached until expire
+type failedSchema struct {
+	err    error
+	expire time.Time
+}
+
+func newConfluentDecoder(c *config.DecoderConf) (Decoder, error) {
+	if c.SchemaRegistry == nil {
+		return nil, errors.New("newConfluentDecoder | SchemaRegistry is required")
+	}
+	registry, err := NewRegistry(c.SchemaRegistry)
+	if err != nil {
+		return nil, err
+	}
+	d := NewConfluentDecoder(registry).(*confluentDecoder)
+	d.retryInterval = time.Duration(c.SchemaRegistry.RetryIntervalMillisecond) * time.Millisecond
+	d.maxRetryInterval = time.Duration(c.SchemaRegistry.MaxRetryIntervalSecond) * time.Second
+	return d, nil
+}
+
+// NewConfluentDecoder creates a decoder of Confluent wire format which resolves schemas from registry
+func NewConfluentDecoder(registry Registry) Decoder {
+	return &confluentDecoder{
+		registry:         registry,
+		codecs:           make(map[int]codec),
+		failures:         make(map[int]failedSchema),
+		flight:           syncx.NewSingleFlight(),
+		retryInterval:    500 * time.Millisecond,
+		maxRetryInterval: 30 * time.Second,
+		closing:          make(chan struct{}),
+	}
+}
+
+// Close stops waiting for schema registry, the messages waiting for it fail with ErrClosed
+func (d *confluentDecoder) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closing)
+	})
+	return nil
+}
+
+func (d *confluentDecoder) Decode(value []byte) ([]map[string]interface{}, error) {
+	if len(value) < 5 || value[0] != magicByte {
+		return nil, errors.New("decode | value is not in confluent wire format")
+	}
+	id := int(binary.BigEndian.Uint32(value[1:5]))
+
+	c, err := d.codec(id)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c(value[5:])
+	if err != nil {
+		return nil, fmt.Errorf("decode | decode value of schema[%d] failed: %v", id, err)
+	}
+	return []map[string]interface{}{m}, nil
+}
+
+// codec returns the codec of schema id, it is built from registry at the first time.
+// While registry is unavailable, it keeps retrying instead of failing the message, which holds up consuming,
+// until the decoder is closed.
+func (d *confluentDecoder) codec(id int) (codec, error) {
+	interval := d.retryInterval
+	for {
+		c, err := d.resolve(id)
+		if err == nil || !errors.Is(err, ErrRegistryUnavailable) {
+			return c, err
+		}
+		logx.Errorf("codec | %v, retry in %v", err, interval)
+		select {
+		case <-time.After(interval):
+		case <-d.closing:
+			return nil, fmt.Errorf("codec | %w: %v", ErrClosed, err)
+		}
+		if interval *= 2; interval > d.maxRetryInterval {
+			interval = d.maxRetryInterval
+		}
+	}
+}
+
+// resolve returns the cached codec of schema id, or builds it from registry.
+// The error of a schema which can not be resolved, other than registry being unavailable, is cached for failedSchemaTTL.
+func (d *confluentDecoder) resolve(id int) (codec, error) {
+	d.lock.RLock()
+	c, ok := d.codecs[id]
+	failure, failed := d.failures[id]
+	d.lock.RUnlock()
+	if ok {
+		return c, nil
+	}
+	if failed && time.Now().Before(failure.expire) {
+		return nil, fmt.Errorf("resolve | resolve schema[%d] failed: %w", id, failure.err)
+	}
+
+	v, err := d.flight.Do(strconv.Itoa(id), func() (interface{}, error) {
+		c, err := d.build(id)
+		if err != nil {
+			if !errors.Is(err, ErrRegistryUnavailable) {
+				d.lock.Lock()
+				d.failures[id] = failedSchema{err: err, expire: time.Now().Add(failedSchemaTTL)}
+				d.lock.Unlock()
+			}
+			return nil, err
+		}
+		d.lock.Lock()
+		d.codecs[id] = c
+		delete(d.failures, id)
+		d.lock.Unlock()
+		return c, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("resolve | resolve schema[%d] failed: %w", id, err)
+	}
+	return v.(codec), nil
+}
+
+// build requests schema id from registry and builds its codec
+func (d *confluentDecoder) build(id int) (codec, error) {
+	s, err := d.registry.SchemaByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return d.newCodec(s)
+}
+
+func (d *confluentDecoder) newCodec(s *Schema) (codec, error) {
+	switch s.SchemaType {
+	case "", SchemaTypeAvro:
+		schemas := newAvroSchemas()
+		if err := d.parseAvroReferences(schemas, s.References); err != nil {
+			return nil, err
+		}
+		t, err := schemas.parse(s.Schema)
+		if err != nil {
+			return nil, err
+		}
+		return func(payload []byte) (map[string]interface{}, error) {
+			return decodeAvro(t, payload)
+		}, nil
+	case SchemaTypeProtobuf:
+		files := new(protoregistry.Files)
+		fd, err := d.buildProtoFile(files, s)
+		if err != nil {
+			return nil, err
+		}
+		return func(payload []byte) (map[string]interface{}, error) {
+			md, payload, err := findIndexedMessage(fd, payload)
+			if err != nil {
+				return nil, err
+			}
+			return DecodeProtobuf(md, payload)
+		}, nil
+	default:
+		return nil, fmt.Errorf("newCodec | unsupported schema type [%s]", s.SchemaType)
+	}
+}
+
+// parseAvroReferences parses the referenced schemas in order, so that their types can be used by name
+func (d *confluentDecoder) parseAvroReferences(schemas *avroSchemas, refs []SchemaReference) error {
+	for _, ref := range refs {
+		s, err := d.registry.SchemaByVersion(ref.Subject, ref.Version)
+		if err != nil {
+			return err
+		}
+		if err := d.parseAvroReferences(schemas, s.References); err != nil {
+			return err
+		}
+		if _, err := schemas.parse(s.Schema); err != nil {
+			return fmt.Errorf("parseAvroReferences | parse reference[%s] failed: %v", ref.Name, err)
+		}
+	}
+	return nil
+}
+
+// buildProtoFile builds the file descriptor of s after the files it imports, and registers it in files
+func (d *confluentDecoder) buildProtoFile(files *protoregistry.Files, s *Schema) (protoreflect.FileDescriptor, error) {
+	bs, err := base64.StdEncoding.DecodeString(s.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("buildProtoFile | protobuf schema must be serialized in base64: %v", err)
+	}
+	var fdp descriptorpb.FileDescriptorProto
+	if err := proto.Unmarshal(bs, &fdp); err != nil {
+		return nil, fmt.Errorf("buildProtoFile | unmarshal file descriptor failed: %v", err)
+	}
+
+	for _, ref := range s.References {
+		if _, err := files.FindFileByPath(ref.Name); err == nil {
+			continue
+		}
+		rs, err := d.registry.SchemaByVersion(ref.Subject, ref.Version)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := d.buildProtoFile(files, rs); err != nil {
+			return nil, fmt.Errorf("buildProtoFile | build reference[%s] failed: %w", ref.Name, err)
+		}
+	}
+
+	fd, err := protodesc.NewFile(&fdp, protoResolver{files})
+	if err != nil {
+		return nil, fmt.Errorf("buildProtoFile | build file descriptor[%s] failed: %v", fdp.GetName(), err)
+	}
+	if err := files.RegisterFile(fd); err != nil {
+		return nil, fmt.Errorf("buildProtoFile | register file descriptor[%s] failed: %v", fdp.GetName(), err)
+	}
+	return fd, nil
+}
+
+// protoResolver resolves the referenced files, and then the well known types
+type protoResolver struct {
+	files *protoregistry.Files
+}
+
+func (r protoResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.files.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r protoResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if desc, err := r.files.FindDescriptorByName(name); err == nil {
+		return desc, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+// findIndexedMessage reads the message indexes leading the payload, which locate the message type in fd,
+// they are a count and the indexes in zigzag varints, and a single 0 means the first message
+func findIndexedMessage(fd protoreflect.FileDescriptor, payload []byte) (protoreflect.MessageDescriptor, []byte, error) {
+	n, size := binary.Varint(payload)
+	if size <= 0 || n < 0 {
+		return nil, nil, errors.New("findIndexedMessage | invalid message indexes")
+	}
+	payload = payload[size:]
+	indexes := []int64{0}
+	if n > 0 {
+		indexes = make([]int64, n)
+		for i := range indexes {
+			indexes[i], size = binary.Varint(payload)
+			if size <= 0 {
+				return nil, nil, errors.New("findIndexedMessage | invalid message indexes")
+			}
+			payload = payload[size:]
+		}
+	}
+
+	messages := fd.Messages()
+	var md protoreflect.MessageDescriptor
+	for _, i := range indexes {
+		if i < 0 || int(i) >= messages.Len() {
+			return nil, nil, fmt.Errorf("findIndexedMessage | message index %v out of file[%s]", indexes, fd.Path())
+		}
+		md = messages.Get(int(i))
+		messages = md.Messages()
+	}
+	return md, payload, nil
+}
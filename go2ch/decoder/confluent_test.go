@@ -0,0 +1,273 @@
+package decoder
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"go2ch/go2ch/config"
+)
+
+const eventSchema = `{
+	"type": "record",
+	"name": "Event",
+	"namespace": "logger",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "msg", "type": ["null", "string"]},
+		{"name": "level", "type": "Level"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "attrs", "type": {"type": "map", "values": "int"}},
+		{"name": "amount", "type": {"type": "bytes", "logicalType": "decimal", "precision": 9, "scale": 2}},
+		{"name": "ts", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "ratio", "type": "double"},
+		{"name": "ok", "type": "boolean"}
+	]
+}`
+
+const levelSchema = `{"type": "enum", "name": "Level", "namespace": "logger", "symbols": ["INFO", "WARN"]}`
+
+// writeSchema writes s into the file registry at dir like the response of path in schema registry
+func writeSchema(t *testing.T, dir, path string, s *Schema) {
+	bs, err := jsoniter.Marshal(s)
+	assert.Nil(t, err)
+	path = filepath.Join(dir, path)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, bs, 0644))
+}
+
+// avroLong encodes n in zigzag varint
+func avroLong(n int64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutVarint(b, n)]
+}
+
+func avroString(s string) []byte {
+	return append(avroLong(int64(len(s))), s...)
+}
+
+// frame frames payload in confluent wire format of schema id
+func frame(id int, payload ...[]byte) []byte {
+	value := []byte{magicByte, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(value[1:], uint32(id))
+	for _, p := range payload {
+		value = append(value, p...)
+	}
+	return value
+}
+
+func TestConfluentAvro(t *testing.T) {
+	dir := t.TempDir()
+	writeSchema(t, dir, "schemas/ids/1.json", &Schema{
+		Schema:     eventSchema,
+		References: []SchemaReference{{Name: "logger.Level", Subject: "level", Version: 1}},
+	})
+	writeSchema(t, dir, "subjects/level/versions/1.json", &Schema{Schema: levelSchema})
+
+	d, err := NewDecoder(&config.DecoderConf{Format: FormatConfluent, SchemaRegistry: &config.SchemaRegistryConf{Dir: dir}})
+	assert.Nil(t, err)
+
+	ratio := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ratio, math.Float64bits(0.5))
+	value := frame(1,
+		avroLong(42),
+		avroLong(1), avroString("hello"),
+		avroLong(1),
+		avroLong(2), avroString("a"), avroString("b"), avroLong(0),
+		avroLong(-1), avroLong(3), avroString("k"), avroLong(-7), avroLong(0),
+		avroLong(2), []byte{0xfb, 0x2e}, // -1234
+		avroLong(1650000000123),
+		ratio,
+		[]byte{1},
+	)
+	rows, err := d.Decode(value)
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{
+		"id":     int64(42),
+		"msg":    "hello",
+		"level":  "WARN",
+		"tags":   []interface{}{"a", "b"},
+		"attrs":  map[string]interface{}{"k": int64(-7)},
+		"amount": "-12.34",
+		"ts":     1650000000.123,
+		"ratio":  0.5,
+		"ok":     true,
+	}}, rows)
+
+	// truncated payload
+	_, err = d.Decode(value[:len(value)-1])
+	assert.NotNil(t, err)
+	// not in wire format
+	_, err = d.Decode([]byte(`{"id":1}`))
+	assert.NotNil(t, err)
+	// unknown schema
+	_, err = d.Decode(frame(2, avroLong(1)))
+	assert.NotNil(t, err)
+}
+
+func TestConfluentProtobuf(t *testing.T) {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("event.proto"),
+		Package:    proto.String("logger"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Other")},
+			{
+				Name: proto.String("Batch"),
+				NestedType: []*descriptorpb.DescriptorProto{{
+					Name: proto.String("Event"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						{Name: proto.String("id"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_UINT32.Enum()},
+						{Name: proto.String("ts"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(), TypeName: proto.String(".google.protobuf.Timestamp")},
+					},
+				}},
+			},
+		},
+	}
+	bs, err := proto.Marshal(file)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	writeSchema(t, dir, "schemas/ids/7.json", &Schema{SchemaType: SchemaTypeProtobuf, Schema: base64.StdEncoding.EncodeToString(bs)})
+	registry, err := NewRegistry(&config.SchemaRegistryConf{Dir: dir})
+	assert.Nil(t, err)
+	d := NewConfluentDecoder(registry)
+
+	fd, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	assert.Nil(t, err)
+	md := fd.Messages().ByName("Batch").Messages().ByName("Event")
+	msg := dynamicpb.NewMessage(md)
+	msg.Set(md.Fields().ByName("id"), protoreflect.ValueOfUint32(9))
+	ts := msg.Mutable(md.Fields().ByName("ts")).Message()
+	ts.Set(ts.Descriptor().Fields().ByName("seconds"), protoreflect.ValueOfInt64(1650000000))
+	ts.Set(ts.Descriptor().Fields().ByName("nanos"), protoreflect.ValueOfInt32(500000000))
+	payload, err := proto.Marshal(msg)
+	assert.Nil(t, err)
+
+	// message indexes [1, 0] locate Batch.Event
+	rows, err := d.Decode(frame(7, avroLong(2), avroLong(1), avroLong(0), payload))
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{"id": uint64(9), "ts": 1650000000.5}}, rows)
+
+	// index out of file
+	_, err = d.Decode(frame(7, avroLong(1), avroLong(5), payload))
+	assert.NotNil(t, err)
+	// a single 0 is the first message, which has no fields
+	rows, err = d.Decode(frame(7, avroLong(0)))
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{}}, rows)
+}
+
+func TestHTTPRegistry(t *testing.T) {
+	var requests, unavailable int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if user, password, _ := r.BasicAuth(); user != "u" || password != "p" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/schemas/ids/5":
+			// unavailable for the first two requests
+			if atomic.AddInt32(&unavailable, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fallthrough
+		case "/schemas/ids/3":
+			_, _ = w.Write([]byte(`{"schema": "{\"type\":\"record\",\"name\":\"R\",\"fields\":[{\"name\":\"a\",\"type\":\"int\"}]}"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	d, err := NewDecoder(&config.DecoderConf{
+		Format: FormatConfluent,
+		SchemaRegistry: &config.SchemaRegistryConf{
+			URL:                      server.URL + "/",
+			Username:                 "u",
+			Password:                 "p",
+			TimeoutSecond:            5,
+			RetryIntervalMillisecond: 1,
+			MaxRetryIntervalSecond:   1,
+		},
+	})
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		rows, err := d.Decode(frame(3, avroLong(int64(i))))
+		assert.Nil(t, err)
+		assert.Equal(t, []map[string]interface{}{{"a": int64(i)}}, rows)
+	}
+	// the schema is cached after the first request
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// the schema which is not found is rejected right away, and the failure is cached
+	_, err = d.Decode(frame(4, avroLong(1)))
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrRegistryUnavailable))
+	_, err = d.Decode(frame(4, avroLong(2)))
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// the registry is requested again until it is available, rather than the message is rejected
+	rows, err := d.Decode(frame(5, avroLong(7)))
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{"a": int64(7)}}, rows)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&unavailable))
+}
+
+func TestConfluentClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	d, err := NewDecoder(&config.DecoderConf{
+		Format: FormatConfluent,
+		SchemaRegistry: &config.SchemaRegistryConf{
+			URL:                      server.URL,
+			TimeoutSecond:            5,
+			RetryIntervalMillisecond: 1000,
+			MaxRetryIntervalSecond:   60,
+		},
+	})
+	assert.Nil(t, err)
+
+	// closing stops waiting for the registry which is unavailable
+	errs := make(chan error, 1)
+	go func() {
+		_, err := d.Decode(frame(3, avroLong(1)))
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, d.(io.Closer).Close())
+	select {
+	case err := <-errs:
+		assert.True(t, errors.Is(err, ErrClosed))
+	case <-time.After(time.Second):
+		t.Fatal("decoding is not stopped by closing")
+	}
+}
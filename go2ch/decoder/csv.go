@@ -0,0 +1,130 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"go2ch/go2ch/config"
+)
+
+// csvDecoder decodes each record of csv or tsv into a row, the values are kept in strings.
+// tsv is in the TabSeparated format of clickhouse, which escapes special characters by backslash instead of quoting.
+type csvDecoder struct {
+	comma   rune
+	tsv     bool
+	header  bool
+	columns []string
+}
+
+func newCSVDecoder(c *config.DecoderConf) (Decoder, error) {
+	d := &csvDecoder{comma: ',', header: c.Header, columns: c.Columns}
+	if c.Format == FormatTSV {
+		d.comma = '\t'
+		d.tsv = true
+	}
+	if c.Delimiter != "" {
+		r, size := utf8.DecodeRuneInString(c.Delimiter)
+		if size != len(c.Delimiter) || r == utf8.RuneError {
+			return nil, fmt.Errorf("newCSVDecoder | delimiter [%s] must be a single character", c.Delimiter)
+		}
+		d.comma = r
+	}
+	if !d.header && len(d.columns) == 0 {
+		return nil, errors.New("newCSVDecoder | either columns or header is required")
+	}
+	return d, nil
+}
+
+// Decode decodes records in value, the first record is the names of fields if header is set,
+// and the fields which are not in a record are left out of its row
+func (d *csvDecoder) Decode(value []byte) ([]map[string]interface{}, error) {
+	read := d.csvReader(value)
+	if d.tsv {
+		read = d.tsvReader(value)
+	}
+
+	columns := d.columns
+	var rows []map[string]interface{}
+	for n := 1; ; n++ {
+		record, err := read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode | read record %d failed: %v", n, err)
+		}
+		if d.header && columns == nil {
+			columns = make([]string, len(record))
+			for i, field := range record {
+				name, ok := field.(string)
+				if !ok {
+					return nil, fmt.Errorf("decode | null name of column %d in header", i+1)
+				}
+				columns[i] = name
+			}
+			continue
+		}
+		if len(record) > len(columns) {
+			return nil, fmt.Errorf("decode | record %d has %d fields, but there are %d columns", n, len(record), len(columns))
+		}
+
+		m := make(map[string]interface{}, len(record))
+		for i, field := range record {
+			m[columns[i]] = field
+		}
+		rows = append(rows, m)
+	}
+	return rows, nil
+}
+
+// csvReader returns a function which reads a record of csv from value each time, and io.EOF at the end
+func (d *csvDecoder) csvReader(value []byte) func() ([]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(value))
+	r.Comma = d.comma
+	r.FieldsPerRecord = -1
+	return func() ([]interface{}, error) {
+		record, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]interface{}, len(record))
+		for i, field := range record {
+			fields[i] = field
+		}
+		return fields, nil
+	}
+}
+
+// tsvReader returns a function which reads a line of tsv from value each time, and io.EOF at the end,
+// \N is taken as null and empty lines are skipped
+func (d *csvDecoder) tsvReader(value []byte) func() ([]interface{}, error) {
+	lines := strings.Split(string(value), "\n")
+	return func() ([]interface{}, error) {
+		var line string
+		for line == "" {
+			if len(lines) == 0 {
+				return nil, io.EOF
+			}
+			line = strings.TrimSuffix(lines[0], "\r")
+			lines = lines[1:]
+		}
+
+		record := strings.Split(line, string(d.comma))
+		fields := make([]interface{}, len(record))
+		for i, field := range record {
+			if field == `\N` {
+				continue
+			}
+			fields[i] = tsvUnescaper.Replace(field)
+		}
+		return fields, nil
+	}
+}
+
+// tsvUnescaper unescapes the special characters in tsv fields
+var tsvUnescaper = strings.NewReplacer(`\t`, "\t", `\n`, "\n", `\r`, "\r", `\0`, "\x00", `\'`, "'", `\\`, `\`)
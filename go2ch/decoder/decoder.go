@@ -0,0 +1,74 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"go2ch/go2ch/config"
+)
+
+// formats of kafka messages
+const (
+	FormatJSON      = "json"       // a json object
+	FormatJSONArray = "json_array" // a json array of objects, or a json object
+	FormatNDJSON    = "ndjson"     // json objects separated by new lines
+	FormatCSV       = "csv"        // lines of comma separated values
+	FormatTSV       = "tsv"        // lines of tab separated values
+	FormatLogfmt    = "logfmt"     // lines of key=value pairs
+	FormatProtobuf  = "protobuf"   // a protobuf message
+	FormatConfluent = "confluent"  // an avro or protobuf message in confluent wire format
+)
+
+// ErrClosed tells the decoder is closed while the message is being decoded, it is left to be consumed again
+var ErrClosed = errors.New("decoder is closed")
+
+// Decoder decodes a kafka message into zero or more rows.
+// A decoder which waits for external services, like schema registry, implements io.Closer to stop waiting on shutdown.
+type Decoder interface {
+	Decode(value []byte) ([]map[string]interface{}, error)
+}
+
+// Factory creates a decoder by configuration
+type Factory func(c *config.DecoderConf) (Decoder, error)
+
+var (
+	lock      sync.RWMutex
+	factories = map[string]Factory{
+		FormatJSON:      newJSONDecoder,
+		FormatJSONArray: newJSONArrayDecoder,
+		FormatNDJSON:    newNDJSONDecoder,
+		FormatCSV:       newCSVDecoder,
+		FormatTSV:       newCSVDecoder,
+		FormatLogfmt:    newLogfmtDecoder,
+		FormatProtobuf:  newProtobufDecoder,
+		FormatConfluent: newConfluentDecoder,
+	}
+)
+
+// Register registers the factory of decoders for format, so that format can be used in configuration
+func Register(format string, factory Factory) {
+	lock.Lock()
+	defer lock.Unlock()
+	factories[format] = factory
+}
+
+// NewDecoder creates the decoder of format in c, it decodes json objects if c is nil
+func NewDecoder(c *config.DecoderConf) (Decoder, error) {
+	if c == nil {
+		c = &config.DecoderConf{Format: FormatJSON}
+	}
+
+	lock.RLock()
+	factory, ok := factories[c.Format]
+	lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("newDecoder | unknown format [%s]", c.Format)
+	}
+
+	d, err := factory(c)
+	if err != nil {
+		return nil, fmt.Errorf("newDecoder | create decoder of format [%s] failed: %v", c.Format, err)
+	}
+	return d, nil
+}
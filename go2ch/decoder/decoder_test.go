@@ -0,0 +1,203 @@
+package decoder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"go2ch/go2ch/config"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   *config.DecoderConf
+		value  string
+		expect []map[string]interface{}
+		err    bool
+	}{
+		{
+			name:   "default",
+			value:  `{"a":1}`,
+			expect: []map[string]interface{}{{"a": float64(1)}},
+		},
+		{
+			name:  "json not object",
+			conf:  &config.DecoderConf{Format: FormatJSON},
+			value: `[{"a":1}]`,
+			err:   true,
+		},
+		{
+			name:   "json array",
+			conf:   &config.DecoderConf{Format: FormatJSONArray},
+			value:  ` [{"a":1}, null, {"a":2}]`,
+			expect: []map[string]interface{}{{"a": float64(1)}, {"a": float64(2)}},
+		},
+		{
+			name:   "json array of single object",
+			conf:   &config.DecoderConf{Format: FormatJSONArray},
+			value:  `{"a":1}`,
+			expect: []map[string]interface{}{{"a": float64(1)}},
+		},
+		{
+			name:   "empty json array",
+			conf:   &config.DecoderConf{Format: FormatJSONArray},
+			value:  `[]`,
+			expect: []map[string]interface{}{},
+		},
+		{
+			name:   "ndjson",
+			conf:   &config.DecoderConf{Format: FormatNDJSON},
+			value:  "{\"a\":1}\n\n{\"a\":2}\n",
+			expect: []map[string]interface{}{{"a": float64(1)}, {"a": float64(2)}},
+		},
+		{
+			name:   "ndjson with null line",
+			conf:   &config.DecoderConf{Format: FormatNDJSON},
+			value:  "{\"a\":1}\nnull\n{\"a\":2}\n",
+			expect: []map[string]interface{}{{"a": float64(1)}, {"a": float64(2)}},
+		},
+		{
+			name:  "json null",
+			conf:  &config.DecoderConf{Format: FormatJSON},
+			value: `null`,
+		},
+		{
+			name:  "bad ndjson",
+			conf:  &config.DecoderConf{Format: FormatNDJSON},
+			value: "{\"a\":1}\n{\"a\":",
+			err:   true,
+		},
+		{
+			name:   "csv with columns",
+			conf:   &config.DecoderConf{Format: FormatCSV, Columns: []string{"a", "b", "c"}},
+			value:  "1,\"x,y\",z\n2,w\n",
+			expect: []map[string]interface{}{{"a": "1", "b": "x,y", "c": "z"}, {"a": "2", "b": "w"}},
+		},
+		{
+			name:   "csv with header and delimiter",
+			conf:   &config.DecoderConf{Format: FormatCSV, Header: true, Delimiter: ";"},
+			value:  "a;b\n1;2\n",
+			expect: []map[string]interface{}{{"a": "1", "b": "2"}},
+		},
+		{
+			name:  "csv with too many fields",
+			conf:  &config.DecoderConf{Format: FormatCSV, Columns: []string{"a"}},
+			value: "1,2\n",
+			err:   true,
+		},
+		{
+			name:   "tsv",
+			conf:   &config.DecoderConf{Format: FormatTSV, Columns: []string{"a", "b", "c"}},
+			value:  "1\t\"x\\ty\t\\N\n\n2\n",
+			expect: []map[string]interface{}{{"a": "1", "b": "\"x\ty", "c": nil}, {"a": "2"}},
+		},
+		{
+			name:  "tsv with null in header",
+			conf:  &config.DecoderConf{Format: FormatTSV, Header: true},
+			value: "a\t\\N\n1\t2\n",
+			err:   true,
+		},
+		{
+			name:   "logfmt",
+			conf:   &config.DecoderConf{Format: FormatLogfmt},
+			value:  "level=info msg=\"hello \\\"world\\\"\" debug\nlevel=warn empty=\n",
+			expect: []map[string]interface{}{{"level": "info", "msg": "hello \"world\"", "debug": true}, {"level": "warn", "empty": ""}},
+		},
+		{
+			name:  "bad logfmt",
+			conf:  &config.DecoderConf{Format: FormatLogfmt},
+			value: `msg="hello`,
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := NewDecoder(test.conf)
+			assert.Nil(t, err)
+
+			rows, err := d.Decode([]byte(test.value))
+			if test.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, rows)
+		})
+	}
+}
+
+func TestNewDecoder(t *testing.T) {
+	_, err := NewDecoder(&config.DecoderConf{Format: "xml"})
+	assert.NotNil(t, err)
+	_, err = NewDecoder(&config.DecoderConf{Format: FormatCSV})
+	assert.NotNil(t, err)
+	_, err = NewDecoder(&config.DecoderConf{Format: FormatCSV, Columns: []string{"a"}, Delimiter: ";;"})
+	assert.NotNil(t, err)
+	_, err = NewDecoder(&config.DecoderConf{Format: FormatProtobuf})
+	assert.NotNil(t, err)
+}
+
+func TestProtobufDecoder(t *testing.T) {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("event.proto"),
+		Package: proto.String("logger"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Level"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("INFO"), Number: proto.Int32(0)},
+				{Name: proto.String("WARN"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Event"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("id"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()},
+				{Name: proto.String("msg"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+				{Name: proto.String("level"), Number: proto.Int32(3), Type: descriptorpb.FieldDescriptorProto_TYPE_ENUM.Enum(), TypeName: proto.String(".logger.Level")},
+				{Name: proto.String("tags"), Number: proto.Int32(4), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()},
+			},
+		}},
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}}
+	bs, err := proto.Marshal(set)
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "event.desc")
+	assert.Nil(t, ioutil.WriteFile(path, bs, 0644))
+
+	d, err := NewDecoder(&config.DecoderConf{Format: FormatProtobuf, ProtoDescriptorSet: path, ProtoMessage: "logger.Event"})
+	assert.Nil(t, err)
+
+	// build a message to decode
+	fd, err := protodesc.NewFile(file, nil)
+	assert.Nil(t, err)
+	md := fd.Messages().ByName("Event")
+	msg := dynamicpb.NewMessage(md)
+	msg.Set(md.Fields().ByName("id"), protoreflect.ValueOfInt64(42))
+	msg.Set(md.Fields().ByName("level"), protoreflect.ValueOfEnum(1))
+	tags := msg.Mutable(md.Fields().ByName("tags")).List()
+	tags.Append(protoreflect.ValueOfString("a"))
+	value, err := proto.Marshal(msg)
+	assert.Nil(t, err)
+
+	rows, err := d.Decode(value)
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{
+		"id":    int64(42),
+		"msg":   "",
+		"level": "WARN",
+		"tags":  []interface{}{"a"},
+	}}, rows)
+
+	_, err = d.Decode([]byte{0xff})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,102 @@
+package decoder
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"go2ch/go2ch/config"
+)
+
+// maxLineBytes is the max length of a line in ndjson, csv, tsv and logfmt messages
+const maxLineBytes = 10 * 1024 * 1024
+
+// jsonDecoder decodes a json object into a row
+type jsonDecoder struct{}
+
+func newJSONDecoder(c *config.DecoderConf) (Decoder, error) {
+	return jsonDecoder{}, nil
+}
+
+func (jsonDecoder) Decode(value []byte) ([]map[string]interface{}, error) {
+	var m map[string]interface{}
+	if err := jsoniter.Unmarshal(value, &m); err != nil {
+		return nil, fmt.Errorf("decode | unmarshal json object failed: %v", err)
+	}
+	// null is not a row
+	if m == nil {
+		return nil, nil
+	}
+	return []map[string]interface{}{m}, nil
+}
+
+// jsonArrayDecoder decodes each object in a json array into a row, a single json object is also accepted
+type jsonArrayDecoder struct{}
+
+func newJSONArrayDecoder(c *config.DecoderConf) (Decoder, error) {
+	return jsonArrayDecoder{}, nil
+}
+
+func (jsonArrayDecoder) Decode(value []byte) ([]map[string]interface{}, error) {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 || value[0] != '[' {
+		return jsonDecoder{}.Decode(value)
+	}
+
+	var ms []map[string]interface{}
+	if err := jsoniter.Unmarshal(value, &ms); err != nil {
+		return nil, fmt.Errorf("decode | unmarshal json array failed: %v", err)
+	}
+	rows := ms[:0]
+	for _, m := range ms {
+		// null in array is not a row
+		if m != nil {
+			rows = append(rows, m)
+		}
+	}
+	return rows, nil
+}
+
+// ndjsonDecoder decodes each line of json object into a row, blank and null lines are skipped
+type ndjsonDecoder struct{}
+
+func newNDJSONDecoder(c *config.DecoderConf) (Decoder, error) {
+	return ndjsonDecoder{}, nil
+}
+
+func (ndjsonDecoder) Decode(value []byte) ([]map[string]interface{}, error) {
+	var rows []map[string]interface{}
+	err := scanLines(value, func(n int, line []byte) error {
+		var m map[string]interface{}
+		if err := jsoniter.Unmarshal(line, &m); err != nil {
+			return fmt.Errorf("decode | unmarshal json object at line %d failed: %v", n, err)
+		}
+		// null line is not a row
+		if m != nil {
+			rows = append(rows, m)
+		}
+		return nil
+	})
+	return rows, err
+}
+
+// scanLines calls fn with each non-blank line of value and its line number which starts from 1
+func scanLines(value []byte, fn func(n int, line []byte) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(value))
+	scanner.Buffer(nil, maxLineBytes)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(n, line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scanLines | read lines failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package decoder
+
+import (
+	"fmt"
+	"strconv"
+
+	"go2ch/go2ch/config"
+)
+
+// logfmtDecoder decodes each line of key=value pairs into a row, the values are kept in strings,
+// and a key without value is taken as true
+type logfmtDecoder struct{}
+
+func newLogfmtDecoder(c *config.DecoderConf) (Decoder, error) {
+	return logfmtDecoder{}, nil
+}
+
+func (logfmtDecoder) Decode(value []byte) ([]map[string]interface{}, error) {
+	var rows []map[string]interface{}
+	err := scanLines(value, func(n int, line []byte) error {
+		m, err := parseLogfmt(string(line))
+		if err != nil {
+			return fmt.Errorf("decode | parse logfmt at line %d failed: %v", n, err)
+		}
+		rows = append(rows, m)
+		return nil
+	})
+	return rows, err
+}
+
+// parseLogfmt parses a line like `level=info msg="hello world" debug`
+func parseLogfmt(line string) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			return nil, fmt.Errorf("empty key at position %d", start)
+		}
+		if i == len(line) || line[i] != '=' {
+			m[key] = true
+			continue
+		}
+
+		// skip '='
+		i++
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted value of key [%s]", key)
+			}
+			v, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("unquote value of key [%s] failed: %v", key, err)
+			}
+			m[key] = v
+			i = end + 1
+			continue
+		}
+
+		start = i
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		m[key] = line[start:i]
+	}
+	return m, nil
+}
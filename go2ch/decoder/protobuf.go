@@ -0,0 +1,154 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"go2ch/go2ch/config"
+)
+
+const timestampName = "google.protobuf.Timestamp"
+
+// protobufDecoder decodes a protobuf message into a row, the message type is read from a descriptor set file
+type protobufDecoder struct {
+	desc protoreflect.MessageDescriptor
+}
+
+func newProtobufDecoder(c *config.DecoderConf) (Decoder, error) {
+	if c.ProtoDescriptorSet == "" || c.ProtoMessage == "" {
+		return nil, errors.New("newProtobufDecoder | ProtoDescriptorSet and ProtoMessage are required")
+	}
+	desc, err := LoadMessageDescriptor(c.ProtoDescriptorSet, c.ProtoMessage)
+	if err != nil {
+		return nil, err
+	}
+	return &protobufDecoder{desc: desc}, nil
+}
+
+func (d *protobufDecoder) Decode(value []byte) ([]map[string]interface{}, error) {
+	m, err := DecodeProtobuf(d.desc, value)
+	if err != nil {
+		return nil, err
+	}
+	return []map[string]interface{}{m}, nil
+}
+
+// LoadMessageDescriptor finds the message named name in the descriptor set file at path,
+// which is generated by `protoc --include_imports --descriptor_set_out`
+func LoadMessageDescriptor(path, name string) (protoreflect.MessageDescriptor, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadMessageDescriptor | read descriptor set[%s] failed: %v", path, err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(bs, &set); err != nil {
+		return nil, fmt.Errorf("loadMessageDescriptor | unmarshal descriptor set[%s] failed: %v", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("loadMessageDescriptor | build descriptors of [%s] failed: %v", path, err)
+	}
+	return findMessage(files, name)
+}
+
+// findMessage finds the message named name in files
+func findMessage(files *protoregistry.Files, name string) (protoreflect.MessageDescriptor, error) {
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("findMessage | find message[%s] failed: %v", name, err)
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("findMessage | [%s] is not a message", name)
+	}
+	return md, nil
+}
+
+// DecodeProtobuf unmarshals value into a message of desc and converts it to a row
+func DecodeProtobuf(desc protoreflect.MessageDescriptor, value []byte) (map[string]interface{}, error) {
+	msg := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(value, msg); err != nil {
+		return nil, fmt.Errorf("decodeProtobuf | unmarshal message[%s] failed: %v", desc.FullName(), err)
+	}
+	return messageToMap(msg), nil
+}
+
+// messageToMap converts msg to a map keyed by field names, the fields which are not set are left out
+// if they can tell it, otherwise they are taken in zero values just like proto3 does
+func messageToMap(msg protoreflect.Message) map[string]interface{} {
+	fields := msg.Descriptor().Fields()
+	m := make(map[string]interface{}, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.HasPresence() && !msg.Has(fd) {
+			continue
+		}
+		m[string(fd.Name())] = fieldValue(fd, msg.Get(fd))
+	}
+	return m
+}
+
+// fieldValue converts the value of field fd to the value which json decodes to,
+// except that integers keep their types to be precise
+func fieldValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch {
+	case fd.IsList():
+		list := v.List()
+		values := make([]interface{}, list.Len())
+		for i := range values {
+			values[i] = singularValue(fd, list.Get(i))
+		}
+		return values
+	case fd.IsMap():
+		values := make(map[string]interface{}, v.Map().Len())
+		v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			values[k.String()] = singularValue(fd.MapValue(), v)
+			return true
+		})
+		return values
+	default:
+		return singularValue(fd, v)
+	}
+}
+
+// singularValue converts a value which is not a list or map, Timestamp becomes unix time in seconds
+func singularValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return v.Int()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return v.Uint()
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float()
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.BytesKind:
+		return v.Bytes()
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int64(v.Enum())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		msg := v.Message()
+		if msg.Descriptor().FullName() == timestampName {
+			fields := msg.Descriptor().Fields()
+			seconds := msg.Get(fields.ByName("seconds")).Int()
+			nanos := msg.Get(fields.ByName("nanos")).Int()
+			return float64(seconds) + float64(nanos)/1e9
+		}
+		return messageToMap(msg)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package decoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"go2ch/go2ch/config"
+)
+
+// types of schemas in schema registry
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+)
+
+// ErrRegistryUnavailable tells schema registry can not be reached or fails to respond for now,
+// so that the request is retried rather than the message being rejected
+var ErrRegistryUnavailable = errors.New("schema registry is unavailable")
+
+// Schema is a schema registered in schema registry
+type Schema struct {
+	// AVRO or PROTOBUF, empty means AVRO
+	SchemaType string `json:"schemaType,omitempty"`
+	// json of avro schema, or base64 of serialized FileDescriptorProto of protobuf schema
+	Schema     string            `json:"schema"`
+	References []SchemaReference `json:"references,omitempty"`
+}
+
+// SchemaReference is a schema which another schema depends on,
+// Name is the import path of protobuf file, or the full name of avro type
+type SchemaReference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+// Registry resolves schemas by id, or by subject and version for references
+type Registry interface {
+	SchemaByID(id int) (*Schema, error)
+	SchemaByVersion(subject string, version int) (*Schema, error)
+}
+
+// NewRegistry creates the registry which reads schemas from the HTTP API of schema registry at c.URL,
+// or from files under c.Dir which are laid out like the API
+func NewRegistry(c *config.SchemaRegistryConf) (Registry, error) {
+	switch {
+	case c.URL != "":
+		return &httpRegistry{
+			url:      strings.TrimRight(c.URL, "/"),
+			username: c.Username,
+			password: c.Password,
+			client:   &http.Client{Timeout: time.Duration(c.TimeoutSecond) * time.Second},
+		}, nil
+	case c.Dir != "":
+		return &fileRegistry{dir: c.Dir}, nil
+	default:
+		return nil, fmt.Errorf("newRegistry | either URL or Dir of schema registry is required")
+	}
+}
+
+// httpRegistry reads schemas from the HTTP API of a Confluent compatible schema registry,
+// protobuf schemas are requested in serialized format, so that they don't have to be compiled from .proto files
+type httpRegistry struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+}
+
+func (r *httpRegistry) SchemaByID(id int) (*Schema, error) {
+	return r.get(fmt.Sprintf("/schemas/ids/%d?format=serialized", id))
+}
+
+func (r *httpRegistry) SchemaByVersion(subject string, version int) (*Schema, error) {
+	return r.get(fmt.Sprintf("/subjects/%s/versions/%d?format=serialized", url.PathEscape(subject), version))
+}
+
+func (r *httpRegistry) get(path string) (*Schema, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, r.url+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("get | create request of [%s] failed: %v", path, err)
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get | request schema registry[%s] failed: %w: %v", path, ErrRegistryUnavailable, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("get | read response of [%s] failed: %w: %v", path, ErrRegistryUnavailable, err)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, fmt.Errorf("get | schema registry responds %d to [%s]: %w: %s", resp.StatusCode, path, ErrRegistryUnavailable, body)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get | schema registry responds %d to [%s]: %s", resp.StatusCode, path, body)
+	}
+
+	var s Schema
+	if err := jsoniter.Unmarshal(body, &s); err != nil {
+		return nil, fmt.Errorf("get | unmarshal schema of [%s] failed: %v", path, err)
+	}
+	return &s, nil
+}
+
+// fileRegistry reads schemas in the json of schema registry responses from
+// <dir>/schemas/ids/<id>.json and <dir>/subjects/<subject>/versions/<version>.json
+type fileRegistry struct {
+	dir string
+}
+
+func (r *fileRegistry) SchemaByID(id int) (*Schema, error) {
+	return r.read(filepath.Join(r.dir, "schemas", "ids", fmt.Sprintf("%d.json", id)))
+}
+
+func (r *fileRegistry) SchemaByVersion(subject string, version int) (*Schema, error) {
+	return r.read(filepath.Join(r.dir, "subjects", subject, "versions", fmt.Sprintf("%d.json", version)))
+}
+
+func (r *fileRegistry) read(path string) (*Schema, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read | read schema file[%s] failed: %v", path, err)
+	}
+	var s Schema
+	if err := jsoniter.Unmarshal(bs, &s); err != nil {
+		return nil, fmt.Errorf("read | unmarshal schema file[%s] failed: %v", path, err)
+	}
+	return &s, nil
+}
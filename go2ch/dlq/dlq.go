@@ -0,0 +1,218 @@
+package dlq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+
+	"go2ch/go2ch/config"
+	kf "go2ch/go2ch/kafka"
+)
+
+const (
+	typeKafka = "kafka"
+	typeFile  = "file"
+)
+
+// stages of the pipeline where a row can be rejected
+const (
+	StageDecode  = "decode"
+	StageWrite   = "write"
+	StageConvert = "convert"
+	StagePrepare = "prepare"
+	StageAppend  = "append"
+	StageSend    = "send"
+)
+
+// Record is a row rejected by the pipeline.
+// It keeps the original kafka message, so the row can be replayed from the record later.
+// Payload is kept in bytes as it is, which is base64 encoded in json, since it may not be valid UTF-8.
+// A message may be decoded into many rows, Index and Row tell which one of them is rejected.
+type Record struct {
+	Cluster string          `json:"cluster"`
+	Topic   string          `json:"topic,omitempty"`
+	Key     string          `json:"key,omitempty"`
+	Payload []byte          `json:"payload"`
+	Index   int             `json:"index"` // index of the rejected row in the rows of payload, -1 if the whole message is rejected
+	Row     json.RawMessage `json:"row,omitempty"`
+	Stage   string          `json:"stage"`
+	Error   string          `json:"error"`
+	Time    time.Time       `json:"time"`
+}
+
+// DeadLetter receives the rows rejected anywhere in the pipeline
+type DeadLetter interface {
+	Put(records ...*Record) error
+	Close() error
+}
+
+// NewRecord creates a record for the original message which was rejected at stage because of err
+func NewRecord(topic, key string, payload []byte, stage string, err error) *Record {
+	return &Record{
+		Topic:   topic,
+		Key:     key,
+		Payload: payload,
+		Index:   -1,
+		Stage:   stage,
+		Error:   err.Error(),
+		Time:    time.Now(),
+	}
+}
+
+// WithRow tells the record is for the row at index of the rows decoded from payload, whose fields are kept in json
+func (r *Record) WithRow(index int, fields map[string]interface{}) *Record {
+	r.Index = index
+	if bs, err := json.Marshal(fields); err == nil {
+		r.Row = bs
+	}
+	return r
+}
+
+// NewDeadLetter creates the dead letter output of a cluster.
+// If the cluster does not configure one, rejected rows are only logged.
+func NewDeadLetter(ctx context.Context, c *config.Cluster) (DeadLetter, error) {
+	name := c.Input.Kafka.Name
+	if c.DeadLetter == nil {
+		return &logDeadLetter{cluster: name}, nil
+	}
+
+	switch c.DeadLetter.Type {
+	case typeKafka:
+		if c.DeadLetter.Topic == "" {
+			return nil, fmt.Errorf("NewDeadLetter | lack topic of kafka dead letter in config")
+		}
+		brokers := c.DeadLetter.Brokers
+		if len(brokers) == 0 {
+			brokers = c.Input.Kafka.Brokers
+		}
+		kw, err := kf.NewWriter(ctx, &config.KafkaConf{
+			Brokers: brokers,
+			Topics:  []string{c.DeadLetter.Topic},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("NewDeadLetter | %v", err)
+		}
+		return &kafkaDeadLetter{cluster: name, writer: kw}, nil
+	case typeFile:
+		if c.DeadLetter.Path == "" {
+			return nil, fmt.Errorf("NewDeadLetter | lack path of file dead letter in config")
+		}
+		return NewFileDeadLetter(name, c.DeadLetter.Path)
+	default:
+		return nil, fmt.Errorf("NewDeadLetter | unknown dead letter type[%s]", c.DeadLetter.Type)
+	}
+}
+
+// ReadRecords reads the records in JSONL format from r, the format is the same as the file dead letter writes
+func ReadRecords(r io.Reader) ([]*Record, error) {
+	records := make([]*Record, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("ReadRecords | unmarshal line to record failed: %v", err)
+		}
+		records = append(records, &record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ReadRecords | read records failed: %v", err)
+	}
+	return records, nil
+}
+
+// logDeadLetter only logs the rejected rows
+type logDeadLetter struct {
+	cluster string
+}
+
+func (d *logDeadLetter) Put(records ...*Record) error {
+	for _, record := range records {
+		logx.Errorf("dead letter | cluster[%s] rejected row at stage[%s]: %s", d.cluster, record.Stage, record.Error)
+	}
+	return nil
+}
+
+func (d *logDeadLetter) Close() error {
+	return nil
+}
+
+// kafkaDeadLetter sends the rejected rows to a kafka topic
+type kafkaDeadLetter struct {
+	cluster string
+	writer  *kf.Writer
+}
+
+func (d *kafkaDeadLetter) Put(records ...*Record) error {
+	datas := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		record.Cluster = d.cluster
+		datas = append(datas, record)
+	}
+	if err := d.writer.Produce(datas...); err != nil {
+		return fmt.Errorf("Put | %v", err)
+	}
+	return nil
+}
+
+func (d *kafkaDeadLetter) Close() error {
+	return d.writer.Writer.Close()
+}
+
+// FileDeadLetter appends the rejected rows to a local file, one JSON record per line
+type FileDeadLetter struct {
+	cluster string
+	lock    sync.Mutex
+	file    *os.File
+}
+
+// NewFileDeadLetter opens or creates the file in path for appending records
+func NewFileDeadLetter(cluster, path string) (*FileDeadLetter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("NewFileDeadLetter | open file[%s] failed: %v", path, err)
+	}
+	return &FileDeadLetter{
+		cluster: cluster,
+		file:    f,
+	}, nil
+}
+
+// Put appends records to the file
+func (d *FileDeadLetter) Put(records ...*Record) error {
+	bs := make([]byte, 0)
+	for _, record := range records {
+		record.Cluster = d.cluster
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("Put | marshal record to json failed: %v", err)
+		}
+		bs = append(bs, line...)
+		bs = append(bs, '\n')
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, err := d.file.Write(bs); err != nil {
+		return fmt.Errorf("Put | write records to file failed: %v", err)
+	}
+	return nil
+}
+
+// Close closes the file
+func (d *FileDeadLetter) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.file.Close()
+}
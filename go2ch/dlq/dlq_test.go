@@ -0,0 +1,91 @@
+package dlq
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileDeadLetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letter.log")
+
+	d, err := NewFileDeadLetter("example_logger", path)
+	assert.Nil(t, err)
+
+	err = d.Put(
+		NewRecord("t_logger", "k1", []byte(`[{"id":0},{"id":"x"}]`), StageConvert, errors.New("bad id")).
+			WithRow(1, map[string]interface{}{"id": "x"}),
+		NewRecord("t_logger", "", []byte(`{"id":`), StageDecode, errors.New("unexpected end")),
+		NewRecord("t_logger", "", []byte{0xff, 0xfe, 0x00}, StageDecode, errors.New("invalid utf-8")),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, d.Close())
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	records, err := ReadRecords(f)
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+
+	assert.Equal(t, "example_logger", records[0].Cluster)
+	assert.Equal(t, "t_logger", records[0].Topic)
+	assert.Equal(t, "k1", records[0].Key)
+	assert.Equal(t, []byte(`[{"id":0},{"id":"x"}]`), records[0].Payload)
+	assert.Equal(t, 1, records[0].Index)
+	assert.JSONEq(t, `{"id":"x"}`, string(records[0].Row))
+	assert.Equal(t, StageConvert, records[0].Stage)
+	assert.Equal(t, "bad id", records[0].Error)
+	assert.False(t, records[0].Time.IsZero())
+
+	assert.Equal(t, []byte(`{"id":`), records[1].Payload)
+	assert.Equal(t, StageDecode, records[1].Stage)
+	// the whole message is rejected
+	assert.Equal(t, -1, records[1].Index)
+	assert.Empty(t, records[1].Row)
+
+	// the payload which is not valid UTF-8 is kept as it is
+	assert.Equal(t, []byte{0xff, 0xfe, 0x00}, records[2].Payload)
+}
+
+func TestReadRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect int
+		err    bool
+	}{
+		{
+			name:   "empty",
+			input:  "",
+			expect: 0,
+		},
+		{
+			name:   "skip blank lines",
+			input:  "{\"payload\":\"YQ==\"}\n\n{\"payload\":\"Yg==\"}\n",
+			expect: 2,
+		},
+		{
+			name:  "broken line",
+			input: "{\"payload\":\"YQ==\"}\n{\"payload\":",
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, err := ReadRecords(strings.NewReader(test.input))
+			if test.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Len(t, records, test.expect)
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go2ch/go2ch/config"
+)
+
+// predicate reports whether a message meets a condition
+type predicate func(m map[string]interface{}) bool
+
+// literal is a value in conditions, parsed once so that it is compared with the fields of messages by type
+type literal struct {
+	s      string
+	f      float64
+	number bool
+	b      bool
+	bool   bool
+}
+
+// newLiteral parses s to a literal
+func newLiteral(s string) literal {
+	l := literal{s: s}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		l.f, l.number = f, true
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		l.b, l.bool = b, true
+	}
+	return l
+}
+
+// equals reports whether v of a message equals l, numbers and booleans are compared by value rather than by text
+func (l literal) equals(v interface{}) bool {
+	switch value := v.(type) {
+	case string:
+		return value == l.s
+	case bool:
+		return l.bool && value == l.b
+	}
+	f, ok := toNumber(v)
+	return ok && l.number && f == l.f
+}
+
+// compileConditions compiles the conditions of a filter into a predicate.
+// The and conditions must all be true, and without any of them, one of the or conditions must be true.
+func compileConditions(conditions []config.Condition) (predicate, error) {
+	var ands, ors []predicate
+	for i, c := range conditions {
+		p, err := compileCondition(c)
+		if err != nil {
+			return nil, fmt.Errorf("condition[%d]: %v", i, err)
+		}
+		if c.Op == opOr {
+			ors = append(ors, p)
+		} else {
+			ands = append(ands, p)
+		}
+	}
+	if len(ands) > 0 {
+		return allOf(ands), nil
+	}
+	return anyOf(ors), nil
+}
+
+// compileCondition compiles c, which is a group of conditions if one of All, Any and Not is set,
+// otherwise a condition of Type on the field at Key
+func compileCondition(c config.Condition) (predicate, error) {
+	var set int
+	for _, ok := range []bool{c.Key != "", len(c.All) > 0, len(c.Any) > 0, c.Not != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("a condition must have exactly one of Key, All, Any and Not")
+	}
+
+	switch {
+	case len(c.All) > 0:
+		ps, err := compileGroup(c.All)
+		if err != nil {
+			return nil, fmt.Errorf("all: %v", err)
+		}
+		return allOf(ps), nil
+	case len(c.Any) > 0:
+		ps, err := compileGroup(c.Any)
+		if err != nil {
+			return nil, fmt.Errorf("any: %v", err)
+		}
+		return anyOf(ps), nil
+	case c.Not != nil:
+		p, err := compileCondition(*c.Not)
+		if err != nil {
+			return nil, fmt.Errorf("not: %v", err)
+		}
+		return func(m map[string]interface{}) bool {
+			return !p(m)
+		}, nil
+	}
+
+	if c.Type == typeNe {
+		eq := c
+		eq.Type = typeEq
+		p, err := compileCondition(eq)
+		if err != nil {
+			return nil, err
+		}
+		return func(m map[string]interface{}) bool {
+			return !p(m)
+		}, nil
+	}
+	key, err := newFieldPath(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	if c.Type == typeExists {
+		return func(m map[string]interface{}) bool {
+			v, ok := key.get(m)
+			return ok && v != nil
+		}, nil
+	}
+	match, err := compileMatch(c)
+	if err != nil {
+		return nil, fmt.Errorf("%s of key[%s]: %v", c.Type, c.Key, err)
+	}
+	return func(m map[string]interface{}) bool {
+		v, ok := key.get(m)
+		return ok && match(v)
+	}, nil
+}
+
+// compileGroup compiles each of conditions in a group
+func compileGroup(conditions []config.Condition) ([]predicate, error) {
+	ps := make([]predicate, 0, len(conditions))
+	for i, c := range conditions {
+		p, err := compileCondition(c)
+		if err != nil {
+			return nil, fmt.Errorf("condition[%d]: %v", i, err)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// compileMatch compiles the function telling whether the value of field meets c
+func compileMatch(c config.Condition) (func(v interface{}) bool, error) {
+	switch c.Type {
+	case "", typeEq, typeMatch:
+		l := newLiteral(c.Value)
+		return l.equals, nil
+	case typeIn:
+		if len(c.Values) == 0 {
+			return nil, fmt.Errorf("values are required")
+		}
+		ls := make([]literal, 0, len(c.Values))
+		for _, value := range c.Values {
+			ls = append(ls, newLiteral(value))
+		}
+		return func(v interface{}) bool {
+			for _, l := range ls {
+				if l.equals(v) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case typeContains:
+		l := newLiteral(c.Value)
+		return func(v interface{}) bool {
+			switch value := v.(type) {
+			case string:
+				return strings.Contains(value, c.Value)
+			case []interface{}:
+				for _, item := range value {
+					if l.equals(item) {
+						return true
+					}
+				}
+			}
+			return false
+		}, nil
+	case typePrefix:
+		return func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && strings.HasPrefix(s, c.Value)
+		}, nil
+	case typeSuffix:
+		return func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && strings.HasSuffix(s, c.Value)
+		}, nil
+	case typeRegex:
+		re, err := regexp.Compile(c.Value)
+		if err != nil {
+			return nil, err
+		}
+		return func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		}, nil
+	case typeGt, typeGte, typeLt, typeLte:
+		bound, err := strconv.ParseFloat(c.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("value [%s] is not a number", c.Value)
+		}
+		compare := comparisons[c.Type]
+		return func(v interface{}) bool {
+			f, ok := toNumber(v)
+			return ok && compare(f, bound)
+		}, nil
+	case typeBetween:
+		if len(c.Values) != 2 {
+			return nil, fmt.Errorf("values must be the lower and upper bounds")
+		}
+		lower, err1 := strconv.ParseFloat(c.Values[0], 64)
+		upper, err2 := strconv.ParseFloat(c.Values[1], 64)
+		if err1 != nil || err2 != nil || lower > upper {
+			return nil, fmt.Errorf("values %v are not the lower and upper bounds in numbers", c.Values)
+		}
+		return func(v interface{}) bool {
+			f, ok := toNumber(v)
+			return ok && f >= lower && f <= upper
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown type")
+}
+
+// comparisons are the numeric comparisons of conditions
+var comparisons = map[string]func(f, bound float64) bool{
+	typeGt:  func(f, bound float64) bool { return f > bound },
+	typeGte: func(f, bound float64) bool { return f >= bound },
+	typeLt:  func(f, bound float64) bool { return f < bound },
+	typeLte: func(f, bound float64) bool { return f <= bound },
+}
+
+// allOf returns the predicate which is true if all of ps are true
+func allOf(ps []predicate) predicate {
+	return func(m map[string]interface{}) bool {
+		for _, p := range ps {
+			if !p(m) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// anyOf returns the predicate which is true if any of ps is true
+func anyOf(ps []predicate) predicate {
+	return func(m map[string]interface{}) bool {
+		for _, p := range ps {
+			if p(m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// toNumber converts a number, or a numeric string from text formats like csv, to float64
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
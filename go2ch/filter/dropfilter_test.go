@@ -153,8 +153,97 @@ func TestDropFilter(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			actual := DropFilter(test.conditions)(test.input)
+			f, err := DropFilter(test.conditions)
+			assert.Nil(t, err)
+			actual := f(test.input)
 			assert.EqualValues(t, test.expect, actual)
 		})
 	}
 }
+
+func TestDropFilterConditions(t *testing.T) {
+	input := map[string]interface{}{
+		"level":  "debug",
+		"status": float64(404),
+		"cost":   "1.5",
+		"ok":     false,
+		"tags":   []interface{}{"a", float64(1)},
+		"user":   map[string]interface{}{"geo": map[string]interface{}{"country": "cn"}},
+		"empty":  nil,
+	}
+
+	tests := []struct {
+		name      string
+		condition config.Condition
+		drop      bool
+	}{
+		{name: "eq number", condition: config.Condition{Key: "status", Value: "404"}, drop: true},
+		{name: "eq bool", condition: config.Condition{Key: "ok", Type: typeEq, Value: "false"}, drop: true},
+		{name: "eq missing", condition: config.Condition{Key: "x", Type: typeEq, Value: ""}},
+		{name: "ne", condition: config.Condition{Key: "level", Type: typeNe, Value: "info"}, drop: true},
+		{name: "ne missing", condition: config.Condition{Key: "x", Type: typeNe, Value: "info"}, drop: true},
+		{name: "in", condition: config.Condition{Key: "level", Type: typeIn, Values: []string{"trace", "debug"}}, drop: true},
+		{name: "not in", condition: config.Condition{Key: "level", Type: typeIn, Values: []string{"info"}}},
+		{name: "contains in array", condition: config.Condition{Key: "tags", Type: typeContains, Value: "1"}, drop: true},
+		{name: "prefix", condition: config.Condition{Key: "level", Type: typePrefix, Value: "de"}, drop: true},
+		{name: "suffix", condition: config.Condition{Key: "level", Type: typeSuffix, Value: "de"}},
+		{name: "regex", condition: config.Condition{Key: "level", Type: typeRegex, Value: "^(debug|trace)$"}, drop: true},
+		{name: "exists", condition: config.Condition{Key: "level", Type: typeExists}, drop: true},
+		{name: "exists null", condition: config.Condition{Key: "empty", Type: typeExists}},
+		{name: "gte", condition: config.Condition{Key: "status", Type: typeGte, Value: "400"}, drop: true},
+		{name: "lt numeric string", condition: config.Condition{Key: "cost", Type: typeLt, Value: "1"}},
+		{name: "between", condition: config.Condition{Key: "cost", Type: typeBetween, Values: []string{"1", "2"}}, drop: true},
+		{name: "nested path", condition: config.Condition{Key: "user.geo.country", Value: "cn"}, drop: true},
+		{name: "nested path missing", condition: config.Condition{Key: "user.geo.city", Type: typeExists}},
+		{
+			name: "all",
+			condition: config.Condition{All: []config.Condition{
+				{Key: "level", Value: "debug"},
+				{Key: "status", Type: typeLt, Value: "400"},
+			}},
+		},
+		{
+			name: "any",
+			condition: config.Condition{Any: []config.Condition{
+				{Key: "level", Value: "info"},
+				{Key: "status", Type: typeGte, Value: "400"},
+			}},
+			drop: true,
+		},
+		{
+			name:      "not",
+			condition: config.Condition{Not: &config.Condition{Key: "user.geo.country", Type: typeIn, Values: []string{"cn", "us"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := DropFilter([]config.Condition{test.condition})
+			assert.Nil(t, err)
+			assert.Equal(t, test.drop, f(input) == nil)
+		})
+	}
+}
+
+func TestDropFilterInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition config.Condition
+	}{
+		{name: "bad regex", condition: config.Condition{Key: "a", Type: typeRegex, Value: "("}},
+		{name: "not a number", condition: config.Condition{Key: "a", Type: typeGt, Value: "x"}},
+		{name: "between one bound", condition: config.Condition{Key: "a", Type: typeBetween, Values: []string{"1"}}},
+		{name: "in without values", condition: config.Condition{Key: "a", Type: typeIn}},
+		{name: "unknown type", condition: config.Condition{Key: "a", Type: "like"}},
+		{name: "empty", condition: config.Condition{}},
+		{name: "key and group", condition: config.Condition{Key: "a", Any: []config.Condition{{Key: "b"}}}},
+		{name: "bad nested", condition: config.Condition{Not: &config.Condition{All: []config.Condition{{Key: "a", Type: typeRegex, Value: "["}}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DropFilter([]config.Condition{test.condition})
+			assert.NotNil(t, err)
+		})
+	}
+}
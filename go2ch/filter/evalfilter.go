@@ -0,0 +1,27 @@
+package filter
+
+import (
+	"fmt"
+)
+
+// EvalFilter sets field, which may be a dotted path into nested objects, to the value of expression of each message, see compileExpr about expressions.
+// The expression is compiled once here, and the field is left as it is if the expression evaluates to null.
+func EvalFilter(field, expression string) (FilterFunc, error) {
+	if field == "" {
+		return nil, fmt.Errorf("evalFilter | field is required")
+	}
+	path, err := newFieldPath(field)
+	if err != nil {
+		return nil, fmt.Errorf("evalFilter | %v", err)
+	}
+	e, err := compileExpr(expression)
+	if err != nil {
+		return nil, fmt.Errorf("evalFilter | compile expression [%s] failed: %v", expression, err)
+	}
+	return func(m map[string]interface{}) map[string]interface{} {
+		if v := e(m); v != nil {
+			path.set(m, v)
+		}
+		return m
+	}, nil
+}
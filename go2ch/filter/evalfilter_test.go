@@ -0,0 +1,106 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalFilter(t *testing.T) {
+	input := func() map[string]interface{} {
+		return map[string]interface{}{
+			"first":   " Ada ",
+			"last":    "Lovelace",
+			"cost":    float64(1500),
+			"count":   "3",
+			"status":  float64(404),
+			"time":    time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC),
+			"user":    map[string]interface{}{"geo": map[string]interface{}{"country": "cn"}},
+			"odd.key": "x",
+			"list":    []interface{}{"p", "q"},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		expr   string
+		expect interface{}
+	}{
+		{name: "concat", expr: "trim(first) || ' ' || upper(last)", expect: "Ada LOVELACE"},
+		{name: "concat function", expr: "concat(lower(last), '-', count)", expect: "lovelace-3"},
+		{name: "arithmetic", expr: "cost / 1000 * count + -1", expect: 3.5},
+		{name: "precedence", expr: "(1 + 2) * 3 % 4", expect: float64(1)},
+		{name: "substring", expr: "substring(last, 2, 3)", expect: "ove"},
+		{name: "substring from end", expr: "substring(last, -3)", expect: "ace"},
+		{name: "substring with huge length", expr: "substring(last, 1, 1e20)", expect: "Lovelace"},
+		{name: "substring with huge offset", expr: "substring(last, 1e20, 2)", expect: ""},
+		{name: "substring with huge negative offset", expr: "substring(last, -1e20)", expect: "Lovelace"},
+		{name: "substring with huge negative length", expr: "substring(last, 2, -1e20)", expect: ""},
+		{name: "substring with negative offset before start", expr: "substring(last, -10, 4)", expect: "Lo"},
+		{name: "substring with negative length", expr: "substring(last, 2, -3)", expect: "ovel"},
+		{name: "substring with zero offset", expr: "substring(last, 0, 3)", expect: ""},
+		{name: "substring with zero length", expr: "substring(last, 2, 0)", expect: ""},
+		{name: "substring with length from field", expr: "substring(last, 1, cost * 1e20)", expect: "Lovelace"},
+		{name: "coalesce", expr: "coalesce(missing, null, user.geo.country)", expect: "cn"},
+		{name: "if", expr: "if(status >= 400 and not (status = 404), 'error', if(status = 404, 'not found', 'ok'))", expect: "not found"},
+		{name: "compare strings", expr: "last > 'A' or false", expect: true},
+		{name: "array index", expr: "list[-1] || list[0]", expect: "qp"},
+		{name: "quoted name", expr: "`odd.key` || \"y\"", expect: "xy"},
+		{name: "md5", expr: "md5('abc')", expect: "900150983cd24fb0d6963f7d28e17f72"},
+		{name: "sha1", expr: "sha1('abc')", expect: "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{name: "to start of hour", expr: "toStartOfHour(time)", expect: time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)},
+		{name: "to start of day from string", expr: "toStartOfDay('2020-09-13T12:26:40Z')", expect: time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC)},
+		{name: "null is left", expr: "cost / 0", expect: "unchanged"},
+		{name: "wrong type is null", expr: "last * 2", expect: "unchanged"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := EvalFilter("out", test.expr)
+			assert.Nil(t, err)
+
+			m := input()
+			m["out"] = "unchanged"
+			assert.Equal(t, test.expect, f(m)["out"])
+		})
+	}
+}
+
+func TestEvalFilterFunctions(t *testing.T) {
+	f, err := EvalFilter("hash", "cityHash64(id)")
+	assert.Nil(t, err)
+	first := f(map[string]interface{}{"id": "a"})["hash"]
+	assert.IsType(t, uint64(0), first)
+	assert.Equal(t, first, f(map[string]interface{}{"id": "a"})["hash"])
+	assert.NotEqual(t, first, f(map[string]interface{}{"id": "b"})["hash"])
+
+	f, err = EvalFilter("user.name", "upper(name)")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "ada", "user": map[string]interface{}{"name": "ADA"}},
+		f(map[string]interface{}{"name": "ada"}))
+
+	f, err = EvalFilter("at", "now()")
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), f(map[string]interface{}{})["at"].(time.Time), time.Second)
+}
+
+func TestEvalFilterInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"1 +",
+		"(a",
+		"a b",
+		"'unterminated",
+		"unknown(a)",
+		"lower(a, b)",
+		"if(a, b)",
+		"a & b",
+	} {
+		_, err := EvalFilter("out", expr)
+		assert.NotNil(t, err, expr)
+	}
+
+	_, err := EvalFilter("", "1")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,524 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expr is a compiled expression, which evaluates to a value of message m, nil means null
+type expr func(m map[string]interface{}) interface{}
+
+// kinds of tokens in expressions
+const (
+	tokenEOF = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOp
+)
+
+// token is a token in expression
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+// compileExpr compiles expression s once, so that it is only evaluated for each message.
+// An expression is made of field references like user.name, tags[0] or `odd name`, number and string literals, true, false and null,
+// arithmetic + - * / %, string concat ||, comparisons = == != <> < <= > >=, and, or, not, parentheses, and the functions of exprFuncs.
+// Operations on values of wrong types evaluate to null rather than failing the message.
+func compileExpr(s string) (expr, error) {
+	tokens, err := lexExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected [%s] at %d", t.text, t.pos)
+	}
+	return e, nil
+}
+
+// lexExpr splits s into tokens
+func lexExpr(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isDigit(c) || (c == '.' && i+1 < len(s) && isDigit(s[i+1])):
+			start := i
+			for i < len(s) && (isDigit(s[i]) || s[i] == '.') {
+				i++
+			}
+			if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+				i++
+				if i < len(s) && (s[i] == '+' || s[i] == '-') {
+					i++
+				}
+				for i < len(s) && isDigit(s[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: s[start:i], pos: start})
+		case c == '\'' || c == '"' || c == '`':
+			start := i
+			text, n, err := unquoteExpr(s[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at %d", err, start)
+			}
+			i += n
+			kind := tokenString
+			if c == '`' {
+				kind = tokenIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: start})
+		case isIdentStart(c):
+			start := i
+			for i < len(s) && (isIdentStart(s[i]) || isDigit(s[i]) || s[i] == '.' || s[i] == '[' || s[i] == ']' ||
+				(s[i] == '-' && s[i-1] == '[')) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: s[start:i], pos: start})
+		default:
+			op := string(c)
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "||", "==", "!=", "<>", "<=", ">=":
+					op = two
+				}
+			}
+			switch op {
+			case "(", ")", ",", "+", "-", "*", "/", "%", "<", ">", "=", "||", "==", "!=", "<>", "<=", ">=":
+			default:
+				return nil, fmt.Errorf("unexpected [%s] at %d", op, i)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, text: "end of expression", pos: len(s)}), nil
+}
+
+// unquoteExpr reads a quoted string or name at the beginning of s, and returns it with the bytes read
+func unquoteExpr(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated %c", quote)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '@' || c == '$'
+}
+
+// exprParser parses tokens into an expression by precedence, from or, and, not, comparisons,
+// + - and ||, * / and %, down to unary minus and operands
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is one of the operators or keywords in texts
+func (p *exprParser) accept(texts ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOp && t.kind != tokenIdent {
+		return "", false
+	}
+	for _, text := range texts {
+		if (t.kind == tokenOp && t.text == text) || (t.kind == tokenIdent && strings.EqualFold(t.text, text) && isKeyword(text)) {
+			p.pos++
+			return text, true
+		}
+	}
+	return "", false
+}
+
+// expect consumes the next token which must be the operator text
+func (p *exprParser) expect(text string) error {
+	if _, ok := p.accept(text); !ok {
+		t := p.peek()
+		return fmt.Errorf("expect [%s] but got [%s] at %d", text, t.text, t.pos)
+	}
+	return nil
+}
+
+func isKeyword(s string) bool {
+	switch strings.ToLower(s) {
+	case "and", "or", "not", "true", "false", "null":
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("or"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m map[string]interface{}) interface{} {
+			return truthy(l(m)) || truthy(right(m))
+		}
+	}
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("and"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m map[string]interface{}) interface{} {
+			return truthy(l(m)) && truthy(right(m))
+		}
+	}
+}
+
+func (p *exprParser) parseNot() (expr, error) {
+	if _, ok := p.accept("not"); ok {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(m map[string]interface{}) interface{} {
+			return !truthy(e(m))
+		}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (expr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("=", "==", "!=", "<>", "<", "<=", ">", ">=")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return func(m map[string]interface{}) interface{} {
+		c, ok := compareValues(left(m), right(m))
+		if !ok {
+			return nil
+		}
+		switch op {
+		case "=", "==":
+			return c == 0
+		case "!=", "<>":
+			return c != 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}, nil
+}
+
+func (p *exprParser) parseAdditive() (expr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-", "||")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		if op == "||" {
+			l := left
+			left = func(m map[string]interface{}) interface{} {
+				return toText(l(m)) + toText(right(m))
+			}
+			continue
+		}
+		left = arithmetic(op, left, right)
+	}
+}
+
+func (p *exprParser) parseMultiplicative() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(op, left, right)
+	}
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if _, ok := p.accept("-"); ok {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(m map[string]interface{}) interface{} {
+			if f, ok := toNumber(e(m)); ok {
+				return -f
+			}
+			return nil
+		}, nil
+	}
+	return p.parseOperand()
+}
+
+func (p *exprParser) parseOperand() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number [%s] at %d", t.text, t.pos)
+		}
+		return constant(f), nil
+	case tokenString:
+		return constant(t.text), nil
+	case tokenOp:
+		if t.text == "(" {
+			e, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		}
+	case tokenIdent:
+		switch strings.ToLower(t.text) {
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		case "null":
+			return constant(nil), nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(t)
+		}
+		path, err := newFieldPath(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("%v at %d", err, t.pos)
+		}
+		return func(m map[string]interface{}) interface{} {
+			v, _ := path.get(m)
+			return v
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected [%s] at %d", t.text, t.pos)
+}
+
+// parseCall parses the arguments of function t, whose opening parenthesis is consumed
+func (p *exprParser) parseCall(t token) (expr, error) {
+	f, ok := exprFuncs[strings.ToLower(t.text)]
+	if !ok {
+		return nil, fmt.Errorf("unknown function [%s] at %d", t.text, t.pos)
+	}
+	var args []expr
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) < f.min || (f.max >= 0 && len(args) > f.max) {
+		return nil, fmt.Errorf("function [%s] at %d takes %s arguments, but got %d", t.text, t.pos, f.arity(), len(args))
+	}
+	return f.build(args), nil
+}
+
+// constant returns the expression of constant v
+func constant(v interface{}) expr {
+	return func(m map[string]interface{}) interface{} {
+		return v
+	}
+}
+
+// arithmetic returns the expression of arithmetic op on numbers, it is null if either is not a number or dividing by zero
+func arithmetic(op string, left, right expr) expr {
+	return func(m map[string]interface{}) interface{} {
+		a, ok1 := toNumber(left(m))
+		b, ok2 := toNumber(right(m))
+		if !ok1 || !ok2 {
+			return nil
+		}
+		switch op {
+		case "+":
+			return a + b
+		case "-":
+			return a - b
+		case "*":
+			return a * b
+		}
+		if b == 0 {
+			return nil
+		}
+		if op == "/" {
+			return a / b
+		}
+		return math.Mod(a, b)
+	}
+}
+
+// truthy reports whether v is true in conditions: true, a number other than 0, or a string other than empty
+func truthy(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case string:
+		return value != ""
+	}
+	if f, ok := toNumber(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+// toText converts v to string, null is empty
+func toText(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// compareValues compares a and b as numbers if both are numbers, as times if both are times, otherwise as strings,
+// it fails if either is null
+func compareValues(a, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	_, aTime := a.(time.Time)
+	_, bTime := b.(time.Time)
+	if aTime || bTime {
+		ta, ok1 := toTime(a)
+		tb, ok2 := toTime(b)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		return compareOrdered(ta.UnixNano(), tb.UnixNano()), true
+	}
+	_, aString := a.(string)
+	_, bString := b.(string)
+	if !aString || !bString {
+		fa, ok1 := toNumber(a)
+		fb, ok2 := toNumber(b)
+		if ok1 && ok2 {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return strings.Compare(toText(a), toText(b)), true
+}
+
+func compareOrdered(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// toTime converts a time, a unix timestamp in seconds, or an RFC 3339 string to time.Time
+func toTime(v interface{}) (time.Time, bool) {
+	return parseTime(v, "", false, time.Second, time.UTC)
+}
@@ -0,0 +1,178 @@
+package filter
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/cityhash102"
+)
+
+// exprFunc is a function in expressions, which builds the expression of a call from its arguments
+type exprFunc struct {
+	min, max int // how many arguments it takes, max < 0 means no limit
+	build    func(args []expr) expr
+}
+
+// arity describes how many arguments f takes
+func (f exprFunc) arity() string {
+	switch {
+	case f.max < 0:
+		return "at least " + strconv.Itoa(f.min)
+	case f.min == f.max:
+		return strconv.Itoa(f.min)
+	}
+	return strconv.Itoa(f.min) + " to " + strconv.Itoa(f.max)
+}
+
+// exprFuncs are the functions in expressions by lower case names, names are case insensitive
+var exprFuncs = map[string]exprFunc{
+	"concat": {1, -1, func(args []expr) expr {
+		return func(m map[string]interface{}) interface{} {
+			var b strings.Builder
+			for _, arg := range args {
+				b.WriteString(toText(arg(m)))
+			}
+			return b.String()
+		}
+	}},
+	"lower": stringFunc(strings.ToLower),
+	"upper": stringFunc(strings.ToUpper),
+	"trim":  stringFunc(strings.TrimSpace),
+	"tostring": {1, 1, func(args []expr) expr {
+		return func(m map[string]interface{}) interface{} { return nullable(args[0](m), toText) }
+	}},
+	// substring(s, offset[, length]) in bytes like clickhouse, offset starts from 1 and counts from the end if it is negative,
+	// offset 0 gives an empty string, a negative length leaves out as many bytes from the end.
+	// The bounds are clamped as float64, since they may come from messages and be too large for int
+	"substring": {2, 3, func(args []expr) expr {
+		return func(m map[string]interface{}) interface{} {
+			v := args[0](m)
+			offset, ok := toNumber(args[1](m))
+			if v == nil || !ok || math.IsNaN(offset) {
+				return nil
+			}
+			s := toText(v)
+			size := float64(len(s))
+			offset = math.Trunc(offset)
+			var start float64
+			switch {
+			case offset == 0:
+				return ""
+			case offset > 0:
+				start = offset - 1
+			default:
+				start = size + offset
+			}
+			end := size
+			if len(args) == 3 {
+				length, ok := toNumber(args[2](m))
+				if !ok || math.IsNaN(length) {
+					return nil
+				}
+				length = math.Trunc(length)
+				if length >= 0 {
+					end = start + length
+				} else {
+					end = size + length
+				}
+			}
+			start = math.Max(start, 0)
+			end = math.Min(end, size)
+			if start >= end {
+				return ""
+			}
+			return s[int(start):int(end)]
+		}
+	}},
+	// coalesce returns the first argument which is not null, a missing field is null
+	"coalesce": {1, -1, func(args []expr) expr {
+		return func(m map[string]interface{}) interface{} {
+			for _, arg := range args {
+				if v := arg(m); v != nil {
+					return v
+				}
+			}
+			return nil
+		}
+	}},
+	// if(cond, then, else) evaluates only the branch taken
+	"if": {3, 3, func(args []expr) expr {
+		return func(m map[string]interface{}) interface{} {
+			if truthy(args[0](m)) {
+				return args[1](m)
+			}
+			return args[2](m)
+		}
+	}},
+	"md5": stringFunc(func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}),
+	"sha1": stringFunc(func(s string) string {
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}),
+	// cityHash64 is the same as cityHash64 of clickhouse on a string, so that values can be matched with the ones hashed in sql
+	"cityhash64": {1, 1, func(args []expr) expr {
+		return func(m map[string]interface{}) interface{} {
+			v := args[0](m)
+			if v == nil {
+				return nil
+			}
+			s := toText(v)
+			return cityhash102.CityHash64([]byte(s), uint32(len(s)))
+		}
+	}},
+	"now": {0, 0, func(args []expr) expr {
+		return func(m map[string]interface{}) interface{} {
+			return time.Now()
+		}
+	}},
+	"tostartofminute": truncateFunc(func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+	}),
+	"tostartofhour": truncateFunc(func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	}),
+	"tostartofday": truncateFunc(func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}),
+}
+
+// stringFunc returns the function which applies f to its argument in string, null stays null
+func stringFunc(f func(s string) string) exprFunc {
+	return exprFunc{1, 1, func(args []expr) expr {
+		return func(m map[string]interface{}) interface{} {
+			return nullable(args[0](m), func(v interface{}) string {
+				return f(toText(v))
+			})
+		}
+	}}
+}
+
+// truncateFunc returns the function which truncates its argument in time by f,
+// the argument is a time, a unix timestamp in seconds or an RFC 3339 string, otherwise the result is null
+func truncateFunc(f func(t time.Time) time.Time) exprFunc {
+	return exprFunc{1, 1, func(args []expr) expr {
+		return func(m map[string]interface{}) interface{} {
+			t, ok := toTime(args[0](m))
+			if !ok {
+				return nil
+			}
+			return f(t)
+		}
+	}}
+}
+
+// nullable returns f(v), or nil if v is null
+func nullable(v interface{}, f func(v interface{}) string) interface{} {
+	if v == nil {
+		return nil
+	}
+	return f(v)
+}
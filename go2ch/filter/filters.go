@@ -1,38 +1,93 @@
 package filter
 
 import (
+	"fmt"
+
 	"go2ch/go2ch/config"
 )
 
 const (
 	filterDrop         = "drop"
+	filterKeep         = "keep"
+	filterSample       = "sample"
 	filterRemoveFields = "remove_field"
 	filterTransfer     = "transfer"
 	filterTimeFormat   = "time_format"
+	filterEval         = "eval"
+	filterSet          = "set" // the same as eval
+	filterFlatten      = "flatten"
+	filterUnflatten    = "unflatten"
 	opAnd              = "and"
 	opOr               = "or"
-	typeContains       = "contains"
-	typeMatch          = "match"
+)
+
+// types of conditions, see compileCondition
+const (
+	typeMatch    = "match" // the same as eq, kept for old configurations
+	typeContains = "contains"
+	typeEq       = "eq"
+	typeNe       = "ne"
+	typeIn       = "in"
+	typePrefix   = "prefix"
+	typeSuffix   = "suffix"
+	typeRegex    = "regex"
+	typeExists   = "exists"
+	typeGt       = "gt"
+	typeGte      = "gte"
+	typeLt       = "lt"
+	typeLte      = "lte"
+	typeBetween  = "between"
 )
 
 type FilterFunc func(map[string]interface{}) map[string]interface{}
 
 // CreateFilters creates a serial of filters according to cluster config.
-func CreateFilters(p *config.Cluster) []FilterFunc {
+// The fields of filters may be dotted paths like a.b[0].c into nested objects and arrays.
+// Conditions, expressions and paths are compiled here once, and invalid ones are rejected.
+func CreateFilters(p *config.Cluster) ([]FilterFunc, error) {
 	var filters []FilterFunc
 
-	for _, f := range p.Filters {
-		switch f.Action {
-		case filterDrop:
-			filters = append(filters, DropFilter(f.Conditions))
-		case filterRemoveFields:
-			filters = append(filters, RemoveFieldFilter(f.Fields))
-		case filterTransfer:
-			filters = append(filters, TransferFilter(f.Field, f.Target))
-		case filterTimeFormat:
-			filters = append(filters, TimeFormatFilter(f.Field, f.Layout, f.Local))
+	for i, f := range p.Filters {
+		filter, err := createFilter(f)
+		if err != nil {
+			return nil, fmt.Errorf("createFilters | %s: %v", Name(i, f), err)
+		}
+		filters = append(filters, filter)
+	}
+
+	return filters, nil
+}
+
+// createFilter creates the filter of f by its action
+func createFilter(f config.Filter) (FilterFunc, error) {
+	switch f.Action {
+	case filterDrop:
+		return DropFilter(f.Conditions)
+	case filterKeep:
+		return KeepFilter(f.Conditions)
+	case filterSample:
+		return SampleFilter(f.Conditions, f.Field, f.Percent)
+	case filterRemoveFields:
+		return RemoveFieldFilter(f.Fields)
+	case filterTransfer:
+		return TransferFilter(f.Field, f.Target)
+	case filterEval, filterSet:
+		return EvalFilter(f.Field, f.Expr)
+	case filterTimeFormat:
+		fields := f.Fields
+		if f.Field != "" {
+			fields = append([]string{f.Field}, fields...)
 		}
+		return TimeFormatFilter(fields, f.Layout, f.Local)
+	case filterFlatten:
+		return FlattenFilter(f.Fields, f.Separator, f.MaxDepth)
+	case filterUnflatten:
+		return UnflattenFilter(f.Fields, f.Separator, f.MaxDepth)
 	}
+	return nil, fmt.Errorf("unknown action [%s]", f.Action)
+}
 
-	return filters
+// Name returns the name of the ith filter f in configuration, which labels its metrics
+func Name(i int, f config.Filter) string {
+	return fmt.Sprintf("%s_%d", f.Action, i)
 }
@@ -0,0 +1,31 @@
+package filter
+
+import (
+	"testing"
+
+	"go2ch/go2ch/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateFilters(t *testing.T) {
+	filters, err := CreateFilters(&config.Cluster{Filters: []config.Filter{
+		{Action: filterFlatten, Separator: "_"},
+		{Action: filterDrop, Conditions: []config.Condition{{Key: "user_geo_country", Value: "cn"}}},
+		{Action: filterRemoveFields, Fields: []string{"user_tags[0]"}},
+	}})
+	assert.Nil(t, err)
+	assert.Len(t, filters, 3)
+
+	tests := []config.Filter{
+		{Action: "unknown"},
+		{Action: filterDrop, Conditions: []config.Condition{{Key: "a", Type: typeRegex, Value: "("}}},
+		{Action: filterRemoveFields, Fields: []string{"a..b"}},
+		{Action: filterEval, Field: "a", Expr: "1 +"},
+		{Action: filterTimeFormat, Field: "a", Local: "Nowhere/Unknown"},
+	}
+	for _, f := range tests {
+		_, err := CreateFilters(&config.Cluster{Filters: []config.Filter{f}})
+		assert.NotNil(t, err, f.Action)
+	}
+}
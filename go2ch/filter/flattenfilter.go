@@ -0,0 +1,129 @@
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go2ch/go2ch/util"
+)
+
+// FlattenFilter turns nested objects into top-level fields, whose keys are the keys on the way joined by separator like a_b_c,
+// so that nested messages map onto flat tables. Objects deeper than maxDepth are kept as values, 0 means no limit,
+// and arrays are always kept as values. Only the objects at fields are flattened if fields are given, they may be dotted paths.
+// A key which is in the message already is not overwritten by a flattened one.
+func FlattenFilter(fields []string, separator string, maxDepth int) (FilterFunc, error) {
+	if separator == "" {
+		return nil, fmt.Errorf("flattenFilter | separator is required")
+	}
+	paths, err := newFieldPaths(fields)
+	if err != nil {
+		return nil, fmt.Errorf("flattenFilter | %v", err)
+	}
+
+	return func(m map[string]interface{}) map[string]interface{} {
+		targets := paths
+		if len(targets) == 0 {
+			// the keys are collected before flattening, since m is changed along the way
+			targets = make([]fieldPath, 0)
+			for key, v := range m {
+				if _, ok := v.(map[string]interface{}); ok {
+					targets = append(targets, fieldPath{raw: key})
+				}
+			}
+		}
+		for _, path := range targets {
+			v, ok := path.get(m)
+			object, isObject := v.(map[string]interface{})
+			if !ok || !isObject || len(object) == 0 {
+				continue
+			}
+			path.delete(m)
+			prefix := strings.ReplaceAll(path.raw, string(util.Dot), separator)
+			flatten(m, prefix, object, separator, 1, maxDepth)
+		}
+		return m
+	}, nil
+}
+
+// flatten puts the fields of object at depth into m, with keys prefixed by prefix and separator
+func flatten(m map[string]interface{}, prefix string, object map[string]interface{}, separator string, depth, maxDepth int) {
+	for k, v := range object {
+		key := prefix + separator + k
+		if child, ok := v.(map[string]interface{}); ok && len(child) > 0 && (maxDepth <= 0 || depth < maxDepth) {
+			flatten(m, key, child, separator, depth+1, maxDepth)
+			continue
+		}
+		if _, ok := m[key]; !ok {
+			m[key] = v
+		}
+	}
+}
+
+// UnflattenFilter is the reverse of FlattenFilter, it turns the top-level fields whose keys have separator into nested objects,
+// like a_b_c into {"a": {"b": {"c": ...}}}. Keys are split at most maxDepth times, 0 means no limit.
+// Only fields are unflattened if they are given. A field is left as it is if it would overwrite a value in the message.
+func UnflattenFilter(fields []string, separator string, maxDepth int) (FilterFunc, error) {
+	if separator == "" {
+		return nil, fmt.Errorf("unflattenFilter | separator is required")
+	}
+	n := -1
+	if maxDepth > 0 {
+		n = maxDepth + 1
+	}
+
+	return func(m map[string]interface{}) map[string]interface{} {
+		keys := fields
+		if len(keys) == 0 {
+			keys = make([]string, 0)
+			for key := range m {
+				if strings.Contains(key, separator) {
+					keys = append(keys, key)
+				}
+			}
+			// sorted so that the same message is always unflattened the same way
+			sort.Strings(keys)
+		}
+		for _, key := range keys {
+			v, ok := m[key]
+			if !ok {
+				continue
+			}
+			parts := strings.SplitN(key, separator, n)
+			if len(parts) > 1 && unflatten(m, parts, v) {
+				delete(m, key)
+			}
+		}
+		return m
+	}, nil
+}
+
+// unflatten sets v at the nested keys of parts in m, and reports whether it is set
+func unflatten(m map[string]interface{}, parts []string, v interface{}) bool {
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	object := m
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := object[part]
+		if !ok {
+			child := make(map[string]interface{})
+			object[part] = child
+			object = child
+			continue
+		}
+		child, ok := next.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		object = child
+	}
+	last := parts[len(parts)-1]
+	if _, ok := object[last]; ok {
+		return false
+	}
+	object[last] = v
+	return true
+}
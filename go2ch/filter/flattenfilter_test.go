@@ -0,0 +1,163 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlattenFilter(t *testing.T) {
+	input := func() map[string]interface{} {
+		return map[string]interface{}{
+			"id": "1",
+			"user": map[string]interface{}{
+				"name": "ada",
+				"geo":  map[string]interface{}{"country": "uk", "city": map[string]interface{}{"name": "london"}},
+				"tags": []interface{}{"a"},
+			},
+			"empty":      map[string]interface{}{},
+			"user_name":  "kept",
+			"extra":      map[string]interface{}{"k": "v"},
+			"dotted.key": "x",
+		}
+	}
+
+	tests := []struct {
+		name      string
+		fields    []string
+		separator string
+		maxDepth  int
+		expect    map[string]interface{}
+	}{
+		{
+			name:      "all",
+			separator: "_",
+			expect: map[string]interface{}{
+				"id":                 "1",
+				"user_name":          "kept",
+				"user_geo_country":   "uk",
+				"user_geo_city_name": "london",
+				"user_tags":          []interface{}{"a"},
+				"empty":              map[string]interface{}{},
+				"extra_k":            "v",
+				"dotted.key":         "x",
+			},
+		},
+		{
+			name:      "max depth",
+			separator: ".",
+			maxDepth:  2,
+			expect: map[string]interface{}{
+				"id":               "1",
+				"user.name":        "ada",
+				"user.geo.country": "uk",
+				"user.geo.city":    map[string]interface{}{"name": "london"},
+				"user.tags":        []interface{}{"a"},
+				"user_name":        "kept",
+				"empty":            map[string]interface{}{},
+				"extra.k":          "v",
+				"dotted.key":       "x",
+			},
+		},
+		{
+			name:      "path",
+			fields:    []string{"user.geo"},
+			separator: "_",
+			maxDepth:  1,
+			expect: map[string]interface{}{
+				"id": "1",
+				"user": map[string]interface{}{
+					"name": "ada",
+					"tags": []interface{}{"a"},
+				},
+				"user_geo_country": "uk",
+				"user_geo_city":    map[string]interface{}{"name": "london"},
+				"empty":            map[string]interface{}{},
+				"user_name":        "kept",
+				"extra":            map[string]interface{}{"k": "v"},
+				"dotted.key":       "x",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := FlattenFilter(test.fields, test.separator, test.maxDepth)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, f(input()))
+		})
+	}
+
+	_, err := FlattenFilter(nil, "", 0)
+	assert.NotNil(t, err)
+}
+
+func TestUnflattenFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []string
+		maxDepth int
+		input    map[string]interface{}
+		expect   map[string]interface{}
+	}{
+		{
+			name: "all",
+			input: map[string]interface{}{
+				"id":               "1",
+				"user_name":        "ada",
+				"user_geo_country": "uk",
+				"user_geo_city":    "london",
+				"_private":         "x",
+			},
+			expect: map[string]interface{}{
+				"id": "1",
+				"user": map[string]interface{}{
+					"name": "ada",
+					"geo":  map[string]interface{}{"country": "uk", "city": "london"},
+				},
+				"_private": "x",
+			},
+		},
+		{
+			name:     "max depth",
+			maxDepth: 1,
+			input: map[string]interface{}{
+				"user_geo_country": "uk",
+			},
+			expect: map[string]interface{}{
+				"user": map[string]interface{}{"geo_country": "uk"},
+			},
+		},
+		{
+			name:   "fields",
+			fields: []string{"user_name", "missing_key"},
+			input: map[string]interface{}{
+				"user_name": "ada",
+				"trace_id":  "t",
+			},
+			expect: map[string]interface{}{
+				"user":     map[string]interface{}{"name": "ada"},
+				"trace_id": "t",
+			},
+		},
+		{
+			name: "conflict",
+			input: map[string]interface{}{
+				"user":      "ada",
+				"user_name": "ada",
+			},
+			expect: map[string]interface{}{
+				"user":      "ada",
+				"user_name": "ada",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := UnflattenFilter(test.fields, "_", test.maxDepth)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, f(test.input))
+		})
+	}
+}
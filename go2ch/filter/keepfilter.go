@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+
+	"go2ch/go2ch/config"
+)
+
+// sampleBuckets are the buckets which messages are hashed into by sample filter, so that percent has 4 decimals
+const sampleBuckets = 1000000
+
+// KeepFilter is the inverse of DropFilter, only the data that meets the conditions is kept
+func KeepFilter(conditions []config.Condition) (FilterFunc, error) {
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("keepFilter | conditions are required, otherwise nothing is kept")
+	}
+	match, err := compileConditions(conditions)
+	if err != nil {
+		return nil, fmt.Errorf("keepFilter | %v", err)
+	}
+	return func(m map[string]interface{}) map[string]interface{} {
+		if !match(m) {
+			return nil
+		}
+		return m
+	}, nil
+}
+
+// SampleFilter keeps percent of the data that meets the conditions, or of all the data without conditions, and the rest passes.
+// With field, the data is kept by the hash of the value of field, so that the data of the same value, like a trace_id,
+// is always kept or dropped together. Without field, or if the data has no such field, it is kept at random.
+func SampleFilter(conditions []config.Condition, field string, percent float64) (FilterFunc, error) {
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("sampleFilter | percent must be in [0, 100], but got %v", percent)
+	}
+	var err error
+	match := predicate(func(m map[string]interface{}) bool {
+		return true
+	})
+	if len(conditions) > 0 {
+		if match, err = compileConditions(conditions); err != nil {
+			return nil, fmt.Errorf("sampleFilter | %v", err)
+		}
+	}
+	path, err := newFieldPath(field)
+	if err != nil {
+		return nil, fmt.Errorf("sampleFilter | %v", err)
+	}
+	kept := uint64(percent / 100 * sampleBuckets)
+
+	return func(m map[string]interface{}) map[string]interface{} {
+		if !match(m) {
+			return m
+		}
+		bucket := uint64(rand.Int63n(sampleBuckets))
+		if field != "" {
+			if v, ok := path.get(m); ok && v != nil {
+				bucket = sampleBucket(v)
+			}
+		}
+		if bucket >= kept {
+			return nil
+		}
+		return m
+	}, nil
+}
+
+// sampleBucket hashes v into one of sampleBuckets
+func sampleBucket(v interface{}) uint64 {
+	s, ok := v.(string)
+	if !ok {
+		s = fmt.Sprint(v)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64() % sampleBuckets
+}
@@ -0,0 +1,80 @@
+package filter
+
+import (
+	"fmt"
+	"testing"
+
+	"go2ch/go2ch/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepFilter(t *testing.T) {
+	f, err := KeepFilter([]config.Condition{{Key: "level", Type: typeIn, Values: []string{"warn", "error"}}})
+	assert.Nil(t, err)
+	assert.NotNil(t, f(map[string]interface{}{"level": "error"}))
+	assert.Nil(t, f(map[string]interface{}{"level": "debug"}))
+	assert.Nil(t, f(map[string]interface{}{}))
+
+	_, err = KeepFilter(nil)
+	assert.NotNil(t, err)
+	_, err = KeepFilter([]config.Condition{{Key: "a", Type: typeRegex, Value: "("}})
+	assert.NotNil(t, err)
+}
+
+func TestSampleFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []config.Condition
+		field      string
+		percent    float64
+		min, max   int // kept of 1000 messages
+	}{
+		{name: "all", percent: 100, min: 1000, max: 1000},
+		{name: "none", percent: 0, min: 0, max: 0},
+		{name: "by field", field: "trace_id", percent: 10, min: 50, max: 150},
+		{name: "at random", percent: 50, min: 400, max: 600},
+		{
+			name:       "only debug sampled",
+			conditions: []config.Condition{{Key: "level", Value: "debug"}},
+			field:      "trace_id",
+			percent:    0,
+			min:        500,
+			max:        500,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := SampleFilter(test.conditions, test.field, test.percent)
+			assert.Nil(t, err)
+
+			var kept int
+			for i := 0; i < 1000; i++ {
+				level := "debug"
+				if i%2 == 0 {
+					level = "info"
+				}
+				if f(map[string]interface{}{"trace_id": fmt.Sprintf("trace-%d", i), "level": level}) != nil {
+					kept++
+				}
+			}
+			assert.True(t, kept >= test.min && kept <= test.max, "kept %d", kept)
+		})
+	}
+}
+
+func TestSampleFilterDeterministic(t *testing.T) {
+	f, err := SampleFilter(nil, "trace_id", 30)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		m := map[string]interface{}{"trace_id": float64(i)}
+		first := f(m) != nil
+		for j := 0; j < 5; j++ {
+			assert.Equal(t, first, f(m) != nil)
+		}
+	}
+
+	_, err = SampleFilter(nil, "", 101)
+	assert.NotNil(t, err)
+}
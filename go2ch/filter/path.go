@@ -0,0 +1,220 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go2ch/go2ch/util"
+)
+
+// pathPart is a key of an object, or an index of an array in a field path
+type pathPart struct {
+	key   string
+	index int
+	array bool
+}
+
+// parsePath parses a dotted path like user.tags[0].name, an index counts from the end if it is negative
+func parsePath(path string) ([]pathPart, error) {
+	var parts []pathPart
+	for _, segment := range strings.Split(path, string(util.Dot)) {
+		key := segment
+		var indexes []int
+		if i := strings.IndexByte(segment, '['); i >= 0 {
+			key = segment[:i]
+			for rest := segment[i:]; rest != ""; {
+				end := strings.IndexByte(rest, ']')
+				if rest[0] != '[' || end < 0 {
+					return nil, fmt.Errorf("bad index in path [%s]", path)
+				}
+				index, err := strconv.Atoi(rest[1:end])
+				if err != nil {
+					return nil, fmt.Errorf("bad index in path [%s]", path)
+				}
+				indexes = append(indexes, index)
+				rest = rest[end+1:]
+			}
+		}
+		if key == "" && (len(parts) > 0 || len(indexes) == 0) {
+			return nil, fmt.Errorf("empty key in path [%s]", path)
+		}
+		if key != "" {
+			parts = append(parts, pathPart{key: key})
+		}
+		for _, index := range indexes {
+			parts = append(parts, pathPart{index: index, array: true})
+		}
+	}
+	return parts, nil
+}
+
+// fieldPath addresses a field of messages, which is a plain key, or a dotted path like user.geo.country or user.tags[0]
+// into nested objects and arrays. A key of message with dots is still taken as it is first.
+type fieldPath struct {
+	raw   string
+	parts []pathPart // nil for a plain key
+}
+
+// newFieldPath parses path once, so that it is only looked up for each message
+func newFieldPath(path string) (fieldPath, error) {
+	p := fieldPath{raw: path}
+	if strings.IndexByte(path, util.Dot) < 0 && strings.IndexByte(path, '[') < 0 {
+		return p, nil
+	}
+	parts, err := parsePath(path)
+	if err != nil {
+		return p, err
+	}
+	p.parts = parts
+	return p, nil
+}
+
+// newFieldPaths parses each of paths
+func newFieldPaths(paths []string) ([]fieldPath, error) {
+	ps := make([]fieldPath, 0, len(paths))
+	for _, path := range paths {
+		p, err := newFieldPath(path)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// get returns the field of m at p
+func (p fieldPath) get(m map[string]interface{}) (interface{}, bool) {
+	if v, ok := m[p.raw]; ok || p.parts == nil {
+		return v, ok
+	}
+	return lookup(m, p.parts)
+}
+
+// lookup returns the value at parts in v
+func lookup(v interface{}, parts []pathPart) (interface{}, bool) {
+	for _, part := range parts {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			if part.array {
+				return nil, false
+			}
+			var ok bool
+			if v, ok = value[part.key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, ok := arrayIndex(value, part)
+			if !ok {
+				return nil, false
+			}
+			v = value[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// set sets the field of m at p to v, the missing objects on the way are created.
+// It fails if p goes through a value which is not an object, or an index out of an array.
+func (p fieldPath) set(m map[string]interface{}, v interface{}) bool {
+	if _, ok := m[p.raw]; ok || p.parts == nil {
+		m[p.raw] = v
+		return true
+	}
+	parts := p.parts
+	parent, ok := walkParent(m, parts, true)
+	if !ok {
+		return false
+	}
+	last := parts[len(parts)-1]
+	switch value := parent.(type) {
+	case map[string]interface{}:
+		if last.array {
+			return false
+		}
+		value[last.key] = v
+		return true
+	case []interface{}:
+		i, ok := arrayIndex(value, last)
+		if ok {
+			value[i] = v
+		}
+		return ok
+	}
+	return false
+}
+
+// delete removes the field of m at p, and returns its value.
+// An element of array is removed by setting it null, so that the indexes of the others stay the same.
+func (p fieldPath) delete(m map[string]interface{}) (interface{}, bool) {
+	if v, ok := m[p.raw]; ok || p.parts == nil {
+		delete(m, p.raw)
+		return v, ok
+	}
+	parts := p.parts
+	parent, ok := walkParent(m, parts, false)
+	if !ok {
+		return nil, false
+	}
+	last := parts[len(parts)-1]
+	switch value := parent.(type) {
+	case map[string]interface{}:
+		v, ok := value[last.key]
+		if ok && !last.array {
+			delete(value, last.key)
+			return v, true
+		}
+	case []interface{}:
+		if i, ok := arrayIndex(value, last); ok {
+			v := value[i]
+			value[i] = nil
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// walkParent returns the parent of the last part of parts in m, the missing objects are created if create is set
+func walkParent(m map[string]interface{}, parts []pathPart, create bool) (interface{}, bool) {
+	var v interface{} = m
+	for i, part := range parts[:len(parts)-1] {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			if part.array {
+				return nil, false
+			}
+			next, ok := value[part.key]
+			if !ok || next == nil {
+				if !create || parts[i+1].array {
+					return nil, false
+				}
+				next = make(map[string]interface{})
+				value[part.key] = next
+			}
+			v = next
+		case []interface{}:
+			index, ok := arrayIndex(value, part)
+			if !ok {
+				return nil, false
+			}
+			v = value[index]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// arrayIndex returns the index of array which part points to, if it is in range
+func arrayIndex(array []interface{}, part pathPart) (int, bool) {
+	if !part.array {
+		return 0, false
+	}
+	i := part.index
+	if i < 0 {
+		i += len(array)
+	}
+	return i, i >= 0 && i < len(array)
+}
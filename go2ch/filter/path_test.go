@@ -0,0 +1,66 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldPath(t *testing.T) {
+	m := map[string]interface{}{
+		"a.b": "dotted key",
+		"user": map[string]interface{}{
+			"tags": []interface{}{"x", map[string]interface{}{"name": "y"}},
+		},
+		"matrix": []interface{}{[]interface{}{float64(1), float64(2)}},
+	}
+
+	tests := []struct {
+		path   string
+		expect interface{}
+		found  bool
+	}{
+		{path: "a.b", expect: "dotted key", found: true},
+		{path: "user.tags[0]", expect: "x", found: true},
+		{path: "user.tags[-1].name", expect: "y", found: true},
+		{path: "matrix[0][1]", expect: float64(2), found: true},
+		{path: "user.tags[2]"},
+		{path: "user.tags.name"},
+		{path: "user.missing.name"},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			p, err := newFieldPath(test.path)
+			assert.Nil(t, err)
+			v, ok := p.get(m)
+			assert.Equal(t, test.found, ok)
+			assert.Equal(t, test.expect, v)
+		})
+	}
+
+	for _, path := range []string{"a..b", "a[x]", "a[1", "a[0]b", "a.[0]"} {
+		_, err := newFieldPath(path)
+		assert.NotNil(t, err, path)
+	}
+}
+
+func TestFieldPathSet(t *testing.T) {
+	m := map[string]interface{}{"tags": []interface{}{"x"}, "s": "v"}
+
+	p, _ := newFieldPath("user.geo.country")
+	assert.True(t, p.set(m, "uk"))
+	p, _ = newFieldPath("tags[0]")
+	assert.True(t, p.set(m, "y"))
+	p, _ = newFieldPath("tags[1]")
+	assert.False(t, p.set(m, "z"))
+	p, _ = newFieldPath("s.t")
+	assert.False(t, p.set(m, "z"))
+	p, _ = newFieldPath("list[0].a")
+	assert.False(t, p.set(m, "z"))
+
+	assert.Equal(t, map[string]interface{}{
+		"tags": []interface{}{"y"},
+		"s":    "v",
+		"user": map[string]interface{}{"geo": map[string]interface{}{"country": "uk"}},
+	}, m)
+}
@@ -1,11 +1,19 @@
 package filter
 
-// RemoveFieldFilter removes the listed fields.
-func RemoveFieldFilter(fields []string) FilterFunc {
+import (
+	"fmt"
+)
+
+// RemoveFieldFilter removes the listed fields, which may be dotted paths into nested objects.
+func RemoveFieldFilter(fields []string) (FilterFunc, error) {
+	paths, err := newFieldPaths(fields)
+	if err != nil {
+		return nil, fmt.Errorf("removeFieldFilter | %v", err)
+	}
 	return func(m map[string]interface{}) map[string]interface{} {
-		for _, field := range fields {
-			delete(m, field)
+		for _, path := range paths {
+			path.delete(m)
 		}
 		return m
-	}
+	}, nil
 }
@@ -36,11 +36,25 @@ func TestRemoveFieldFilter(t *testing.T) {
 				"b": `{"c":"cc"}`,
 			},
 		},
+		{
+			name: "nested",
+			input: map[string]interface{}{
+				"a": map[string]interface{}{"b": "bb", "c": "cc"},
+				"d": []interface{}{"x", map[string]interface{}{"e": "ee", "f": "ff"}},
+			},
+			fields: []string{"a.b", "d[1].e", "d[5]", "a.x.y"},
+			expect: map[string]interface{}{
+				"a": map[string]interface{}{"c": "cc"},
+				"d": []interface{}{"x", map[string]interface{}{"f": "ff"}},
+			},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			actual := RemoveFieldFilter(test.fields)(test.input)
+			f, err := RemoveFieldFilter(test.fields)
+			assert.Nil(t, err)
+			actual := f(test.input)
 			assert.EqualValues(t, test.expect, actual)
 		})
 	}
@@ -1,17 +1,109 @@
 package filter
 
-const (
-	Time_Format_Layout_Field = "time_format_layout_10086"
-	Time_Format_Local_Field  = "time_format_local_10086"
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"go2ch/go2ch/util"
 )
 
-// TimeFormatFilter formats data to time.Time whose type is Date, Datetime or Datetime64
-func TimeFormatFilter(field, layout, local string) FilterFunc {
+// epochUnits are the layouts of time_format which take numbers, or numeric strings, as unix timestamps in the unit
+var epochUnits = map[string]time.Duration{
+	"unix":    time.Second,
+	"unix_ms": time.Millisecond,
+	"unix_us": time.Microsecond,
+	"unix_ns": time.Nanosecond,
+}
+
+// TimeFormatFilter parses the values of fields to time.Time, so that they are inserted into Date, DateTime or DateTime64 columns.
+// layout is a go time layout which strings are parsed by in location local, or one of epochUnits for unix timestamps.
+// Strings in RFC 3339 are always detected, and numbers are unix timestamps in seconds unless layout is one of epochUnits.
+// The values which can not be parsed are left as they are, and they are rejected if they can not be converted to the column.
+func TimeFormatFilter(fields []string, layout, local string) (FilterFunc, error) {
+	loc, err := util.LoadLocation(local)
+	if err != nil {
+		return nil, fmt.Errorf("timeFormatFilter | load location[%s] failed: %v", local, err)
+	}
+	paths, err := newFieldPaths(fields)
+	if err != nil {
+		return nil, fmt.Errorf("timeFormatFilter | %v", err)
+	}
+	unit, epoch := epochUnits[layout]
+	if !epoch {
+		unit = time.Second
+	}
+
 	return func(m map[string]interface{}) map[string]interface{} {
-		if _, ok := m[field]; ok {
-			m[Time_Format_Layout_Field] = layout
-			m[Time_Format_Local_Field] = local
+		for _, path := range paths {
+			v, ok := path.get(m)
+			if !ok {
+				continue
+			}
+			if t, ok := parseTime(v, layout, epoch, unit, loc); ok {
+				path.set(m, t)
+			}
 		}
 		return m
+	}, nil
+}
+
+// parseTime parses v by layout in loc, or as a unix timestamp in unit if it is a number or epoch is set
+func parseTime(v interface{}, layout string, epoch bool, unit time.Duration, loc *time.Location) (time.Time, bool) {
+	switch value := v.(type) {
+	case time.Time:
+		return value, true
+	case string:
+		value = strings.TrimSpace(value)
+		if epoch {
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return unixTime(i, unit), true
+			}
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				return unixTimeFloat(f, unit), true
+			}
+		} else if layout != "" {
+			if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+				return t, true
+			}
+		}
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, true
+		}
+		return time.Time{}, false
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < math.MaxInt64 {
+			return unixTime(int64(value), unit), true
+		}
+		return unixTimeFloat(value, unit), true
+	case float32:
+		return unixTimeFloat(float64(value), unit), true
+	case int:
+		return unixTime(int64(value), unit), true
+	case int32:
+		return unixTime(int64(value), unit), true
+	case int64:
+		return unixTime(value, unit), true
+	case uint32:
+		return unixTime(int64(value), unit), true
+	case uint64:
+		if value <= math.MaxInt64 {
+			return unixTime(int64(value), unit), true
+		}
 	}
+	return time.Time{}, false
+}
+
+// unixTime returns the time of unix timestamp n in unit
+func unixTime(n int64, unit time.Duration) time.Time {
+	perSecond := int64(time.Second / unit)
+	return time.Unix(n/perSecond, n%perSecond*int64(unit))
+}
+
+// unixTimeFloat returns the time of unix timestamp f in unit, which may have a fraction
+func unixTimeFloat(f float64, unit time.Duration) time.Time {
+	sec, frac := math.Modf(f / float64(time.Second/unit))
+	return time.Unix(int64(sec), int64(frac*1e9))
 }
@@ -0,0 +1,83 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeFormatFilter(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name   string
+		layout string
+		input  interface{}
+		expect interface{}
+	}{
+		{
+			name:   "layout in location",
+			layout: "2006-01-02 15:04:05",
+			input:  "2020-09-13 20:26:40",
+			expect: time.Date(2020, 9, 13, 20, 26, 40, 0, shanghai),
+		},
+		{
+			name:   "rfc3339 detected",
+			layout: "2006-01-02 15:04:05",
+			input:  "2020-09-13T12:26:40Z",
+			expect: time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC),
+		},
+		{
+			name:   "seconds without layout",
+			input:  float64(1600000000),
+			expect: time.Unix(1600000000, 0),
+		},
+		{
+			name:   "millis",
+			layout: "unix_ms",
+			input:  float64(1600000000123),
+			expect: time.Unix(1600000000, 123e6),
+		},
+		{
+			name:   "micros from string",
+			layout: "unix_us",
+			input:  "1600000000000123",
+			expect: time.Unix(1600000000, 123e3),
+		},
+		{
+			name:   "nanos",
+			layout: "unix_ns",
+			input:  int64(1600000000000000123),
+			expect: time.Unix(1600000000, 123),
+		},
+		{
+			name:   "seconds with fraction",
+			layout: "unix",
+			input:  1600000000.5,
+			expect: time.Unix(1600000000, 5e8),
+		},
+		{
+			name:   "not parsed",
+			layout: "2006-01-02",
+			input:  "13/09/2020",
+			expect: "13/09/2020",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := TimeFormatFilter([]string{"a", "b"}, test.layout, "Asia/Shanghai")
+			assert.Nil(t, err)
+
+			actual := f(map[string]interface{}{"a": test.input, "b": test.input, "c": test.input})
+			assert.Equal(t, test.expect, actual["a"])
+			assert.Equal(t, test.expect, actual["b"])
+			assert.Equal(t, test.input, actual["c"])
+		})
+	}
+
+	_, err = TimeFormatFilter([]string{"a"}, "", "Nowhere/Unknown")
+	assert.NotNil(t, err)
+}
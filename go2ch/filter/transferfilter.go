@@ -1,17 +1,28 @@
 package filter
 
-// TransferFilter transfers a filed identifier.
-func TransferFilter(field, target string) FilterFunc {
+import (
+	"fmt"
+)
+
+// TransferFilter transfers a filed identifier, field and target may be dotted paths into nested objects.
+func TransferFilter(field, target string) (FilterFunc, error) {
+	from, err := newFieldPath(field)
+	if err != nil {
+		return nil, fmt.Errorf("transferFilter | %v", err)
+	}
+	to, err := newFieldPath(target)
+	if err != nil {
+		return nil, fmt.Errorf("transferFilter | %v", err)
+	}
 	return func(m map[string]interface{}) map[string]interface{} {
-		val, ok := m[field]
+		val, ok := from.get(m)
 		if !ok {
 			return m
 		}
-		if len(target) > 0 {
-			m[target] = val
-			delete(m, field)
+		if len(target) > 0 && target != field && to.set(m, val) {
+			from.delete(m)
 		}
 
 		return m
-	}
+	}, nil
 }
@@ -87,11 +87,65 @@ func TestTransferFilter(t *testing.T) {
 				"b": map[string]interface{}{"c": "cc"},
 			},
 		},
+		{
+			name: "from nested",
+			input: map[string]interface{}{
+				"a": map[string]interface{}{"b": "bb", "c": "cc"},
+			},
+			field:  "a.b",
+			target: "b",
+			expect: map[string]interface{}{
+				"a": map[string]interface{}{"c": "cc"},
+				"b": "bb",
+			},
+		},
+		{
+			name: "to nested",
+			input: map[string]interface{}{
+				"a": "aa",
+				"tags": []interface{}{
+					map[string]interface{}{"name": "x"},
+				},
+			},
+			field:  "tags[0].name",
+			target: "user.tag",
+			expect: map[string]interface{}{
+				"a":    "aa",
+				"tags": []interface{}{map[string]interface{}{}},
+				"user": map[string]interface{}{"tag": "x"},
+			},
+		},
+		{
+			name: "key with dots",
+			input: map[string]interface{}{
+				"a.b": "ab",
+			},
+			field:  "a.b",
+			target: "ab",
+			expect: map[string]interface{}{
+				"ab": "ab",
+			},
+		},
+		{
+			name: "through a value which is not an object",
+			input: map[string]interface{}{
+				"a": "aa",
+				"b": "bb",
+			},
+			field:  "a",
+			target: "b.c",
+			expect: map[string]interface{}{
+				"a": "aa",
+				"b": "bb",
+			},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			actual := TransferFilter(test.field, test.target)(test.input)
+			f, err := TransferFilter(test.field, test.target)
+			assert.Nil(t, err)
+			actual := f(test.input)
 			assert.EqualValues(t, test.expect, actual)
 		})
 	}
@@ -3,21 +3,27 @@ package main
 import (
 	"context"
 	"flag"
+	"io"
 	"net/http"
 	"time"
 
-	"github.com/zeromicro/go-queue/kq"
 	"github.com/zeromicro/go-zero/core/logx"
 	"github.com/zeromicro/go-zero/core/proc"
+	"github.com/zeromicro/go-zero/core/prometheus"
 	"github.com/zeromicro/go-zero/core/service"
+	"github.com/zeromicro/go-zero/core/syncx"
 	"github.com/zeromicro/go-zero/rest"
 
 	"go2ch/go2ch/ch"
 	"go2ch/go2ch/config"
+	"go2ch/go2ch/decoder"
+	"go2ch/go2ch/dlq"
 	"go2ch/go2ch/filter"
 	"go2ch/go2ch/handler"
 	kf "go2ch/go2ch/kafka"
+	"go2ch/go2ch/output"
 	"go2ch/go2ch/producer/pusher"
+	"go2ch/go2ch/status"
 )
 
 var configFile = flag.String("f", "etc/config.yml", "Specify the config file")
@@ -38,30 +44,98 @@ func main() {
 	// sets the waiting time before force quitting.
 	proc.SetTimeToForceQuit(time.Duration(c.GracePeriodSecond) * time.Second)
 
+	// expose metrics in prometheus format
+	prometheus.StartAgent(c.Prometheus)
+
 	// create a new go-zero service group
 	group := service.NewServiceGroup()
-	defer group.Stop()
 
+	// decoders stop waiting for external services first, so that consumers can be stopped.
+	// Outputs and dead letters are closed in order once consumers are stopped, so that nothing is written to them
+	// after closing, and the rows flushed by closing outputs still reach the dead letters
+	var decoders []io.Closer
+	var outputsList [][]output.Output
+	var deadLetters []dlq.DeadLetter
+	var names []string
+	shutdown := syncx.Once(func() {
+		for _, d := range decoders {
+			_ = d.Close()
+		}
+		group.Stop()
+		for i, outputs := range outputsList {
+			for _, o := range outputs {
+				if err := o.Close(); err != nil {
+					logx.Errorf("close output of cluster[%s] failed: %v", names[i], err)
+				}
+			}
+		}
+		for i, deadLetter := range deadLetters {
+			if err := deadLetter.Close(); err != nil {
+				logx.Errorf("close dead letter of cluster[%s] failed: %v", names[i], err)
+			}
+		}
+	})
+	proc.AddShutdownListener(shutdown)
+	defer shutdown()
+
+	statusClusters := make([]*status.Cluster, 0, len(c.Clusters))
 	for _, cluster := range c.Clusters {
-		// clickhouse writer
 		ctx := context.Background()
-		chWriter, err := ch.NewWriter(ctx, cluster.Output.ClickHouse)
+
+		// dead letter queue for the rows rejected in pipeline
+		deadLetter, err := dlq.NewDeadLetter(ctx, cluster)
+		if err != nil {
+			panic(err)
+		}
+
+		// outputs which rows fan out to
+		outputs, err := output.NewOutputs(ctx, cluster, deadLetter)
 		if err != nil {
 			panic(err)
 		}
+		outputsList = append(outputsList, outputs)
+		deadLetters = append(deadLetters, deadLetter)
+		names = append(names, cluster.Input.Kafka.Name)
+
+		statusCluster := &status.Cluster{
+			Name:    cluster.Input.Kafka.Name,
+			Brokers: cluster.Input.Kafka.Brokers,
+			Group:   cluster.Input.Kafka.Group,
+			Topics:  cluster.Input.Kafka.Topics,
+		}
+		for _, o := range outputs {
+			if w, ok := o.(*ch.Writer); ok {
+				statusCluster.Writer = w
+			}
+		}
+		statusClusters = append(statusClusters, statusCluster)
 
 		// data filters
-		filters := filter.CreateFilters(cluster)
+		filters, err := filter.CreateFilters(cluster)
+		if err != nil {
+			panic(err)
+		}
+
+		// decoder of kafka messages
+		dec, err := decoder.NewDecoder(cluster.Input.Decoder)
+		if err != nil {
+			panic(err)
+		}
+		if closer, ok := dec.(io.Closer); ok {
+			decoders = append(decoders, closer)
+		}
 
 		// data handler
-		handle := handler.NewHandler(chWriter)
-		handle.AddFilters(filters...)
+		handle := handler.NewHandler(cluster.Input.Kafka.Name, dec, outputs, deadLetter)
+		for i, f := range filters {
+			handle.AddFilter(filter.Name(i, cluster.Filters[i]), f)
+		}
 		//handle.AddFilters(filter.AddUriFieldFilter("url", "uri"))
 
 		// kafka
 		ks := config.GetKafkaConf(cluster.Input.Kafka)
 		for _, k := range ks {
-			mq, err := kq.NewQueue(*k, handle)
+			mq, err := kf.NewQueue(*k, handle)
 			if err != nil {
 				panic(err)
 			}
@@ -96,10 +170,32 @@ func main() {
 				Method:  http.MethodPost,
 				Handler: kp.PushList,
 			},
+			{
+				Path:    "/replay",
+				Method:  http.MethodPost,
+				Handler: kp.Replay,
+			},
 		})
 		group.Add(ser)
 	}
 
+	// start a service to serve health, readiness and status of clusters
+	if c.Status != nil {
+		ser, err := rest.NewServer(rest.RestConf{
+			Port: c.Status.Port,
+			ServiceConf: service.ServiceConf{
+				Log: logx.LogConf{
+					Path: "./log/go2ch/status",
+				},
+			},
+		})
+		if err != nil {
+			panic(err)
+		}
+		ser.AddRoutes(status.NewServer(statusClusters).Routes())
+		group.Add(ser)
+	}
+
 	// start go-zero service
 	group.Start()
 
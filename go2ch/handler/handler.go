@@ -1,70 +1,131 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
-	jsoniter "github.com/json-iterator/go"
-	"go2ch/go2ch/ch"
+
+	"go2ch/go2ch/decoder"
+	"go2ch/go2ch/dlq"
 	"go2ch/go2ch/filter"
-	"time"
+	kf "go2ch/go2ch/kafka"
+	"go2ch/go2ch/metrics"
+	"go2ch/go2ch/output"
+	"go2ch/go2ch/pipeline"
 )
 
-var index int64 = 0
-var total int64 = 0
-
 type MessageHandler struct {
-	writer  *ch.Writer
-	filters []filter.FilterFunc
+	name       string
+	decoder    decoder.Decoder
+	outputs    []output.Output
+	filters    []namedFilter
+	deadLetter dlq.DeadLetter
+}
+
+// namedFilter is a filter with the name which labels its metrics
+type namedFilter struct {
+	name string
+	f    filter.FilterFunc
 }
 
-// NewHandler creates a new message handler which is used to consume the message from kafka
-func NewHandler(writer *ch.Writer) *MessageHandler {
+// NewHandler creates a new message handler of cluster name which is used to consume the message from kafka,
+// messages are decoded into rows by dec and written to every one of outputs,
+// and the messages which can not be handled are sent to deadLetter
+func NewHandler(name string, dec decoder.Decoder, outputs []output.Output, deadLetter dlq.DeadLetter) *MessageHandler {
 	return &MessageHandler{
-		writer:  writer,
-		filters: []filter.FilterFunc{filter.RecoverFilter("kafka")},
+		name:       name,
+		decoder:    dec,
+		outputs:    outputs,
+		filters:    []namedFilter{{name: "recover", f: filter.RecoverFilter("kafka")}},
+		deadLetter: deadLetter,
 	}
 }
 
-// AddFilters adds filters
+// AddFilters adds filters, they are named by their positions in handler
 func (mh *MessageHandler) AddFilters(filters ...filter.FilterFunc) {
 	for _, f := range filters {
-		mh.filters = append(mh.filters, f)
+		mh.AddFilter(fmt.Sprintf("filter_%d", len(mh.filters)), f)
 	}
 }
 
-// Consume writes data to clickhouse execute chunk
-func (mh *MessageHandler) Consume(key, value string) error {
-
-	index++
+// AddFilter adds a filter named name
+func (mh *MessageHandler) AddFilter(name string, f filter.FilterFunc) {
+	mh.filters = append(mh.filters, namedFilter{name: name, f: f})
+}
 
-	start := time.Now().UnixNano()
+// Consume decodes the message into rows and writes them to outputs.
+// The message is acked once each of its rows is written by every output, dropped by filters or kept by dead letter.
+func (mh *MessageHandler) Consume(msg *kf.Message) error {
+	rows, err := mh.decoder.Decode(msg.Value)
+	if errors.Is(err, decoder.ErrClosed) {
+		// not acked, the message is consumed again after restarting
+		return fmt.Errorf("consume | %v", err)
+	}
+	if err != nil {
+		err = fmt.Errorf("consume | decode value failed: %v", err)
+		return mh.reject(dlq.NewRecord(msg.Topic, string(msg.Key), msg.Value, dlq.StageDecode, err), msg.Ack, err)
+	}
+	if len(rows) == 0 {
+		msg.Ack()
+		return nil
+	}
 
-	var m map[string]interface{}
-	if err := jsoniter.Unmarshal([]byte(value), &m); err != nil {
-		return fmt.Errorf("consume | unmarshal value to map failed: %v", err)
+	// every row is consumed even if some fail, otherwise the message would never be acked
+	ack := output.AckAfter(len(rows), msg.Ack)
+	origin := pipeline.Row{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Payload:   string(msg.Value),
 	}
+	var firstErr error
+	for i, m := range rows {
+		row := origin
+		row.Index = i
+		if err := mh.consumeRow(row, m, ack); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
 
+// consumeRow passes m through filters and writes it to outputs in a row like origin, ack is called once m is done.
+// The fields of row are not encoded again, each output takes them as they are.
+// A row failing in an output is rejected for that output only, the others still get it.
+func (mh *MessageHandler) consumeRow(origin pipeline.Row, m map[string]interface{}, ack func()) error {
 	for _, f := range mh.filters {
-		if m = f(m); m == nil {
-			return fmt.Errorf("consume | m became nil")
+		// the row is dropped by filter on purpose, it is not a rejection
+		if m = f.f(m); m == nil {
+			metrics.MessagesDropped.Inc(mh.name, f.name)
+			ack()
+			return nil
 		}
 	}
 
-	bs, err := jsoniter.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("consume | marshal map to bytes failed: %v", err)
+	ack = output.AckAfter(len(mh.outputs), ack)
+	var firstErr error
+	for _, o := range mh.outputs {
+		row := origin
+		row.Fields = m
+		row.Ack = ack
+		if err := o.Write(&row); err != nil {
+			err = fmt.Errorf("consume | write data to output failed: %v", err)
+			err = mh.reject(row.Record(dlq.StageWrite, err), ack, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
+	return firstErr
+}
 
-	err = mh.writer.Write(string(bs))
-	if err != nil {
-		return fmt.Errorf("consume | write data to clickhouse executor chunk failed: %v", err)
+// reject sends the record of a message or row rejected because of err to the dead letter queue and returns err,
+// ack is called only if the record is kept by dead letter
+func (mh *MessageHandler) reject(record *dlq.Record, ack func(), err error) error {
+	metrics.RowsRejected.Inc(mh.name, record.Stage)
+	if e := mh.deadLetter.Put(record); e != nil {
+		return fmt.Errorf("%v, and put it to dead letter failed: %v", err, e)
 	}
-
-	end := time.Now().UnixNano()
-
-	use := end - start
-	total += use
-
-	fmt.Printf("consume function | write index=%d, length=%dbytes, one use time: %dns, total use time=%dns, avg=%dns\n", index, len(string(bs)), use, total, total/index)
-
-	return nil
+	ack()
+	return err
 }
@@ -0,0 +1,47 @@
+package kf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	describeTimeout = 5 * time.Second
+	groupStable     = "Stable"
+)
+
+// GroupState is the state of a consumer group
+type GroupState struct {
+	State   string `json:"state"`
+	Members int    `json:"members"`
+}
+
+// Stable reports whether the partitions are assigned to the members of group
+func (s *GroupState) Stable() bool {
+	return s.State == groupStable && s.Members > 0
+}
+
+// DescribeGroup returns the state of consumer group through brokers
+func DescribeGroup(ctx context.Context, brokers []string, group string) (*GroupState, error) {
+	client := &kafka.Client{
+		Addr:    kafka.TCP(brokers...),
+		Timeout: describeTimeout,
+	}
+	resp, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{group}})
+	if err != nil {
+		return nil, fmt.Errorf("describeGroup | describe consumer group[%s] failed: %v", group, err)
+	}
+	for _, g := range resp.Groups {
+		if g.GroupID != group {
+			continue
+		}
+		if g.Error != nil {
+			return nil, fmt.Errorf("describeGroup | describe consumer group[%s] failed: %v", group, g.Error)
+		}
+		return &GroupState{State: g.GroupState, Members: len(g.Members)}, nil
+	}
+	return nil, fmt.Errorf("describeGroup | consumer group[%s] is not found", group)
+}
@@ -57,6 +57,28 @@ func (w *Writer) Produce(datas ...interface{}) error {
 	return nil
 }
 
+// ProduceRaw sends a value to topic as it is, without encoding it to json again.
+// If topic is empty, the value is sent to all the topics of writer.
+func (w *Writer) ProduceRaw(topic string, key, value []byte) error {
+	topics := w.topics
+	if topic != "" {
+		topics = []string{topic}
+	}
+	messages := make([]kafka.Message, 0, len(topics))
+	for _, topic := range topics {
+		messages = append(messages, kafka.Message{
+			Topic: topic,
+			Key:   key,
+			Value: value,
+		})
+	}
+	err := w.Writer.WriteMessages(w.ctx, messages...)
+	if err != nil {
+		return fmt.Errorf("ProduceRaw | write messages to kafka failed: %v", err)
+	}
+	return nil
+}
+
 // getMessage encapsulates datas to a slice of kafka message
 func (w *Writer) getMessage(datas ...interface{}) ([]kafka.Message, error) {
 	messages := make([]kafka.Message, 0)
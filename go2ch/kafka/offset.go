@@ -0,0 +1,78 @@
+package kf
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// offsetTracker tracks the messages fetched from kafka and tells which one can be committed.
+// Messages of a partition may be acked out of order, but an offset is committed only after
+// all the messages before it in the same partition have been acked.
+type offsetTracker struct {
+	lock       sync.Mutex
+	partitions map[int]*partitionOffsets
+	commit     func(kafka.Message)
+}
+
+type partitionOffsets struct {
+	pending []kafka.Message // fetched but not committed messages in offset order
+	acked   map[int64]bool
+}
+
+// newOffsetTracker creates an offset tracker which calls commit with the message to commit
+func newOffsetTracker(commit func(kafka.Message)) *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[int]*partitionOffsets),
+		commit:     commit,
+	}
+}
+
+// track records a fetched message
+func (t *offsetTracker) track(msg kafka.Message) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	p, ok := t.partitions[msg.Partition]
+	// the reader rewinds when the partition is reassigned, the messages are fetched again from the committed offset
+	if !ok || (len(p.pending) > 0 && msg.Offset <= p.pending[len(p.pending)-1].Offset) {
+		p = &partitionOffsets{acked: make(map[int64]bool)}
+		t.partitions[msg.Partition] = p
+	}
+	p.pending = append(p.pending, msg)
+}
+
+// ack marks msg as processed, and commits the largest offset whose previous messages are all acked.
+// Acks of the messages not pending are ignored, like the ones fetched before the partition is reset by track,
+// otherwise they would be kept in acked forever.
+func (t *offsetTracker) ack(msg kafka.Message) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	p, ok := t.partitions[msg.Partition]
+	if !ok || !p.isPending(msg.Offset) {
+		return
+	}
+	p.acked[msg.Offset] = true
+
+	var last *kafka.Message
+	for len(p.pending) > 0 && p.acked[p.pending[0].Offset] {
+		delete(p.acked, p.pending[0].Offset)
+		last = &p.pending[0]
+		p.pending = p.pending[1:]
+	}
+
+	// commits in lock to keep the order of offsets
+	if last != nil {
+		t.commit(*last)
+	}
+}
+
+// isPending reports whether the message at offset is fetched but not committed
+func (p *partitionOffsets) isPending(offset int64) bool {
+	i := sort.Search(len(p.pending), func(i int) bool {
+		return p.pending[i].Offset >= offset
+	})
+	return i < len(p.pending) && p.pending[i].Offset == offset
+}
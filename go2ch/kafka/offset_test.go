@@ -0,0 +1,92 @@
+package kf
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	msg := func(partition int, offset int64) kafka.Message {
+		return kafka.Message{Topic: "t", Partition: partition, Offset: offset}
+	}
+
+	tests := []struct {
+		name    string
+		fetched []kafka.Message
+		acked   []kafka.Message
+		expect  []int64 // committed offsets in order
+	}{
+		{
+			name:    "in order",
+			fetched: []kafka.Message{msg(0, 1), msg(0, 2), msg(0, 3)},
+			acked:   []kafka.Message{msg(0, 1), msg(0, 2), msg(0, 3)},
+			expect:  []int64{1, 2, 3},
+		},
+		{
+			name:    "out of order",
+			fetched: []kafka.Message{msg(0, 1), msg(0, 2), msg(0, 3)},
+			acked:   []kafka.Message{msg(0, 3), msg(0, 2), msg(0, 1)},
+			expect:  []int64{3},
+		},
+		{
+			name:    "gap not acked",
+			fetched: []kafka.Message{msg(0, 1), msg(0, 2), msg(0, 3)},
+			acked:   []kafka.Message{msg(0, 1), msg(0, 3)},
+			expect:  []int64{1},
+		},
+		{
+			name:    "partitions are independent",
+			fetched: []kafka.Message{msg(0, 1), msg(1, 7), msg(0, 2), msg(1, 8)},
+			acked:   []kafka.Message{msg(1, 8), msg(0, 1), msg(1, 7)},
+			expect:  []int64{1, 8},
+		},
+		{
+			name:    "rewind after rebalance",
+			fetched: []kafka.Message{msg(0, 1), msg(0, 2), msg(0, 1), msg(0, 2)},
+			acked:   []kafka.Message{msg(0, 1), msg(0, 2)},
+			expect:  []int64{1, 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			committed := make([]int64, 0)
+			tracker := newOffsetTracker(func(msg kafka.Message) {
+				committed = append(committed, msg.Offset)
+			})
+			for _, m := range test.fetched {
+				tracker.track(m)
+			}
+			for _, m := range test.acked {
+				tracker.ack(m)
+			}
+			assert.Equal(t, test.expect, committed)
+		})
+	}
+}
+
+func TestOffsetTrackerIgnoresAcksNotPending(t *testing.T) {
+	msg := func(offset int64) kafka.Message {
+		return kafka.Message{Topic: "t", Partition: 0, Offset: offset}
+	}
+	committed := make([]int64, 0)
+	tracker := newOffsetTracker(func(msg kafka.Message) {
+		committed = append(committed, msg.Offset)
+	})
+
+	// the partition is reset by fetching from 2 again, the acks of 3 and 9 are for messages not pending
+	tracker.track(msg(1))
+	tracker.track(msg(2))
+	tracker.track(msg(3))
+	tracker.track(msg(2))
+	tracker.ack(msg(3))
+	tracker.ack(msg(9))
+	assert.Empty(t, tracker.partitions[0].acked)
+	assert.Empty(t, committed)
+
+	tracker.ack(msg(2))
+	assert.Equal(t, []int64{2}, committed)
+	assert.Empty(t, tracker.partitions[0].acked)
+}
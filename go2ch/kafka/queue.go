@@ -0,0 +1,180 @@
+package kf
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go2ch/go2ch/metrics"
+
+	"github.com/segmentio/kafka-go"
+	_ "github.com/segmentio/kafka-go/gzip"
+	_ "github.com/segmentio/kafka-go/lz4"
+	_ "github.com/segmentio/kafka-go/snappy"
+	"github.com/zeromicro/go-queue/kq"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/service"
+	"github.com/zeromicro/go-zero/core/threading"
+)
+
+const (
+	firstOffset    = "first"
+	commitInterval = time.Second
+	maxWait        = time.Second
+	queueCapacity  = 1000
+)
+
+// Message is a message fetched from kafka.
+// Ack must be called once the message is inserted or rejected, then its offset can be committed.
+type Message struct {
+	kafka.Message
+	Ack func()
+}
+
+// ConsumeHandler handles the messages fetched from kafka
+type ConsumeHandler interface {
+	Consume(msg *Message) error
+}
+
+// Queue consumes a kafka topic with at-least-once semantics.
+// Unlike kq, it does not commit the offset when the handler returns, but when the message is acked.
+type Queue struct {
+	c                kq.KqConf
+	consumer         *kafka.Reader
+	handler          ConsumeHandler
+	channel          chan kafka.Message
+	offsets          *offsetTracker
+	fetchLock        sync.Mutex
+	producerRoutines *threading.RoutineGroup
+	consumerRoutines *threading.RoutineGroup
+	started          int32         // accessed atomically, set once Start is called
+	done             chan struct{} // closed once the messages fetched are all handled after stopping
+}
+
+// NewQueue creates a service which consumes the topic in c with c.Conns connections
+func NewQueue(c kq.KqConf, handler ConsumeHandler) (service.Service, error) {
+	if err := c.SetUp(); err != nil {
+		return nil, err
+	}
+	if c.Conns < 1 {
+		c.Conns = 1
+	}
+
+	group := service.NewServiceGroup()
+	for i := 0; i < c.Conns; i++ {
+		group.Add(newQueue(c, handler))
+	}
+	return group, nil
+}
+
+func newQueue(c kq.KqConf, handler ConsumeHandler) *Queue {
+	offset := kafka.LastOffset
+	if c.Offset == firstOffset {
+		offset = kafka.FirstOffset
+	}
+	consumer := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:        c.Brokers,
+		GroupID:        c.Group,
+		Topic:          c.Topic,
+		StartOffset:    offset,
+		MinBytes:       c.MinBytes,
+		MaxBytes:       c.MaxBytes,
+		MaxWait:        maxWait,
+		CommitInterval: commitInterval,
+		QueueCapacity:  queueCapacity,
+	})
+
+	return &Queue{
+		c:        c,
+		consumer: consumer,
+		handler:  handler,
+		channel:  make(chan kafka.Message),
+		offsets: newOffsetTracker(func(msg kafka.Message) {
+			if err := consumer.CommitMessages(context.Background(), msg); err != nil {
+				logx.Errorf("Queue | commit offset[%d] of topic[%s] partition[%d] failed: %v", msg.Offset, msg.Topic, msg.Partition, err)
+			}
+		}),
+		producerRoutines: threading.NewRoutineGroup(),
+		consumerRoutines: threading.NewRoutineGroup(),
+		done:             make(chan struct{}),
+	}
+}
+
+// Start starts consuming
+func (q *Queue) Start() {
+	atomic.StoreInt32(&q.started, 1)
+	defer close(q.done)
+	q.startConsumers()
+	q.startProducers()
+
+	q.producerRoutines.Wait()
+	close(q.channel)
+	q.consumerRoutines.Wait()
+}
+
+// Stop stops consuming, and waits for the messages fetched to be handled, so that nothing is written to outputs
+// after it returns. The messages not acked yet are fetched again by next start
+func (q *Queue) Stop() {
+	q.consumer.Close()
+	if atomic.LoadInt32(&q.started) == 1 {
+		<-q.done
+	}
+}
+
+func (q *Queue) startConsumers() {
+	for i := 0; i < q.c.Processors; i++ {
+		q.consumerRoutines.Run(func() {
+			for msg := range q.channel {
+				msg := msg
+				err := q.handler.Consume(&Message{
+					Message: msg,
+					Ack: func() {
+						q.offsets.ack(msg)
+					},
+				})
+				if err != nil {
+					logx.Errorf("Error on consuming: %s, error: %v", string(msg.Value), err)
+				}
+			}
+		})
+	}
+}
+
+func (q *Queue) startProducers() {
+	for i := 0; i < q.c.Consumers; i++ {
+		q.producerRoutines.Run(func() {
+			for {
+				msg, err := q.fetch()
+				// io.EOF means consumer closed
+				// io.ErrClosedPipe means committing messages on the consumer,
+				// kafka will refire the messages on uncommitted messages, ignore
+				if err == io.EOF || err == io.ErrClosedPipe {
+					return
+				}
+				if err != nil {
+					logx.Errorf("Error on reading message, %q", err.Error())
+					continue
+				}
+				q.channel <- msg
+			}
+		})
+	}
+}
+
+// fetch fetches a message and tracks its offset, the messages must be tracked in the order they are fetched
+func (q *Queue) fetch() (kafka.Message, error) {
+	q.fetchLock.Lock()
+	defer q.fetchLock.Unlock()
+
+	msg, err := q.consumer.FetchMessage(context.Background())
+	if err != nil {
+		return msg, err
+	}
+	q.offsets.track(msg)
+	metrics.MessagesConsumed.Inc(q.c.Name, msg.Topic)
+	metrics.ConsumerLag.Set(float64(msg.HighWaterMark-msg.Offset-1), q.c.Name, msg.Topic, strconv.Itoa(msg.Partition))
+	return msg, nil
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"github.com/zeromicro/go-zero/core/metric"
+)
+
+const namespace = "go2ch"
+
+// all metrics are labeled by cluster, which is the name of kafka input of the cluster in configuration
+var (
+	// MessagesConsumed counts the messages consumed from kafka
+	MessagesConsumed = metric.NewCounterVec(&metric.CounterVecOpts{
+		Namespace: namespace,
+		Subsystem: "kafka",
+		Name:      "messages_consumed_total",
+		Help:      "number of messages consumed from kafka",
+		Labels:    []string{"cluster", "topic"},
+	})
+
+	// ConsumerLag is the number of messages behind the high water mark of each partition
+	ConsumerLag = metric.NewGaugeVec(&metric.GaugeVecOpts{
+		Namespace: namespace,
+		Subsystem: "kafka",
+		Name:      "consumer_lag",
+		Help:      "number of messages behind the high water mark of partition",
+		Labels:    []string{"cluster", "topic", "partition"},
+	})
+
+	// MessagesDropped counts the messages dropped by each filter
+	MessagesDropped = metric.NewCounterVec(&metric.CounterVecOpts{
+		Namespace: namespace,
+		Subsystem: "filter",
+		Name:      "messages_dropped_total",
+		Help:      "number of messages dropped by filter",
+		Labels:    []string{"cluster", "filter"},
+	})
+
+	// RowsInserted counts the rows inserted into clickhouse
+	RowsInserted = metric.NewCounterVec(&metric.CounterVecOpts{
+		Namespace: namespace,
+		Subsystem: "clickhouse",
+		Name:      "rows_inserted_total",
+		Help:      "number of rows inserted into clickhouse",
+		Labels:    []string{"cluster", "table"},
+	})
+
+	// RowsRejected counts the rows sent to dead letter, by the stage where they are rejected
+	RowsRejected = metric.NewCounterVec(&metric.CounterVecOpts{
+		Namespace: namespace,
+		Subsystem: "pipeline",
+		Name:      "rows_rejected_total",
+		Help:      "number of rows sent to dead letter",
+		Labels:    []string{"cluster", "stage"},
+	})
+
+	// ConversionErrors counts the values which can not be converted to the types of columns, the rows are rejected
+	ConversionErrors = metric.NewCounterVec(&metric.CounterVecOpts{
+		Namespace: namespace,
+		Subsystem: "clickhouse",
+		Name:      "conversion_errors_total",
+		Help:      "number of values which can not be converted to the types of columns",
+		Labels:    []string{"cluster", "column"},
+	})
+
+	// InsertErrors counts the failed attempts of inserting batches, by the stage where they fail
+	InsertErrors = metric.NewCounterVec(&metric.CounterVecOpts{
+		Namespace: namespace,
+		Subsystem: "clickhouse",
+		Name:      "insert_errors_total",
+		Help:      "number of failed attempts of inserting batches into clickhouse",
+		Labels:    []string{"cluster", "stage"},
+	})
+
+	// BatchRows is the number of rows in each flushed chunk
+	BatchRows = metric.NewHistogramVec(&metric.HistogramVecOpts{
+		Namespace: namespace,
+		Subsystem: "clickhouse",
+		Name:      "batch_rows",
+		Help:      "number of rows in a flushed chunk",
+		Labels:    []string{"cluster"},
+		Buckets:   []float64{1, 10, 100, 500, 1000, 5000, 10000, 50000, 100000},
+	})
+
+	// Flushes counts the flushed chunks, by the reason why they are flushed
+	Flushes = metric.NewCounterVec(&metric.CounterVecOpts{
+		Namespace: namespace,
+		Subsystem: "clickhouse",
+		Name:      "flushes_total",
+		Help:      "number of flushed chunks",
+		Labels:    []string{"cluster", "reason"},
+	})
+
+	// BatchDuration is the time to convert and insert each flushed chunk in milliseconds
+	BatchDuration = metric.NewHistogramVec(&metric.HistogramVecOpts{
+		Namespace: namespace,
+		Subsystem: "clickhouse",
+		Name:      "batch_duration_ms",
+		Help:      "milliseconds to convert and insert a flushed chunk",
+		Labels:    []string{"cluster"},
+		Buckets:   []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000},
+	})
+
+	// QueueRows is the number of rows waiting in the chunk executor to be flushed
+	QueueRows = metric.NewGaugeVec(&metric.GaugeVecOpts{
+		Namespace: namespace,
+		Subsystem: "clickhouse",
+		Name:      "queue_rows",
+		Help:      "number of rows waiting in chunk executor",
+		Labels:    []string{"cluster"},
+	})
+)
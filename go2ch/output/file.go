@@ -0,0 +1,233 @@
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go2ch/go2ch/config"
+	"go2ch/go2ch/pipeline"
+)
+
+// formats of file output
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// backupTimeLayout is the suffix of rotated files, which sorts in time order
+const backupTimeLayout = "20060102-150405.000"
+
+// FileOutput appends rows to a local file in JSONL or CSV format.
+// The file is renamed with the time as suffix when it is rotated, and the oldest ones are removed beyond max backups.
+type FileOutput struct {
+	lock       sync.Mutex
+	path       string
+	format     string
+	columns    []string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	openTime   time.Time
+}
+
+// NewFileOutput opens or creates the file of c for appending rows
+func NewFileOutput(c *config.FileOutputConf) (*FileOutput, error) {
+	if c.Path == "" {
+		return nil, errors.New("newFileOutput | lack path of file output in config")
+	}
+	if c.Format == FormatCSV && len(c.Columns) == 0 {
+		return nil, errors.New("newFileOutput | columns are required by csv file output")
+	}
+	o := &FileOutput{
+		path:       c.Path,
+		format:     c.Format,
+		columns:    c.Columns,
+		maxSize:    int64(c.MaxSizeMB) * 1024 * 1024,
+		interval:   time.Duration(c.RotateIntervalMinute) * time.Minute,
+		maxBackups: c.MaxBackups,
+	}
+	if err := o.open(); err != nil {
+		return nil, fmt.Errorf("newFileOutput | %v", err)
+	}
+	return o, nil
+}
+
+// Write appends row to the file, and it is acked once it is written
+func (o *FileOutput) Write(row *pipeline.Row) error {
+	line, err := o.encode(row)
+	if err != nil {
+		return fmt.Errorf("write | %v", err)
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.shouldRotate(int64(len(line))) {
+		if err := o.rotate(); err != nil {
+			return fmt.Errorf("write | %v", err)
+		}
+	}
+	n, err := o.file.Write(line)
+	o.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write | write row to file[%s] failed: %v", o.path, err)
+	}
+	row.Done()
+	return nil
+}
+
+// Close closes the file
+func (o *FileOutput) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.file.Close()
+}
+
+// encode encodes row to a line in the format of file
+func (o *FileOutput) encode(row *pipeline.Row) ([]byte, error) {
+	if o.format != FormatCSV {
+		bs, err := row.JSON()
+		if err != nil {
+			return nil, fmt.Errorf("encode | %v", err)
+		}
+		return append(bs, '\n'), nil
+	}
+
+	record := make([]string, 0, len(o.columns))
+	for _, column := range o.columns {
+		field, err := csvField(row.Fields[column])
+		if err != nil {
+			return nil, fmt.Errorf("encode | encode field [%s] failed: %v", column, err)
+		}
+		record = append(record, field)
+	}
+	return csvLine(record)
+}
+
+// csvField formats v as a field of csv, strings are kept as they are and the others are in json
+func csvField(v interface{}) (string, error) {
+	switch value := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case time.Time:
+		return value.Format(time.RFC3339Nano), nil
+	}
+	bs, err := json.Marshal(v)
+	return string(bs), err
+}
+
+// csvLine encodes record to a line of csv
+func csvLine(record []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(record); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// shouldRotate reports whether the file is too large to append n bytes, or too old
+func (o *FileOutput) shouldRotate(n int64) bool {
+	if o.size == 0 || o.headerOnly() {
+		return false
+	}
+	if o.maxSize > 0 && o.size+n > o.maxSize {
+		return true
+	}
+	return o.interval > 0 && time.Since(o.openTime) >= o.interval
+}
+
+// headerOnly reports whether there is nothing but the header of csv in the file
+func (o *FileOutput) headerOnly() bool {
+	if o.format != FormatCSV {
+		return false
+	}
+	header, _ := csvLine(o.columns)
+	return o.size == int64(len(header))
+}
+
+// open opens the file for appending, the header is written if it is a new csv file
+func (o *FileOutput) open() error {
+	if dir := filepath.Dir(o.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("open | create directory of file[%s] failed: %v", o.path, err)
+		}
+	}
+	f, err := os.OpenFile(o.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open | open file[%s] failed: %v", o.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open | stat file[%s] failed: %v", o.path, err)
+	}
+	o.file, o.size, o.openTime = f, info.Size(), time.Now()
+
+	if o.size == 0 && o.format == FormatCSV {
+		header, err := csvLine(o.columns)
+		if err != nil {
+			return fmt.Errorf("open | encode header of csv failed: %v", err)
+		}
+		n, err := o.file.Write(header)
+		o.size += int64(n)
+		if err != nil {
+			return fmt.Errorf("open | write header to file[%s] failed: %v", o.path, err)
+		}
+	}
+	return nil
+}
+
+// rotate renames the file with the time as suffix and opens a new one
+func (o *FileOutput) rotate() error {
+	if err := o.file.Close(); err != nil {
+		return fmt.Errorf("rotate | close file[%s] failed: %v", o.path, err)
+	}
+	suffix := time.Now().Format(backupTimeLayout)
+	backup := o.path + "." + suffix
+	// files rotated in the same millisecond are told apart by sequence
+	for i := 1; exists(backup); i++ {
+		backup = fmt.Sprintf("%s.%s-%d", o.path, suffix, i)
+	}
+	if err := os.Rename(o.path, backup); err != nil {
+		return fmt.Errorf("rotate | rename file[%s] failed: %v", o.path, err)
+	}
+	if err := o.open(); err != nil {
+		return err
+	}
+	o.removeBackups()
+	return nil
+}
+
+// removeBackups removes the oldest rotated files beyond max backups
+func (o *FileOutput) removeBackups() {
+	if o.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(o.path + ".*")
+	if err != nil || len(backups) <= o.maxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-o.maxBackups] {
+		_ = os.Remove(backup)
+	}
+}
+
+// exists reports whether there is a file in path
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,123 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/zeromicro/go-zero/core/executors"
+	"github.com/zeromicro/go-zero/core/logx"
+
+	"go2ch/go2ch/config"
+	"go2ch/go2ch/dlq"
+	kf "go2ch/go2ch/kafka"
+	"go2ch/go2ch/metrics"
+	"go2ch/go2ch/pipeline"
+)
+
+// messageWriter writes messages to kafka synchronously
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaOutput republishes rows to a kafka topic with their original keys.
+// Rows are sent in batches, and acked once their batch is written, or rejected to dead letter if it fails.
+type KafkaOutput struct {
+	ctx        context.Context
+	name       string // name of cluster, which labels metrics
+	topic      string
+	writer     messageWriter
+	executor   *executors.BulkExecutor
+	deadLetter dlq.DeadLetter
+}
+
+// NewKafkaOutput creates an output of cluster name which republishes rows to the topic of c through brokers
+func NewKafkaOutput(ctx context.Context, name string, brokers []string, c *config.KafkaOutputConf, deadLetter dlq.DeadLetter) (*KafkaOutput, error) {
+	if c.Topic == "" {
+		return nil, fmt.Errorf("newKafkaOutput | lack topic of kafka output in config")
+	}
+	w, err := kf.NewWriter(ctx, &config.KafkaConf{Brokers: brokers, Topics: []string{c.Topic}})
+	if err != nil {
+		return nil, fmt.Errorf("newKafkaOutput | %v", err)
+	}
+	// a batch is written as soon as it is handed over, since rows are batched by executor already
+	w.Writer.BatchSize = c.BatchSize
+	w.Writer.BatchTimeout = time.Millisecond
+	return newKafkaOutput(ctx, name, c, w.Writer, deadLetter), nil
+}
+
+func newKafkaOutput(ctx context.Context, name string, c *config.KafkaOutputConf, writer messageWriter, deadLetter dlq.DeadLetter) *KafkaOutput {
+	o := &KafkaOutput{
+		ctx:        ctx,
+		name:       name,
+		topic:      c.Topic,
+		writer:     writer,
+		deadLetter: deadLetter,
+	}
+	o.executor = executors.NewBulkExecutor(o.execute, executors.WithBulkTasks(c.BatchSize),
+		executors.WithBulkInterval(time.Duration(c.FlushIntervalMillisecond)*time.Millisecond))
+	return o
+}
+
+// kafkaTask is a row waiting in the batch with its value to republish
+type kafkaTask struct {
+	row   *pipeline.Row
+	value []byte
+}
+
+// Write encodes row in json and adds it to the batch
+func (o *KafkaOutput) Write(row *pipeline.Row) error {
+	value, err := row.JSON()
+	if err != nil {
+		return fmt.Errorf("write | %v", err)
+	}
+	return o.executor.Add(&kafkaTask{row: row, value: value})
+}
+
+// Close sends the rows in batch and closes the writer
+func (o *KafkaOutput) Close() error {
+	o.executor.Flush()
+	return o.writer.Close()
+}
+
+func (o *KafkaOutput) execute(tasks []interface{}) {
+	rows := make([]*pipeline.Row, 0, len(tasks))
+	msgs := make([]kafka.Message, 0, len(tasks))
+	for _, task := range tasks {
+		t := task.(*kafkaTask)
+		rows = append(rows, t.row)
+		msg := kafka.Message{Topic: o.topic, Value: t.value}
+		if t.row.Key != "" {
+			msg.Key = []byte(t.row.Key)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err := o.writer.WriteMessages(o.ctx, msgs...); err != nil {
+		o.reject(rows, fmt.Errorf("execute | republish %d rows to kafka topic[%s] failed: %v", len(rows), o.topic, err))
+		return
+	}
+	for _, row := range rows {
+		row.Done()
+	}
+}
+
+// reject sends rows to dead letter, they are acked only if they are kept by dead letter
+func (o *KafkaOutput) reject(rows []*pipeline.Row, err error) {
+	logx.Errorf("%v", err)
+	metrics.RowsRejected.Add(float64(len(rows)), o.name, dlq.StageSend)
+
+	records := make([]*dlq.Record, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, row.Record(dlq.StageSend, err))
+	}
+	if err := o.deadLetter.Put(records...); err != nil {
+		logx.Errorf("reject | put %d rows to dead letter failed: %v", len(records), err)
+		return
+	}
+	for _, row := range rows {
+		row.Done()
+	}
+}
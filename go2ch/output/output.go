@@ -0,0 +1,77 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"go2ch/go2ch/ch"
+	"go2ch/go2ch/config"
+	"go2ch/go2ch/dlq"
+	"go2ch/go2ch/pipeline"
+)
+
+// Output receives the rows which pass filters.
+// Once Write returns nil, the output owns the row and calls its Ack when the row is written or rejected.
+type Output interface {
+	Write(row *pipeline.Row) error
+	Close() error
+}
+
+// NewOutputs creates every output configured in cluster, the rows which can not be written are sent to deadLetter
+func NewOutputs(ctx context.Context, c *config.Cluster, deadLetter dlq.DeadLetter) ([]Output, error) {
+	if c.Output == nil {
+		return nil, errors.New("newOutputs | lack output in config")
+	}
+	name := c.Input.Kafka.Name
+
+	outputs := make([]Output, 0)
+	if c.Output.ClickHouse != nil {
+		w, err := ch.NewWriter(ctx, name, c.Output.ClickHouse, deadLetter)
+		if err != nil {
+			return nil, fmt.Errorf("newOutputs | %v", err)
+		}
+		outputs = append(outputs, w)
+	}
+	if c.Output.File != nil {
+		f, err := NewFileOutput(c.Output.File)
+		if err != nil {
+			return nil, fmt.Errorf("newOutputs | %v", err)
+		}
+		outputs = append(outputs, f)
+	}
+	if c.Output.Stdout != nil {
+		outputs = append(outputs, NewStdoutOutput(c.Output.Stdout))
+	}
+	if c.Output.Kafka != nil {
+		brokers := c.Output.Kafka.Brokers
+		if len(brokers) == 0 {
+			brokers = c.Input.Kafka.Brokers
+		}
+		k, err := NewKafkaOutput(ctx, name, brokers, c.Output.Kafka, deadLetter)
+		if err != nil {
+			return nil, fmt.Errorf("newOutputs | %v", err)
+		}
+		outputs = append(outputs, k)
+	}
+
+	if len(outputs) == 0 {
+		return nil, errors.New("newOutputs | no output is configured")
+	}
+	return outputs, nil
+}
+
+// AckAfter returns a function which calls ack when it has been called n times,
+// so that a message is acked after all of its rows are done in every output
+func AckAfter(n int, ack func()) func() {
+	if n == 1 || ack == nil {
+		return ack
+	}
+	remaining := int32(n)
+	return func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			ack()
+		}
+	}
+}
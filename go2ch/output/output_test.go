@@ -0,0 +1,198 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+
+	"go2ch/go2ch/config"
+	"go2ch/go2ch/dlq"
+	"go2ch/go2ch/pipeline"
+)
+
+// ackCounter counts how many times rows are acked
+type ackCounter struct {
+	lock  sync.Mutex
+	count int
+}
+
+func (c *ackCounter) ack() {
+	c.lock.Lock()
+	c.count++
+	c.lock.Unlock()
+}
+
+func (c *ackCounter) get() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.count
+}
+
+func newRow(c *ackCounter, data string) *pipeline.Row {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		panic(err)
+	}
+	return &pipeline.Row{Topic: "t", Partition: 1, Offset: 2, Key: "k", Payload: data, Fields: fields, Ack: c.ack}
+}
+
+func TestAckAfter(t *testing.T) {
+	c := &ackCounter{}
+	ack := AckAfter(3, c.ack)
+	ack()
+	ack()
+	assert.Equal(t, 0, c.get())
+	ack()
+	assert.Equal(t, 1, c.get())
+	assert.Nil(t, AckAfter(2, nil))
+}
+
+func TestStdoutOutput(t *testing.T) {
+	c := &ackCounter{}
+	var buf bytes.Buffer
+	o := &StdoutOutput{w: &buf, withMeta: true}
+	assert.Nil(t, o.Write(newRow(c, `{"a":1}`)))
+	assert.Equal(t, "t[1]@2\t{\"a\":1}\n", buf.String())
+	assert.Equal(t, 1, c.get())
+}
+
+func TestFileOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rows", "rows.jsonl")
+	c := &ackCounter{}
+
+	o, err := NewFileOutput(&config.FileOutputConf{Path: path, Format: FormatJSONL, MaxSizeMB: 1, MaxBackups: 2})
+	assert.Nil(t, err)
+	o.maxSize = 10
+	for _, data := range []string{`{"a":1}`, `{"a":2}`, `{"a":3}`, `{"a":4}`} {
+		assert.Nil(t, o.Write(newRow(c, data)))
+	}
+	assert.Nil(t, o.Close())
+	assert.Equal(t, 4, c.get())
+
+	// every row is larger than half of max size, so each is in its own file, and only 2 backups are kept
+	bs, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"a\":4}\n", string(bs))
+	backups, err := filepath.Glob(path + ".*")
+	assert.Nil(t, err)
+	sort.Strings(backups)
+	assert.Len(t, backups, 2)
+	bs, err = ioutil.ReadFile(backups[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"a\":2}\n", string(bs))
+
+	// rotated by time
+	o, err = NewFileOutput(&config.FileOutputConf{Path: path, Format: FormatJSONL, RotateIntervalMinute: 1})
+	assert.Nil(t, err)
+	o.openTime = time.Now().Add(-time.Hour)
+	assert.Nil(t, o.Write(newRow(c, `{"a":5}`)))
+	assert.Nil(t, o.Close())
+	bs, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"a\":5}\n", string(bs))
+}
+
+func TestFileOutputCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rows.csv")
+	c := &ackCounter{}
+
+	_, err := NewFileOutput(&config.FileOutputConf{Path: path, Format: FormatCSV})
+	assert.NotNil(t, err)
+
+	o, err := NewFileOutput(&config.FileOutputConf{Path: path, Format: FormatCSV, Columns: []string{"a", "b", "c"}})
+	assert.Nil(t, err)
+	assert.Nil(t, o.Write(newRow(c, `{"a":"x,y","b":1.5,"c":null}`)))
+	assert.Nil(t, o.Write(newRow(c, `{"b":[1,2],"d":1}`)))
+	// a field which can not be encoded fails the row
+	assert.NotNil(t, o.Write(&pipeline.Row{Fields: map[string]interface{}{"a": func() {}}, Ack: c.ack}))
+	assert.Nil(t, o.Close())
+	assert.Equal(t, 2, c.get())
+
+	// the header is not written again when the file is opened again
+	o, err = NewFileOutput(&config.FileOutputConf{Path: path, Format: FormatCSV, Columns: []string{"a", "b", "c"}})
+	assert.Nil(t, err)
+	assert.Nil(t, o.Close())
+
+	bs, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b,c\n\"x,y\",1.5,\n,\"[1,2]\",\n", string(bs))
+}
+
+// fakeKafka records the messages written, or fails
+type fakeKafka struct {
+	lock sync.Mutex
+	msgs []kafka.Message
+	err  error
+}
+
+func (k *fakeKafka) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.err != nil {
+		return k.err
+	}
+	k.msgs = append(k.msgs, msgs...)
+	return nil
+}
+
+func (k *fakeKafka) Close() error {
+	return nil
+}
+
+// memDeadLetter keeps records in memory
+type memDeadLetter struct {
+	lock    sync.Mutex
+	records []*dlq.Record
+}
+
+func (d *memDeadLetter) Put(records ...*dlq.Record) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.records = append(d.records, records...)
+	return nil
+}
+
+func (d *memDeadLetter) Close() error {
+	return nil
+}
+
+func TestKafkaOutput(t *testing.T) {
+	c := &ackCounter{}
+	k := &fakeKafka{}
+	deadLetter := &memDeadLetter{}
+	o := newKafkaOutput(context.Background(), "c", &config.KafkaOutputConf{Topic: "out", BatchSize: 10, FlushIntervalMillisecond: 1000}, k, deadLetter)
+
+	assert.Nil(t, o.Write(newRow(c, `{"a":1}`)))
+	assert.Nil(t, o.Write(&pipeline.Row{Fields: map[string]interface{}{"a": 2}, Ack: c.ack}))
+	// rows are acked after their batch is sent
+	assert.Equal(t, 0, c.get())
+	o.executor.Flush()
+	assert.Equal(t, 2, c.get())
+	assert.Equal(t, []kafka.Message{
+		{Topic: "out", Key: []byte("k"), Value: []byte(`{"a":1}`)},
+		{Topic: "out", Value: []byte(`{"a":2}`)},
+	}, k.msgs)
+
+	// rows of the failed batch are kept by dead letter, each with its index in the message
+	k.err = errors.New("broker unreachable")
+	row := newRow(c, `{"a":3}`)
+	row.Index = 1
+	assert.Nil(t, o.Write(row))
+	assert.Nil(t, o.Close())
+	assert.Equal(t, 3, c.get())
+	assert.Len(t, deadLetter.records, 1)
+	assert.Equal(t, dlq.StageSend, deadLetter.records[0].Stage)
+	assert.Equal(t, 1, deadLetter.records[0].Index)
+	assert.JSONEq(t, `{"a":3}`, string(deadLetter.records[0].Row))
+}
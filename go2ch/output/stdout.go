@@ -0,0 +1,48 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"go2ch/go2ch/config"
+	"go2ch/go2ch/pipeline"
+)
+
+// StdoutOutput prints rows for debugging, one json per line
+type StdoutOutput struct {
+	lock     sync.Mutex
+	w        io.Writer
+	withMeta bool
+}
+
+// NewStdoutOutput creates an output which prints rows to stdout
+func NewStdoutOutput(c *config.StdoutOutputConf) *StdoutOutput {
+	return &StdoutOutput{w: os.Stdout, withMeta: c.WithMeta}
+}
+
+// Write prints row, and it is acked right away
+func (o *StdoutOutput) Write(row *pipeline.Row) error {
+	bs, err := row.JSON()
+	if err != nil {
+		return fmt.Errorf("write | %v", err)
+	}
+	line := string(bs) + "\n"
+	if o.withMeta {
+		line = fmt.Sprintf("%s[%d]@%d\t%s", row.Topic, row.Partition, row.Offset, line)
+	}
+
+	o.lock.Lock()
+	_, err = io.WriteString(o.w, line)
+	o.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("write | print row failed: %v", err)
+	}
+	row.Done()
+	return nil
+}
+
+func (o *StdoutOutput) Close() error {
+	return nil
+}
@@ -0,0 +1,41 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go2ch/go2ch/dlq"
+)
+
+// Row is a message written to outputs after being filtered
+type Row struct {
+	Topic     string                 // topic of the original kafka message
+	Partition int                    // partition of the original kafka message
+	Offset    int64                  // offset of the original kafka message
+	Key       string                 // key of the original kafka message
+	Payload   string                 // value of the original kafka message
+	Index     int                    // index of the row in the rows decoded from the original kafka message
+	Fields    map[string]interface{} // fields of the message after being filtered, shared by outputs so they must not be changed
+	Ack       func()                 // called once the row is written or rejected, so that its offset can be committed
+}
+
+// Done acknowledges the row has been handled by an output
+func (r *Row) Done() {
+	if r.Ack != nil {
+		r.Ack()
+	}
+}
+
+// Record creates the dead letter record of the row which is rejected at stage because of err
+func (r *Row) Record(stage string, err error) *dlq.Record {
+	return dlq.NewRecord(r.Topic, r.Key, []byte(r.Payload), stage, err).WithRow(r.Index, r.Fields)
+}
+
+// JSON encodes the fields of row in json
+func (r *Row) JSON() ([]byte, error) {
+	bs, err := json.Marshal(r.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("json | marshal fields of row failed: %v", err)
+	}
+	return bs, nil
+}
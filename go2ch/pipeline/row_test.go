@@ -0,0 +1,36 @@
+package pipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go2ch/go2ch/dlq"
+)
+
+func TestRow(t *testing.T) {
+	var acked int
+	row := &Row{Topic: "t", Key: "k", Payload: "a,1\nb,x", Index: 1, Fields: map[string]interface{}{"id": "x"}}
+	// a row without Ack can be done as well
+	row.Done()
+	row.Ack = func() { acked++ }
+	row.Done()
+	assert.Equal(t, 1, acked)
+
+	bs, err := row.JSON()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"id":"x"}`, string(bs))
+
+	record := row.Record(dlq.StageConvert, errors.New("bad id"))
+	assert.Equal(t, "t", record.Topic)
+	assert.Equal(t, "k", record.Key)
+	assert.Equal(t, []byte("a,1\nb,x"), record.Payload)
+	assert.Equal(t, 1, record.Index)
+	assert.JSONEq(t, `{"id":"x"}`, string(record.Row))
+	assert.Equal(t, "bad id", record.Error)
+
+	row.Fields = map[string]interface{}{"f": func() {}}
+	_, err = row.JSON()
+	assert.NotNil(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"go2ch/go2ch/dlq"
 	kf "go2ch/go2ch/kafka"
 )
 
@@ -63,3 +64,21 @@ func (p *Pusher) PushList(resp http.ResponseWriter, req *http.Request) {
 	resp.Write([]byte("push data successfully"))
 	return
 }
+
+// Replay pushes the original messages of dead letter records to kafka again, the body is records in JSONL format
+func (p *Pusher) Replay(resp http.ResponseWriter, req *http.Request) {
+	records, err := dlq.ReadRecords(req.Body)
+	if err != nil {
+		resp.Write([]byte(fmt.Sprintf("Replay | read dead letter records failed:%v", err)))
+		return
+	}
+	for _, record := range records {
+		err = p.kafka.ProduceRaw(record.Topic, []byte(record.Key), record.Payload)
+		if err != nil {
+			resp.Write([]byte(fmt.Sprintf("Replay | send one record to kafka failed:%v", err)))
+			return
+		}
+	}
+	resp.Write([]byte(fmt.Sprintf("replay %d records successfully", len(records))))
+	return
+}
@@ -0,0 +1,178 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/rest"
+	"github.com/zeromicro/go-zero/rest/httpx"
+
+	"go2ch/go2ch/ch"
+	kf "go2ch/go2ch/kafka"
+)
+
+const checkTimeout = 5 * time.Second
+
+// Writer is the clickhouse writer of a cluster
+type Writer interface {
+	Ping(ctx context.Context) error
+	Status() ch.Status
+}
+
+// DescribeFunc returns the state of consumer group through brokers
+type DescribeFunc func(ctx context.Context, brokers []string, group string) (*kf.GroupState, error)
+
+// Cluster is a pipeline from kafka to clickhouse
+type Cluster struct {
+	Name    string
+	Brokers []string
+	Group   string
+	Topics  []string
+	Writer  Writer // nil if the cluster does not output to clickhouse
+}
+
+// ClusterStatus is the state of a cluster shown on status page
+type ClusterStatus struct {
+	Name       string         `json:"name"`
+	Topics     []string       `json:"topics"`
+	Group      string         `json:"group"`
+	GroupState *kf.GroupState `json:"group_state,omitempty"`
+	Writer     *ch.Status     `json:"writer,omitempty"`
+	Errors     []string       `json:"errors,omitempty"` // why the cluster is not ready
+}
+
+// Server serves the health, readiness and status of clusters
+type Server struct {
+	clusters []*Cluster
+	describe DescribeFunc
+}
+
+// NewServer creates a status server of clusters
+func NewServer(clusters []*Cluster) *Server {
+	return &Server{
+		clusters: clusters,
+		describe: kf.DescribeGroup,
+	}
+}
+
+// Routes returns the routes of status server
+func (s *Server) Routes() []rest.Route {
+	return []rest.Route{
+		{
+			Path:    "/healthz",
+			Method:  http.MethodGet,
+			Handler: s.Healthz,
+		},
+		{
+			Path:    "/readyz",
+			Method:  http.MethodGet,
+			Handler: s.Readyz,
+		},
+		{
+			Path:    "/status",
+			Method:  http.MethodGet,
+			Handler: s.Status,
+		},
+	}
+}
+
+// Healthz responds 200 if clickhouse can be reached by every writer, otherwise 503
+func (s *Server) Healthz(resp http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), checkTimeout)
+	defer cancel()
+
+	statuses := make([]*ClusterStatus, 0, len(s.clusters))
+	healthy := true
+	for _, c := range s.clusters {
+		status := &ClusterStatus{Name: c.Name, Topics: c.Topics, Group: c.Group}
+		if err := ping(ctx, c); err != nil {
+			status.Errors = append(status.Errors, err.Error())
+			healthy = false
+		}
+		statuses = append(statuses, status)
+	}
+	write(resp, healthy, statuses)
+}
+
+// Readyz responds 200 if clickhouse can be reached by every writer, and the consumers of every cluster
+// are attached to a stable consumer group, otherwise 503
+func (s *Server) Readyz(resp http.ResponseWriter, req *http.Request) {
+	statuses := s.check(req.Context())
+	ready := true
+	for _, status := range statuses {
+		if len(status.Errors) > 0 {
+			ready = false
+		}
+	}
+	write(resp, ready, statuses)
+}
+
+// Status responds the state of every cluster in json
+func (s *Server) Status(resp http.ResponseWriter, req *http.Request) {
+	httpx.OkJson(resp, s.check(req.Context()))
+}
+
+// check checks clusters concurrently
+func (s *Server) check(ctx context.Context) []*ClusterStatus {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	statuses := make([]*ClusterStatus, len(s.clusters))
+	var wg sync.WaitGroup
+	for i, c := range s.clusters {
+		wg.Add(1)
+		go func(i int, c *Cluster) {
+			defer wg.Done()
+			statuses[i] = s.checkCluster(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// checkCluster pings clickhouse and describes the consumer group of c
+func (s *Server) checkCluster(ctx context.Context, c *Cluster) *ClusterStatus {
+	status := &ClusterStatus{
+		Name:   c.Name,
+		Topics: c.Topics,
+		Group:  c.Group,
+	}
+	if c.Writer != nil {
+		writerStatus := c.Writer.Status()
+		status.Writer = &writerStatus
+	}
+	if err := ping(ctx, c); err != nil {
+		status.Errors = append(status.Errors, err.Error())
+	}
+
+	state, err := s.describe(ctx, c.Brokers, c.Group)
+	if err != nil {
+		status.Errors = append(status.Errors, err.Error())
+		return status
+	}
+	status.GroupState = state
+	if !state.Stable() {
+		status.Errors = append(status.Errors, fmt.Sprintf("consumer group[%s] is not stable: state=%s, members=%d", c.Group, state.State, state.Members))
+	}
+	return status
+}
+
+// ping pings clickhouse through the writer of c if there is
+func ping(ctx context.Context, c *Cluster) error {
+	if c.Writer == nil {
+		return nil
+	}
+	return c.Writer.Ping(ctx)
+}
+
+// write responds statuses, in 200 if ok, otherwise 503
+func write(resp http.ResponseWriter, ok bool, statuses []*ClusterStatus) {
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	httpx.WriteJson(resp, code, statuses)
+}
@@ -0,0 +1,114 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go2ch/go2ch/ch"
+	kf "go2ch/go2ch/kafka"
+)
+
+type fakeWriter struct {
+	err error
+}
+
+func (w *fakeWriter) Ping(ctx context.Context) error {
+	return w.err
+}
+
+func (w *fakeWriter) Status() ch.Status {
+	return ch.Status{Table: "t", PendingBytes: 10}
+}
+
+func TestServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		pingErr  error
+		state    *kf.GroupState
+		groupErr error
+		healthz  int
+		readyz   int
+	}{
+		{
+			name:    "ok",
+			state:   &kf.GroupState{State: "Stable", Members: 2},
+			healthz: http.StatusOK,
+			readyz:  http.StatusOK,
+		},
+		{
+			name:    "clickhouse unreachable",
+			pingErr: errors.New("connection refused"),
+			state:   &kf.GroupState{State: "Stable", Members: 2},
+			healthz: http.StatusServiceUnavailable,
+			readyz:  http.StatusServiceUnavailable,
+		},
+		{
+			name:    "rebalancing",
+			state:   &kf.GroupState{State: "PreparingRebalance", Members: 2},
+			healthz: http.StatusOK,
+			readyz:  http.StatusServiceUnavailable,
+		},
+		{
+			name:    "no consumers",
+			state:   &kf.GroupState{State: "Empty"},
+			healthz: http.StatusOK,
+			readyz:  http.StatusServiceUnavailable,
+		},
+		{
+			name:     "kafka unreachable",
+			groupErr: errors.New("dial failed"),
+			healthz:  http.StatusOK,
+			readyz:   http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer([]*Cluster{{Name: "c", Group: "g", Topics: []string{"t"}, Writer: &fakeWriter{err: test.pingErr}}})
+			s.describe = func(ctx context.Context, brokers []string, group string) (*kf.GroupState, error) {
+				return test.state, test.groupErr
+			}
+
+			resp := httptest.NewRecorder()
+			s.Healthz(resp, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			assert.Equal(t, test.healthz, resp.Code)
+
+			resp = httptest.NewRecorder()
+			s.Readyz(resp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, test.readyz, resp.Code)
+
+			resp = httptest.NewRecorder()
+			s.Status(resp, httptest.NewRequest(http.MethodGet, "/status", nil))
+			assert.Equal(t, http.StatusOK, resp.Code)
+			var statuses []*ClusterStatus
+			assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &statuses))
+			assert.Len(t, statuses, 1)
+			assert.Equal(t, "t", statuses[0].Writer.Table)
+			assert.Equal(t, int64(10), statuses[0].Writer.PendingBytes)
+			assert.Equal(t, test.readyz != http.StatusOK, len(statuses[0].Errors) > 0)
+		})
+	}
+}
+
+func TestServerWithoutWriter(t *testing.T) {
+	s := NewServer([]*Cluster{{Name: "c", Group: "g", Topics: []string{"t"}}})
+	s.describe = func(ctx context.Context, brokers []string, group string) (*kf.GroupState, error) {
+		return &kf.GroupState{State: "Stable", Members: 1}, nil
+	}
+
+	resp := httptest.NewRecorder()
+	s.Healthz(resp, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = httptest.NewRecorder()
+	s.Status(resp, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var statuses []*ClusterStatus
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &statuses))
+	assert.Nil(t, statuses[0].Writer)
+}
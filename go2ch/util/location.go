@@ -0,0 +1,22 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// locations caches the locations loaded by name, see LoadLocation
+var locations sync.Map
+
+// LoadLocation returns the location of name like time.LoadLocation, each location is loaded once and cached
+func LoadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}